@@ -1,7 +1,10 @@
 package api
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -15,6 +18,8 @@ import (
 	"time"
 
 	"golang.org/x/crypto/nacl/secretbox"
+
+	"github.com/danderson/pixiecore/log"
 )
 
 // A BootSpec identifies a kernel, kernel commandline, and set of initrds to boot on a machine.
@@ -28,6 +33,143 @@ type BootSpec struct {
 	Kernel  string
 	Initrd  []string
 	Cmdline string
+
+	// ByArch optionally overrides Kernel, Initrd and Cmdline for
+	// clients of a particular system architecture, keyed by the
+	// architecture code the client sent in DHCP option 93.
+	ByArch map[uint16]ArchSpec
+
+	// Files are auxiliary files that the booted OS can fetch, e.g. a
+	// kickstart or cloud-init config, keyed by name. Like Kernel and
+	// Initrd, the values are references to pass to Booter.File. The
+	// commandline can point at them with {{.Files.<name>}}, which
+	// expands to the file's URL.
+	Files map[string]string
+
+	// EFIDirect says that Kernel is an EFI executable that UEFI HTTP
+	// Boot firmware can boot without a bootloader, such as a unified
+	// kernel image with its initrd and commandline built in. HTTP
+	// Boot clients then get the kernel in place of their
+	// bootloader, and Initrd and Cmdline are ignored for them.
+	EFIDirect bool
+
+	// Menu optionally has pxelinux show a boot menu instead of
+	// booting Kernel straight away, e.g. to choose between an
+	// installer, a rescue image and the local disk. The menu needs
+	// menu.c32 and its library modules to be served alongside
+	// ldlinux.c32. Clients that don't run pxelinux (iPXE, UEFI HTTP
+	// Boot) ignore the menu and boot Kernel.
+	Menu *Menu
+}
+
+// A Menu is a pxelinux boot menu.
+type Menu struct {
+	Title   string
+	Entries []MenuEntry
+	// The Label of the entry to boot when Timeout runs out. Empty
+	// means the first entry.
+	Default string
+	// How long to wait for a choice before booting Default. Zero
+	// means wait forever.
+	Timeout time.Duration
+}
+
+// A MenuEntry is one choice in a Menu. Kernel and Initrd are
+// references to pass to Booter.File, like in BootSpec.
+type MenuEntry struct {
+	// Short unique name of the entry, and its text in the menu.
+	Label string
+	Title string
+	// If LocalBoot is set, the entry boots from local disk, and
+	// Kernel, Initrd and Cmdline are ignored.
+	LocalBoot bool
+	Kernel    string
+	Initrd    []string
+	Cmdline   string
+}
+
+// copy returns a deep copy of m.
+func (m *Menu) copy() *Menu {
+	if m == nil {
+		return nil
+	}
+	ret := *m
+	ret.Entries = make([]MenuEntry, len(m.Entries))
+	for i, e := range m.Entries {
+		e.Initrd = append([]string(nil), e.Initrd...)
+		ret.Entries[i] = e
+	}
+	return &ret
+}
+
+// Check checks that m's entries make sense: that each has a unique
+// label and something to boot, and that the default entry exists.
+func (m *Menu) Check() error {
+	labels := map[string]bool{}
+	for _, e := range m.Entries {
+		if e.Label == "" || strings.ContainsAny(e.Label, " \t") {
+			return fmt.Errorf("invalid entry label %q", e.Label)
+		}
+		if labels[e.Label] {
+			return fmt.Errorf("duplicate entry label %q", e.Label)
+		}
+		labels[e.Label] = true
+		if !e.LocalBoot && e.Kernel == "" {
+			return fmt.Errorf("no kernel specified for entry %q", e.Label)
+		}
+	}
+	if len(labels) == 0 {
+		return errors.New("no entries")
+	}
+	if m.Default != "" && !labels[m.Default] {
+		return fmt.Errorf("default entry %q doesn't exist", m.Default)
+	}
+	return nil
+}
+
+// An ArchSpec is the architecture-specific part of a BootSpec.
+type ArchSpec struct {
+	Kernel  string
+	Initrd  []string
+	Cmdline string
+}
+
+// ForArch returns the BootSpec to use for a client of the given
+// architecture. If s has no entry for arch, the default fields are
+// used. The returned BootSpec has no ByArch, and can be modified
+// without affecting s.
+func (s *BootSpec) ForArch(arch uint16) *BootSpec {
+	flat := *s
+	flat.ByArch = nil
+	ret := flat.Clone()
+	if a, ok := s.ByArch[arch]; ok {
+		ret.Kernel = a.Kernel
+		ret.Initrd = append([]string(nil), a.Initrd...)
+		ret.Cmdline = a.Cmdline
+	}
+	return ret
+}
+
+// Clone returns a deep copy of s, which can be modified without
+// affecting s.
+func (s *BootSpec) Clone() *BootSpec {
+	ret := *s
+	ret.Initrd = append([]string(nil), s.Initrd...)
+	if s.Files != nil {
+		ret.Files = make(map[string]string, len(s.Files))
+		for k, v := range s.Files {
+			ret.Files[k] = v
+		}
+	}
+	if s.ByArch != nil {
+		ret.ByArch = make(map[uint16]ArchSpec, len(s.ByArch))
+		for arch, a := range s.ByArch {
+			a.Initrd = append([]string(nil), a.Initrd...)
+			ret.ByArch[arch] = a
+		}
+	}
+	ret.Menu = s.Menu.copy()
+	return &ret
 }
 
 // A Booter tells Pixiecore whether/how to boot machines.
@@ -46,6 +188,389 @@ type Booter interface {
 	File(id string) (io.ReadCloser, string, error)
 }
 
+// A ContextBooter is a Booter whose lookups can be cancelled, e.g.
+// when the client that needs the answer goes away. Pixiecore uses
+// these methods in preference to the Booter ones when they're
+// available.
+type ContextBooter interface {
+	Booter
+	BootSpecContext(ctx context.Context, hw net.HardwareAddr) (*BootSpec, error)
+	FileContext(ctx context.Context, id string) (io.ReadCloser, string, error)
+}
+
+// WithContext returns b as a ContextBooter. If b doesn't already
+// implement ContextBooter, the returned Booter ignores contexts.
+func WithContext(b Booter) ContextBooter {
+	if cb, ok := b.(ContextBooter); ok {
+		return cb
+	}
+	return contextBooter{b}
+}
+
+type contextBooter struct {
+	Booter
+}
+
+func (b contextBooter) BootSpecContext(ctx context.Context, hw net.HardwareAddr) (*BootSpec, error) {
+	return b.BootSpec(hw)
+}
+
+func (b contextBooter) FileContext(ctx context.Context, id string) (io.ReadCloser, string, error) {
+	return b.File(id)
+}
+
+func (b contextBooter) Unwrap() Booter {
+	return b.Booter
+}
+
+// PeekBootSpec passes through to the wrapped Booter, so that wrapping
+// doesn't hide its Peeker implementation.
+func (b contextBooter) PeekBootSpec(ctx context.Context, hw net.HardwareAddr, profile string) (*BootSpec, error) {
+	return PeekBootSpec(ctx, b.Booter, hw, profile)
+}
+
+// Errors that Booters can return from ShouldBoot and BootSpec, to say
+// why a machine shouldn't netboot. Pixiecore compares against them
+// directly, so return them as is rather than wrapped in another
+// error. Any other error is handled according to the HTTP server's
+// fallback policy.
+var (
+	// ErrUnknownMAC means the Booter has never heard of the
+	// machine. Pixiecore can give such machines an onboarding boot
+	// instead, e.g. into an inventory image.
+	ErrUnknownMAC = errors.New("unknown MAC address")
+	// ErrBootFromDisk means the machine is known, and should boot
+	// from its local disk.
+	ErrBootFromDisk = errors.New("machine should boot from disk")
+)
+
+// Errors that Booters can return from File, to tell Pixiecore how to
+// answer the client. As above, return them as is. Any other error is
+// a server error.
+var (
+	// ErrNotFound means there's no file with the requested ID.
+	ErrNotFound = errors.New("no such file")
+	// ErrTemporary means the file can't be served right now, but
+	// might be if the client tries again later. ShouldBoot and
+	// BootSpec can return it too, e.g. when the Booter's backend is
+	// down. Such machines still get a DHCP offer, and once they're
+	// in pxelinux or iPXE they're told to retry after a short
+	// delay.
+	ErrTemporary = errors.New("temporarily unavailable")
+)
+
+// A ProfileBooter is a Booter that can boot machines into one of
+// several profiles, e.g. "minimal", "full" or "rescue". Machines ask
+// for a profile with their DHCP user class (option 77), or by
+// fetching their config with a profile in the URL.
+type ProfileBooter interface {
+	Booter
+	// BootSpecProfile is like BootSpec, for the named profile. An
+	// empty profile means the machine didn't ask for one.
+	BootSpecProfile(ctx context.Context, hw net.HardwareAddr, profile string) (*BootSpec, error)
+}
+
+// WithProfiles returns b as a ProfileBooter. If b doesn't already
+// implement ProfileBooter, the returned Booter ignores profiles.
+func WithProfiles(b Booter) ProfileBooter {
+	if pb, ok := b.(ProfileBooter); ok {
+		return pb
+	}
+	return profileBooter{WithContext(b)}
+}
+
+type profileBooter struct {
+	ContextBooter
+}
+
+func (b profileBooter) BootSpecProfile(ctx context.Context, hw net.HardwareAddr, profile string) (*BootSpec, error) {
+	return b.BootSpecContext(ctx, hw)
+}
+
+func (b profileBooter) Unwrap() Booter {
+	return b.ContextBooter
+}
+
+// A Peeker is a Booter whose BootSpec has no side effects, or that
+// can answer without them. Booters that keep track of the specs they
+// hand out, e.g. to netboot each machine once, count every BootSpec
+// as a boot; PeekBootSpec lets Pixiecore show what a machine would
+// boot without using that up.
+type Peeker interface {
+	Booter
+	// PeekBootSpec is like BootSpecProfile, but nothing that the
+	// Booter does with its answer happens.
+	PeekBootSpec(ctx context.Context, hw net.HardwareAddr, profile string) (*BootSpec, error)
+}
+
+// PeekBootSpec asks b what it would boot hw into, without side
+// effects. If b isn't a Peeker, there's no way to know whether
+// BootSpec has any, so it only asks ShouldBoot, and the spec is nil
+// even if hw would netboot.
+func PeekBootSpec(ctx context.Context, b Booter, hw net.HardwareAddr, profile string) (*BootSpec, error) {
+	if p, ok := b.(Peeker); ok {
+		return p.PeekBootSpec(ctx, hw, profile)
+	}
+	return nil, b.ShouldBoot(hw)
+}
+
+// A HealthChecker is a Booter that can report whether it's able to
+// serve requests, e.g. whether its backend is reachable. Booters that
+// don't implement it are assumed to always be healthy.
+type HealthChecker interface {
+	Healthy() error
+}
+
+// Healthy returns the first error from b and the Booters it wraps
+// that are HealthCheckers, or nil if they're all healthy.
+func Healthy(b Booter) error {
+	for ; b != nil; b = Unwrap(b) {
+		if hc, ok := b.(HealthChecker); ok {
+			if err := hc.Healthy(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// A ProgressRecorder is a Booter that wants to know how machines'
+// boots are going, e.g. so that it can stop netbooting machines that
+// keep failing. Machines (or rather, the software they boot) report
+// their progress to a signed Pixiecore URL, which BootSpec cmdlines
+// get as {{.ProgressURL}}, with a free-form status string such as
+// "installing" or "failed".
+type ProgressRecorder interface {
+	RecordProgress(hw net.HardwareAddr, status string)
+}
+
+// RecordProgress tells b, and each Booter it wraps, that's a
+// ProgressRecorder how hw's boot is going.
+func RecordProgress(b Booter, hw net.HardwareAddr, status string) {
+	for ; b != nil; b = Unwrap(b) {
+		if pr, ok := b.(ProgressRecorder); ok {
+			pr.RecordProgress(hw, status)
+		}
+	}
+}
+
+// A Checksummed byte stream knows the SHA-256 digest its contents
+// should have. If the ReadCloser returned by Booter.File implements
+// it, Pixiecore checks the digest as it serves the file, and cuts the
+// transfer off if it doesn't match, rather than let the client boot
+// corrupted bytes.
+type Checksummed interface {
+	SHA256() []byte
+}
+
+// WithSHA256 returns f as a Checksummed byte stream whose contents
+// should have the SHA-256 digest sum. If f is a SizedReadCloser or an
+// io.Seeker, so is the result.
+func WithSHA256(f io.ReadCloser, sum []byte) io.ReadCloser {
+	c := checksummed{f, sum}
+	s, seeker := f.(io.ReadSeeker)
+	z, sized := f.(SizedReadCloser)
+	switch {
+	case seeker && sized:
+		return checksummedSizedSeeker{checksummedSized{c, z}, s}
+	case seeker:
+		return checksummedSeeker{c, s}
+	case sized:
+		return checksummedSized{c, z}
+	}
+	return c
+}
+
+type checksummed struct {
+	io.ReadCloser
+	sum []byte
+}
+
+func (c checksummed) SHA256() []byte { return c.sum }
+
+type checksummedSized struct {
+	checksummed
+	f SizedReadCloser
+}
+
+func (c checksummedSized) Size() int64 { return c.f.Size() }
+
+type checksummedSeeker struct {
+	checksummed
+	f io.Seeker
+}
+
+func (c checksummedSeeker) Seek(offset int64, whence int) (int64, error) {
+	return c.f.Seek(offset, whence)
+}
+
+type checksummedSizedSeeker struct {
+	checksummedSized
+	s io.Seeker
+}
+
+func (c checksummedSizedSeeker) Seek(offset int64, whence int) (int64, error) {
+	return c.s.Seek(offset, whence)
+}
+
+// ParseSHA256 parses s, a SHA-256 digest in hex.
+func ParseSHA256(s string) ([]byte, error) {
+	sum, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SHA-256 digest %q: %s", s, err)
+	}
+	if len(sum) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256 digest %q: wrong length", s)
+	}
+	return sum, nil
+}
+
+// An Enumerator is a Booter that can list everything it would boot,
+// for auditing. The map is keyed by MAC address, with "*" for the
+// spec given to machines that aren't listed individually. Booters
+// that decide dynamically, like the remote API Booter, can't
+// implement it.
+type Enumerator interface {
+	ListSpecs() (map[string]BootSpec, error)
+}
+
+// ErrNotEnumerable is returned by ListSpecs on Booters that wrap
+// another Booter, when the wrapped Booter isn't an Enumerator.
+var ErrNotEnumerable = errors.New("Booter can't list what it boots")
+
+// A Reloader is a Booter that can re-read its configuration on
+// demand, e.g. when Pixiecore gets SIGHUP. Reload should swap in the
+// new configuration atomically, and keep the old one if reading the
+// new one fails. Files already handed out by File keep streaming.
+// A Wrapper only reloads its own configuration, see the Reload
+// function.
+type Reloader interface {
+	Reload() error
+}
+
+// ErrNotReloadable is returned by Reload for Booters that aren't
+// Reloaders. Reloaders can return it too, if they turn out to have
+// nothing to reload.
+var ErrNotReloadable = errors.New("Booter can't reload its configuration")
+
+// Reload reloads the configuration of b, and of each Booter it wraps,
+// that's a Reloader, and returns the first error, if any. It's only
+// ErrNotReloadable if none of them are.
+func Reload(b Booter) error {
+	var (
+		ret        error
+		reloadable bool
+	)
+	for ; b != nil; b = Unwrap(b) {
+		r, ok := b.(Reloader)
+		if !ok {
+			continue
+		}
+		err := r.Reload()
+		if err == ErrNotReloadable {
+			continue
+		}
+		reloadable = true
+		if err != nil && ret == nil {
+			ret = err
+		}
+	}
+	if !reloadable {
+		return ErrNotReloadable
+	}
+	return ret
+}
+
+// A Wrapper is a Booter that wraps another, e.g. to netboot machines
+// only once, or to log what the wrapped Booter says. Wrappers
+// implement the methods whose behavior they change, and Unwrap. The
+// functions that deal with optional interfaces, like Reload and
+// AsEnumerator, look through Unwrap for them, so that wrapping a
+// Booter neither hides them nor adds ones it doesn't have.
+type Wrapper interface {
+	Booter
+	Unwrap() Booter
+}
+
+// Unwrap returns the Booter that b wraps, or nil if b isn't a
+// Wrapper.
+func Unwrap(b Booter) Booter {
+	if w, ok := b.(Wrapper); ok {
+		return w.Unwrap()
+	}
+	return nil
+}
+
+// AsEnumerator returns the first of b and the Booters it wraps that's
+// an Enumerator, or nil if none is. A Wrapper's list is an edit of
+// the one its wrapped Booter gives, so a Wrapper that's an Enumerator
+// only counts if the wrapped Booter has one too.
+func AsEnumerator(b Booter) Enumerator {
+	e, _ := find(b, func(b Booter) bool {
+		_, ok := b.(Enumerator)
+		return ok
+	}).(Enumerator)
+	return e
+}
+
+// AsContentHasher is AsEnumerator for ContentHashers.
+func AsContentHasher(b Booter) ContentHasher {
+	h, _ := find(b, func(b Booter) bool {
+		_, ok := b.(ContentHasher)
+		return ok
+	}).(ContentHasher)
+	return h
+}
+
+// find returns the first of b and the Booters it wraps that is
+// returns true for, or nil. A Wrapper only counts if the Booter it
+// wraps has one too.
+func find(b Booter, is func(Booter) bool) Booter {
+	for ; b != nil; b = Unwrap(b) {
+		if !is(b) {
+			continue
+		}
+		if inner := Unwrap(b); inner != nil && find(inner, is) == nil {
+			return nil
+		}
+		return b
+	}
+	return nil
+}
+
+// A ContentHasher is a Booter that can compute the SHA-256 digest of
+// a file's contents, as a lowercase hex string, without serving it.
+// Pixiecore can then give out URLs based on file contents rather than
+// IDs, so that caching proxies can tell when machines boot identical
+// files.
+type ContentHasher interface {
+	ContentHash(id string) (string, error)
+}
+
+// A SizedReadCloser is a byte stream that knows its total size. If
+// the ReadCloser returned by Booter.File implements it, Pixiecore
+// tells clients the size of the file up front.
+type SizedReadCloser interface {
+	io.ReadCloser
+	Size() int64
+}
+
+// A Precompressed byte stream knows whether its contents are already
+// compressed. If the ReadCloser returned by Booter.File implements it
+// and reports true, Pixiecore won't try to compress it further for
+// clients that accept compressed transfers.
+type Precompressed interface {
+	Precompressed() bool
+}
+
+// sizedBody is an HTTP response body of known length.
+type sizedBody struct {
+	io.ReadCloser
+	size int64
+}
+
+func (b sizedBody) Size() int64 { return b.size }
+
 // RemoteBooter gets a BootSpec from a remote server over HTTP.
 //
 // The API is described in README.api.md
@@ -70,91 +595,312 @@ type remoteBooter struct {
 	key       [32]byte
 }
 
-func (b *remoteBooter) getSpec(hw net.HardwareAddr) (string, []string, string, error) {
-	reqURL := fmt.Sprintf("%s/boot/%s", b.urlPrefix, hw)
-	resp, err := b.client.Get(reqURL)
-	if err != nil {
-		return "", nil, "", err
+// A SpecResponse is a boot API server's response for a machine, in
+// the JSON format described in README.api.md.
+type SpecResponse struct {
+	Kernel  string            `json:"kernel"`
+	Initrd  []string          `json:"initrd"`
+	Cmdline string            `json:"cmdline"`
+	Files   map[string]string `json:"files"`
+	// Whether the kernel can be booted directly by UEFI HTTP Boot
+	// clients.
+	EFIDirect bool `json:"efi_direct"`
+	// Expected SHA-256 digests of files, in hex, keyed by the same
+	// references as the files themselves.
+	SHA256 map[string]string `json:"sha256"`
+	// Optional pxelinux boot menu.
+	Menu *SpecMenu `json:"menu"`
+}
+
+// A SpecMenu is the boot menu in a SpecResponse. See Menu.
+type SpecMenu struct {
+	Title   string `json:"title"`
+	Default string `json:"default"`
+	// In seconds.
+	Timeout int             `json:"timeout"`
+	Entries []SpecMenuEntry `json:"entries"`
+}
+
+// A SpecMenuEntry is one choice in a SpecMenu. See MenuEntry.
+type SpecMenuEntry struct {
+	Label   string   `json:"label"`
+	Title   string   `json:"title"`
+	Local   bool     `json:"local"`
+	Kernel  string   `json:"kernel"`
+	Initrd  []string `json:"initrd"`
+	Cmdline string   `json:"cmdline"`
+}
+
+// BootSpec checks r, and returns it as a BootSpec. Each file the spec
+// refers to (kernel, initrds, files and menu entries' kernels and
+// initrds) is passed through ref along with its expected digest, or
+// "" if there is none, and the BootSpec gets the reference it returns.
+func (r *SpecResponse) BootSpec(ref func(f, sum string) (string, error)) (*BootSpec, error) {
+	if r.Kernel == "" {
+		return nil, errors.New("no kernel specified")
 	}
-	if resp.StatusCode != http.StatusOK {
-		return "", nil, "", fmt.Errorf("%s: %s", reqURL, http.StatusText(resp.StatusCode))
+	for f, sum := range r.SHA256 {
+		if _, err := ParseSHA256(sum); err != nil {
+			return nil, fmt.Errorf("bad digest for %q: %s", f, err)
+		}
+	}
+	refs := func(fs []string) ([]string, error) {
+		var ret []string
+		for _, f := range fs {
+			s, err := ref(f, r.SHA256[f])
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, s)
+		}
+		return ret, nil
 	}
 
-	r := struct {
-		Kernel  string   `json:"kernel"`
-		Initrd  []string `json:"initrd"`
-		Cmdline string   `json:"cmdline"`
-	}{}
-	if err = json.NewDecoder(resp.Body).Decode(&r); err != nil {
-		return "", nil, "", fmt.Errorf("non-json response from %s: %s", reqURL, err)
+	ret := &BootSpec{
+		Cmdline:   r.Cmdline,
+		EFIDirect: r.EFIDirect,
+	}
+	var err error
+	if ret.Kernel, err = ref(r.Kernel, r.SHA256[r.Kernel]); err != nil {
+		return nil, err
+	}
+	if ret.Initrd, err = refs(r.Initrd); err != nil {
+		return nil, err
+	}
+	for name, f := range r.Files {
+		s, err := ref(f, r.SHA256[f])
+		if err != nil {
+			return nil, err
+		}
+		if ret.Files == nil {
+			ret.Files = map[string]string{}
+		}
+		ret.Files[name] = s
+	}
+	if r.Menu == nil {
+		return ret, nil
 	}
 
-	// Check that the API server gave us absolute URLs for everything
-	u, err := url.Parse(r.Kernel)
+	ret.Menu = &Menu{
+		Title:   r.Menu.Title,
+		Default: r.Menu.Default,
+		Timeout: time.Duration(r.Menu.Timeout) * time.Second,
+	}
+	for _, e := range r.Menu.Entries {
+		entry := MenuEntry{
+			Label:     e.Label,
+			Title:     e.Title,
+			LocalBoot: e.Local,
+			Cmdline:   e.Cmdline,
+		}
+		if !e.Local && e.Kernel != "" {
+			if entry.Kernel, err = ref(e.Kernel, r.SHA256[e.Kernel]); err != nil {
+				return nil, err
+			}
+			if entry.Initrd, err = refs(e.Initrd); err != nil {
+				return nil, err
+			}
+		}
+		ret.Menu.Entries = append(ret.Menu.Entries, entry)
+	}
+	if err = ret.Menu.Check(); err != nil {
+		return nil, fmt.Errorf("bad menu: %s", err)
+	}
+	return ret, nil
+}
+
+// SHA256Ref returns the file reference f with its expected digest sum,
+// in hex, attached, or just f if sum is empty. It's a ref function for
+// SpecResponse.BootSpec, for Booters whose file references are the
+// ones in the SpecResponse. SplitSHA256Ref takes the result apart
+// again in File.
+func SHA256Ref(f, sum string) (string, error) {
+	if sum == "" {
+		return f, nil
+	}
+	return f + "\n" + sum, nil
+}
+
+// SplitSHA256Ref returns the file reference and digest that SHA256Ref
+// put together. The digest is nil if there isn't one.
+func SplitSHA256Ref(ref string) (string, []byte, error) {
+	i := strings.IndexByte(ref, '\n')
+	if i < 0 {
+		return ref, nil, nil
+	}
+	sum, err := ParseSHA256(ref[i+1:])
 	if err != nil {
-		return "", nil, "", fmt.Errorf("non-url %q provided by %s for kernel: %s", r.Kernel, reqURL, err)
+		return "", nil, err
 	}
-	if !u.IsAbs() {
-		return "", nil, "", fmt.Errorf("kernel URL %q provided by %s is not absolute", u, reqURL)
+	return ref[:i], sum, nil
+}
+
+// SpecRequest returns a request for hw's boot spec in profile (""
+// for the default) from the boot API at urlPrefix, e.g.
+// "http://api/v1". Callers can add headers to it before passing it to
+// FetchSpec.
+func SpecRequest(ctx context.Context, urlPrefix string, hw net.HardwareAddr, profile string) (*http.Request, error) {
+	reqURL := fmt.Sprintf("%s/boot/%s", urlPrefix, hw)
+	if profile != "" {
+		reqURL += "?profile=" + url.QueryEscape(profile)
+	}
+	req, err := http.NewRequest("GET", reqURL, nil)
+	if err != nil {
+		return nil, err
 	}
+	return req.WithContext(ctx), nil
+}
 
-	for _, img := range r.Initrd {
-		u, err := url.Parse(img)
-		if err != nil {
-			return "", nil, "", fmt.Errorf("non-url %q provided by %s for initrd: %s", img, reqURL, err)
-		}
-		if !u.IsAbs() {
-			return "", nil, "", fmt.Errorf("initrd URL %q provided by %s is not absolute", img, reqURL)
+// FetchSpec sends req, made by SpecRequest, with client, and decodes
+// the boot API's response. A 404 means ErrUnknownMAC. A 503, or not
+// reaching the server at all, means ErrTemporary. The response isn't
+// checked until it's turned into a BootSpec, since what its file
+// references mean is up to the caller.
+func FetchSpec(client *http.Client, req *http.Request) (*SpecResponse, error) {
+	reqURL := req.URL.String()
+	resp, err := client.Do(req)
+	if err != nil {
+		if req.Context().Err() != nil {
+			// Nobody's waiting for the answer any more.
+			return nil, err
 		}
+		log.Error("API", "Couldn't reach the boot API: %s", err)
+		return nil, ErrTemporary
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, ErrUnknownMAC
+	case http.StatusServiceUnavailable:
+		return nil, ErrTemporary
+	default:
+		return nil, fmt.Errorf("%s: %s", reqURL, http.StatusText(resp.StatusCode))
 	}
 
-	return r.Kernel, r.Initrd, r.Cmdline, nil
+	var r SpecResponse
+	if err = json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("non-json response from %s: %s", reqURL, err)
+	}
+	return &r, nil
 }
 
 func (b *remoteBooter) ShouldBoot(hw net.HardwareAddr) error {
-	_, _, _, err := b.getSpec(hw)
+	_, err := b.BootSpec(hw)
 	return err
 }
 
 func (b *remoteBooter) BootSpec(hw net.HardwareAddr) (*BootSpec, error) {
-	kernel, initrds, cmdline, err := b.getSpec(hw)
+	return b.BootSpecContext(context.Background(), hw)
+}
+
+func (b *remoteBooter) BootSpecContext(ctx context.Context, hw net.HardwareAddr) (*BootSpec, error) {
+	return b.BootSpecProfile(ctx, hw, "")
+}
+
+// PeekBootSpec is BootSpecProfile: asking the API server is all
+// BootSpec does.
+func (b *remoteBooter) PeekBootSpec(ctx context.Context, hw net.HardwareAddr, profile string) (*BootSpec, error) {
+	return b.BootSpecProfile(ctx, hw, profile)
+}
+
+func (b *remoteBooter) BootSpecProfile(ctx context.Context, hw net.HardwareAddr, profile string) (*BootSpec, error) {
+	req, err := SpecRequest(ctx, b.urlPrefix, hw, profile)
 	if err != nil {
 		return nil, err
 	}
-
-	ret := &BootSpec{
-		Cmdline: cmdline,
-	}
-	ret.Kernel, err = b.signURL(kernel)
+	r, err := FetchSpec(b.client, req)
 	if err != nil {
 		return nil, err
 	}
-	for _, img := range initrds {
-		initrd, err := b.signURL(img)
-		if err != nil {
-			return nil, err
-		}
-		ret.Initrd = append(ret.Initrd, initrd)
+	spec, err := r.BootSpec(b.fileRef)
+	if err != nil {
+		return nil, fmt.Errorf("bad spec from %s: %s", req.URL, err)
 	}
+	return spec, nil
+}
 
-	return ret, nil
+// fileRef checks that the API server gave us an absolute URL for a
+// file, and returns it signed.
+func (b *remoteBooter) fileRef(f, sum string) (string, error) {
+	u, err := url.Parse(f)
+	if err != nil {
+		return "", fmt.Errorf("non-url %q: %s", f, err)
+	}
+	if !u.IsAbs() {
+		return "", fmt.Errorf("URL %q is not absolute", f)
+	}
+	return b.signURL(f, sum)
 }
 
 func (b *remoteBooter) File(id string) (io.ReadCloser, string, error) {
-	u, err := b.getURL(id)
+	return b.FileContext(context.Background(), id)
+}
+
+func (b *remoteBooter) FileContext(ctx context.Context, id string) (io.ReadCloser, string, error) {
+	u, sum, err := b.getURL(id)
 	if err != nil {
 		return nil, "", err
 	}
 	// Can't use the handbuilt client we have, it times out too
 	// aggressively. Need to work on that.
-	resp, err := http.Get(u)
+	f, err := FetchURLContext(ctx, http.DefaultClient, u)
+	if err == nil && sum != nil {
+		f = WithSHA256(f, sum)
+	}
+	return f, u, err
+}
+
+// An UpstreamError reports that a file couldn't be fetched from the
+// remote server that holds it.
+type UpstreamError struct {
+	URL string
+	// HTTP status returned by the server, or 0 if we didn't get that
+	// far.
+	Status int
+	Err    error
+}
+
+func (e *UpstreamError) Error() string {
+	if e.Status != 0 {
+		return fmt.Sprintf("fetching %s: %s", e.URL, http.StatusText(e.Status))
+	}
+	return fmt.Sprintf("fetching %s: %s", e.URL, e.Err)
+}
+
+// FetchURL GETs the http(s) URL u using client, and returns the
+// response body for use as the result of Booter.File. If the server
+// says how big the file is, the returned ReadCloser is a
+// SizedReadCloser. Failures are reported as *UpstreamError.
+func FetchURL(client *http.Client, u string) (io.ReadCloser, error) {
+	return FetchURLContext(context.Background(), client, u)
+}
+
+// FetchURLContext is like FetchURL, but gives up when ctx is
+// cancelled.
+func FetchURLContext(ctx context.Context, client *http.Client, u string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", u, nil)
 	if err != nil {
-		return nil, "", err
+		return nil, &UpstreamError{URL: u, Err: err}
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, &UpstreamError{URL: u, Err: err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &UpstreamError{URL: u, Status: resp.StatusCode}
+	}
+	if resp.ContentLength >= 0 {
+		return sizedBody{resp.Body, resp.ContentLength}, nil
 	}
-	return resp.Body, u, nil
+	return resp.Body, nil
 }
 
-func (b *remoteBooter) signURL(u string) (string, error) {
+// signURL seals u, along with its expected SHA-256 digest in hex, if
+// the API server gave one. URLs can't contain newlines, so one
+// separates the two.
+func (b *remoteBooter) signURL(u, sum string) (string, error) {
 	var nonce [24]byte
 	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
 		return "", fmt.Errorf("could not read randomness for signing nonce: %s", err)
@@ -169,23 +915,36 @@ func (b *remoteBooter) signURL(u string) (string, error) {
 	// simultaneously netboot a million machines. This is one case
 	// where convenience and certainty that you got it right trumps
 	// pure efficiency.
+	if sum != "" {
+		u += "\n" + sum
+	}
 	out = secretbox.Seal(out, []byte(u), &nonce, &b.key)
 	return string(out), nil
 }
 
-func (b *remoteBooter) getURL(signed string) (string, error) {
+// getURL opens a blob sealed by signURL, and returns the URL and its
+// expected digest, if any.
+func (b *remoteBooter) getURL(signed string) (string, []byte, error) {
 	if len(signed) < 24 {
-		return "", errors.New("signed blob too short to be valid")
+		return "", nil, errors.New("signed blob too short to be valid")
 	}
 
 	var nonce [24]byte
 	copy(nonce[:], signed)
 	out, ok := secretbox.Open(nil, []byte(signed[24:]), &nonce, &b.key)
 	if !ok {
-		return "", errors.New("signature verification failed")
+		return "", nil, errors.New("signature verification failed")
 	}
 
-	return string(out), nil
+	i := strings.IndexByte(string(out), '\n')
+	if i < 0 {
+		return string(out), nil, nil
+	}
+	sum, err := ParseSHA256(string(out[i+1:]))
+	if err != nil {
+		return "", nil, err
+	}
+	return string(out[:i]), sum, nil
 }
 
 // StaticBooter boots all machines with local files.
@@ -224,6 +983,23 @@ func (b *staticBooter) BootSpec(net.HardwareAddr) (*BootSpec, error) {
 	}, nil
 }
 
+func (b *staticBooter) PeekBootSpec(ctx context.Context, hw net.HardwareAddr, profile string) (*BootSpec, error) {
+	return b.BootSpec(hw)
+}
+
+// ListSpecs implements Enumerator. The spec lists the actual file
+// paths rather than the IDs handed out to machines, since that's what
+// an auditor cares about.
+func (b *staticBooter) ListSpecs() (map[string]BootSpec, error) {
+	return map[string]BootSpec{
+		"*": {
+			Kernel:  b.kernelPath,
+			Initrd:  append([]string(nil), b.initrdPaths...),
+			Cmdline: b.spec.Cmdline,
+		},
+	}, nil
+}
+
 func (b staticBooter) File(id string) (io.ReadCloser, string, error) {
 	if id == "kernel" {
 		f, err := os.Open(b.kernelPath)
@@ -232,5 +1008,5 @@ func (b staticBooter) File(id string) (io.ReadCloser, string, error) {
 		f, err := os.Open(b.initrdPaths[i])
 		return f, "initrd." + id, err
 	}
-	return nil, "", fmt.Errorf("no file with ID %q", id)
+	return nil, "", ErrNotFound
 }
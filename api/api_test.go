@@ -0,0 +1,174 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wrapper is a minimal Wrapper.
+type wrapper struct {
+	Booter
+}
+
+func (w wrapper) Unwrap() Booter { return w.Booter }
+
+// editor is a Wrapper that edits the wrapped Booter's list.
+type editor struct {
+	wrapper
+}
+
+func (e editor) ListSpecs() (map[string]BootSpec, error) { return nil, nil }
+
+// reloader is a Wrapper that counts its reloads.
+type reloader struct {
+	wrapper
+	n   *int
+	err error
+}
+
+func (r reloader) Reload() error {
+	*r.n++
+	return r.err
+}
+
+type progressFunc func(hw net.HardwareAddr, status string)
+
+// recorder is a Wrapper that's a ProgressRecorder.
+type recorder struct {
+	wrapper
+	f progressFunc
+}
+
+func (r recorder) RecordProgress(hw net.HardwareAddr, status string) { r.f(hw, status) }
+
+func TestAsEnumerator(t *testing.T) {
+	fake := &FakeBooter{}
+	// Hides FakeBooter's ListSpecs.
+	opaque := struct{ Booter }{fake}
+	tests := []struct {
+		name string
+		b    Booter
+		want Booter
+	}{
+		{"enumerator", fake, fake},
+		{"wrapped enumerator", wrapper{fake}, fake},
+		{"editor of enumerator", editor{wrapper{fake}}, editor{wrapper{fake}}},
+		{"editor of non-enumerator", editor{wrapper{opaque}}, nil},
+		{"wrapped non-enumerator", wrapper{opaque}, nil},
+	}
+	for _, test := range tests {
+		got := AsEnumerator(test.b)
+		if got == nil && test.want == nil {
+			continue
+		}
+		if gotB, _ := got.(Booter); gotB != test.want {
+			t.Errorf("%s: got %#v, want %#v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	errBroken := errors.New("broken")
+	var outer, inner int
+	b := reloader{wrapper{reloader{wrapper{&FakeBooter{}}, &inner, errBroken}}, &outer, nil}
+	if err := Reload(b); err != errBroken {
+		t.Errorf("Reload returned %v, want %v", err, errBroken)
+	}
+	if outer != 1 || inner != 1 {
+		t.Errorf("reloaded outer %d and inner %d times, want once each", outer, inner)
+	}
+
+	b = reloader{wrapper{&FakeBooter{}}, &outer, ErrNotReloadable}
+	if err := Reload(b); err != ErrNotReloadable {
+		t.Errorf("Reload of nothing reloadable returned %v, want ErrNotReloadable", err)
+	}
+}
+
+func TestRecordProgress(t *testing.T) {
+	var got []string
+	rec := func(name string) progressFunc {
+		return func(hw net.HardwareAddr, status string) { got = append(got, name+" "+status) }
+	}
+	b := recorder{wrapper{recorder{wrapper{&FakeBooter{}}, rec("inner")}}, rec("outer")}
+	RecordProgress(b, net.HardwareAddr{1, 2, 3, 4, 5, 6}, "failed")
+	if len(got) != 2 || got[0] != "outer failed" || got[1] != "inner failed" {
+		t.Errorf("got progress %q, want outer then inner", got)
+	}
+}
+
+func TestSpecResponseMenu(t *testing.T) {
+	const resp = `{
+		"kernel": "k",
+		"sha256": {"rk": "` + "0000000000000000000000000000000000000000000000000000000000000000" + `"},
+		"menu": {
+			"title": "Lab",
+			"timeout": 10,
+			"default": "local",
+			"entries": [
+				{"label": "rescue", "kernel": "rk", "initrd": ["ri"], "cmdline": "single"},
+				{"label": "local", "local": true}
+			]
+		}
+	}`
+	var r SpecResponse
+	if err := json.Unmarshal([]byte(resp), &r); err != nil {
+		t.Fatal(err)
+	}
+	var refs []string
+	spec, err := r.BootSpec(func(f, sum string) (string, error) {
+		refs = append(refs, f+"/"+sum)
+		return "ref:" + f, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := spec.Menu
+	if m == nil || m.Title != "Lab" || m.Timeout != 10*time.Second || m.Default != "local" || len(m.Entries) != 2 {
+		t.Fatalf("got menu %+v", m)
+	}
+	if e := m.Entries[0]; e.Kernel != "ref:rk" || len(e.Initrd) != 1 || e.Initrd[0] != "ref:ri" || e.Cmdline != "single" {
+		t.Errorf("got entry %+v", e)
+	}
+	if e := m.Entries[1]; !e.LocalBoot || e.Kernel != "" {
+		t.Errorf("got entry %+v", e)
+	}
+	if len(refs) != 3 || refs[1] != "rk/"+r.SHA256["rk"] {
+		t.Errorf("ref called with %q", refs)
+	}
+
+	r.Menu.Default = "nope"
+	if _, err = r.BootSpec(SHA256Ref); err == nil {
+		t.Error("BootSpec accepted a menu with a missing default entry")
+	}
+}
+
+// sizedSeeker is a file that's both a SizedReadCloser and an
+// io.Seeker.
+type sizedSeeker struct {
+	*strings.Reader
+}
+
+func (sizedSeeker) Close() error  { return nil }
+func (s sizedSeeker) Size() int64 { return s.Reader.Size() }
+
+func TestWithSHA256SizedSeeker(t *testing.T) {
+	f := WithSHA256(sizedSeeker{strings.NewReader("kernel")}, make([]byte, 32))
+	if s, ok := f.(SizedReadCloser); !ok || s.Size() != 6 {
+		t.Error("WithSHA256 lost the stream's size")
+	}
+	s, ok := f.(io.Seeker)
+	if !ok {
+		t.Fatal("WithSHA256 lost the stream's Seek")
+	}
+	if n, err := s.Seek(2, io.SeekStart); n != 2 || err != nil {
+		t.Errorf("Seek returned %d, %v, want 2, nil", n, err)
+	}
+	if _, ok := f.(Checksummed); !ok {
+		t.Error("WithSHA256 didn't return a Checksummed stream")
+	}
+}
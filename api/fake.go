@@ -0,0 +1,140 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+)
+
+// FakeBooter is a Booter for testing code that uses Booters, such as
+// HTTP handlers and Booter wrappers. It boots the machines listed in
+// Specs and serves the files in Files. BootSpecFunc and FileFunc, if
+// set, take precedence over the maps, for tests that need errors or
+// dynamic behavior. The zero FakeBooter boots nothing.
+//
+// Fields must not be changed while the FakeBooter is in use.
+type FakeBooter struct {
+	// Specs maps MAC addresses, as formatted by
+	// net.HardwareAddr.String, to the BootSpecs to give them.
+	Specs map[string]*BootSpec
+	// Files maps file IDs to their contents. The pretty name of a
+	// file is its ID.
+	Files map[string][]byte
+
+	BootSpecFunc func(hw net.HardwareAddr) (*BootSpec, error)
+	FileFunc     func(id string) (io.ReadCloser, string, error)
+
+	mu            sync.Mutex
+	bootSpecCalls int
+	fileCalls     int
+}
+
+// ShouldBoot implements Booter. It boots the machines BootSpec would
+// return a spec for.
+func (b *FakeBooter) ShouldBoot(hw net.HardwareAddr) error {
+	_, err := b.spec(hw)
+	return err
+}
+
+// BootSpec implements Booter. Machines not in Specs get
+// ErrUnknownMAC.
+func (b *FakeBooter) BootSpec(hw net.HardwareAddr) (*BootSpec, error) {
+	b.mu.Lock()
+	b.bootSpecCalls++
+	b.mu.Unlock()
+	return b.spec(hw)
+}
+
+// PeekBootSpec implements Peeker. Unlike BootSpec, it isn't counted
+// in BootSpecCalls.
+func (b *FakeBooter) PeekBootSpec(ctx context.Context, hw net.HardwareAddr, profile string) (*BootSpec, error) {
+	return b.spec(hw)
+}
+
+func (b *FakeBooter) spec(hw net.HardwareAddr) (*BootSpec, error) {
+	if b.BootSpecFunc != nil {
+		return b.BootSpecFunc(hw)
+	}
+	spec, ok := b.Specs[hw.String()]
+	if !ok {
+		return nil, ErrUnknownMAC
+	}
+	return spec.Clone(), nil
+}
+
+// File implements Booter. Files not in Files get ErrNotFound.
+func (b *FakeBooter) File(id string) (io.ReadCloser, string, error) {
+	b.mu.Lock()
+	b.fileCalls++
+	b.mu.Unlock()
+	if b.FileFunc != nil {
+		return b.FileFunc(id)
+	}
+	bs, ok := b.Files[id]
+	if !ok {
+		return nil, "", ErrNotFound
+	}
+	return MemFile(bs), id, nil
+}
+
+// ListSpecs implements Enumerator.
+func (b *FakeBooter) ListSpecs() (map[string]BootSpec, error) {
+	ret := make(map[string]BootSpec, len(b.Specs))
+	for mac, spec := range b.Specs {
+		ret[mac] = *spec.Clone()
+	}
+	return ret, nil
+}
+
+// BootSpecCalls returns how many times BootSpec has been called, so
+// that tests can check what a wrapper passes through.
+func (b *FakeBooter) BootSpecCalls() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.bootSpecCalls
+}
+
+// FileCalls returns how many times File has been called.
+func (b *FakeBooter) FileCalls() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.fileCalls
+}
+
+// MemFile returns an in-memory byte stream with contents bs, of the
+// kind Booter.File returns. It is a SizedReadCloser and an
+// io.ReadSeeker, like an opened local file.
+func MemFile(bs []byte) io.ReadCloser {
+	return memFile{bytes.NewReader(bs)}
+}
+
+type memFile struct {
+	*bytes.Reader
+}
+
+func (memFile) Close() error { return nil }
+
+// ErrorFile returns an in-memory byte stream that yields bs, and then
+// fails with err instead of io.EOF, for testing how truncated
+// transfers are handled.
+func ErrorFile(bs []byte, err error) io.ReadCloser {
+	return &errorFile{bs: bs, err: err}
+}
+
+type errorFile struct {
+	bs  []byte
+	err error
+}
+
+func (f *errorFile) Read(p []byte) (int, error) {
+	if len(f.bs) == 0 {
+		return 0, f.err
+	}
+	n := copy(p, f.bs)
+	f.bs = f.bs[n:]
+	return n, nil
+}
+
+func (f *errorFile) Close() error { return nil }
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A MACPrefix matches the MAC addresses that start with the same
+// Bits bits as Addr, like a CIDR prefix does for IP addresses. For
+// example, 00:11:22:00:00:00/24 matches every address in the
+// 00:11:22 vendor OUI.
+type MACPrefix struct {
+	Addr net.HardwareAddr
+	Bits int
+}
+
+// ParseMACPrefix parses a MAC address with an optional prefix length,
+// e.g. "00:11:22:00:00:00/24". Without a prefix length, only the
+// exact address matches.
+func ParseMACPrefix(s string) (MACPrefix, error) {
+	addr, bits := s, ""
+	if i := strings.IndexByte(s, '/'); i != -1 {
+		addr, bits = s[:i], s[i+1:]
+	}
+	mac, err := net.ParseMAC(addr)
+	if err != nil {
+		return MACPrefix{}, err
+	}
+	ret := MACPrefix{mac, len(mac) * 8}
+	if bits != "" {
+		n, err := strconv.Atoi(bits)
+		if err != nil || n < 0 || n > len(mac)*8 {
+			return MACPrefix{}, fmt.Errorf("invalid prefix length in %q", s)
+		}
+		ret.Bits = n
+	}
+	return ret, nil
+}
+
+// Contains returns true if mac is in the prefix.
+func (p MACPrefix) Contains(mac net.HardwareAddr) bool {
+	if len(mac) != len(p.Addr) {
+		return false
+	}
+	for i := 0; i < p.Bits; i++ {
+		mask := byte(0x80) >> uint(i%8)
+		if mac[i/8]&mask != p.Addr[i/8]&mask {
+			return false
+		}
+	}
+	return true
+}
+
+func (p MACPrefix) String() string {
+	return fmt.Sprintf("%s/%d", p.Addr, p.Bits)
+}
+
+// A MACFilter is a coarse gate on which machines Pixiecore will talk
+// to at all, regardless of what the Booter says. Its prefixes can
+// come from files, which Reload rereads.
+type MACFilter struct {
+	allow, deny         string // comma-separated prefixes
+	allowFile, denyFile string // files of prefixes, or ""
+
+	mu sync.RWMutex
+	// If not empty, or there's an allow file, only machines in one
+	// of these prefixes are allowed. An empty allow file allows
+	// nothing, rather than everything.
+	allowed []MACPrefix
+	// Machines in any of these prefixes are never allowed.
+	denied []MACPrefix
+}
+
+// ParseMACFilter returns a MACFilter for the comma-separated lists of
+// MAC prefixes allow and deny, either of which can be empty.
+func ParseMACFilter(allow, deny string) (*MACFilter, error) {
+	return LoadMACFilter(allow, deny, "", "")
+}
+
+// LoadMACFilter is like ParseMACFilter, with more prefixes to allow
+// and deny read from allowFile and denyFile, one per line. Blank lines
+// and lines starting with # are ignored. Either file can be "".
+func LoadMACFilter(allow, deny, allowFile, denyFile string) (*MACFilter, error) {
+	ret := &MACFilter{
+		allow:     allow,
+		deny:      deny,
+		allowFile: allowFile,
+		denyFile:  denyFile,
+	}
+	if err := ret.Reload(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Reload rereads the filter's files, and swaps in their new prefixes.
+// If either file doesn't load, the filter keeps its old prefixes.
+func (f *MACFilter) Reload() error {
+	allowed, err := loadMACPrefixes(f.allow, f.allowFile)
+	if err != nil {
+		return err
+	}
+	denied, err := loadMACPrefixes(f.deny, f.denyFile)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.allowed, f.denied = allowed, denied
+	return nil
+}
+
+// loadMACPrefixes parses the comma-separated list s, and the file at
+// path, if any.
+func loadMACPrefixes(s, path string) ([]MACPrefix, error) {
+	ret, err := parseMACPrefixes(s)
+	if err != nil || path == "" {
+		return ret, err
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	sc := bufio.NewScanner(fd)
+	for line := 1; sc.Scan(); line++ {
+		p := strings.TrimSpace(sc.Text())
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+		prefix, err := ParseMACPrefix(p)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		ret = append(ret, prefix)
+	}
+	if err = sc.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return ret, nil
+}
+
+func parseMACPrefixes(s string) ([]MACPrefix, error) {
+	var ret []MACPrefix
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		prefix, err := ParseMACPrefix(p)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, prefix)
+	}
+	return ret, nil
+}
+
+// Allows returns true if the filter lets mac through. A nil filter
+// allows everything.
+func (f *MACFilter) Allows(mac net.HardwareAddr) bool {
+	if f == nil {
+		return true
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, p := range f.denied {
+		if p.Contains(mac) {
+			return false
+		}
+	}
+	if len(f.allowed) == 0 && f.allowFile == "" {
+		return true
+	}
+	for _, p := range f.allowed {
+		if p.Contains(mac) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMACFilterReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "macfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "allow")
+	write := func(s string) {
+		if err := ioutil.WriteFile(path, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a := net.HardwareAddr{0, 0x11, 0x22, 0, 0, 1}
+	b := net.HardwareAddr{0, 0x33, 0x44, 0, 0, 1}
+	write("# lab\n00:11:22:00:00:00/24\n")
+	f, err := LoadMACFilter("", "", path, "")
+	if err != nil {
+		t.Fatalf("LoadMACFilter: %s", err)
+	}
+	if !f.Allows(a) || f.Allows(b) {
+		t.Errorf("before reload: Allows(%s) = %v, Allows(%s) = %v, want true, false", a, f.Allows(a), b, f.Allows(b))
+	}
+
+	write("00:33:44:00:00:00/24\n")
+	if err = f.Reload(); err != nil {
+		t.Fatalf("Reload: %s", err)
+	}
+	if f.Allows(a) || !f.Allows(b) {
+		t.Errorf("after reload: Allows(%s) = %v, Allows(%s) = %v, want false, true", a, f.Allows(a), b, f.Allows(b))
+	}
+
+	// A bad file keeps the old prefixes.
+	write("not a mac\n")
+	if err = f.Reload(); err == nil {
+		t.Error("Reload of a bad file succeeded")
+	}
+	if !f.Allows(b) {
+		t.Errorf("after a bad reload: Allows(%s) = false, want true", b)
+	}
+
+	// An empty allow file allows nothing.
+	write("")
+	if err = f.Reload(); err != nil {
+		t.Fatalf("Reload: %s", err)
+	}
+	if f.Allows(a) || f.Allows(b) {
+		t.Error("empty allow file allows machines")
+	}
+}
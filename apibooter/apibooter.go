@@ -0,0 +1,166 @@
+// Package apibooter provides a Booter that asks a provisioning
+// service over HTTP what to boot, for sites that already keep their
+// machine inventory in one.
+//
+// To decide what a machine boots, the Booter GETs
+// <base>/v1/boot/<mac>, and expects a 200 response with a JSON boot
+// spec, in the same format as the API server's boot response (see
+// README.api.md):
+//
+//	{"kernel": "...", "initrd": ["..."], "cmdline": "..."}
+//
+// Unlike with the API server, the kernel, initrds and files (menu
+// entries' included) are IDs that the service understands, not URLs, and "sha256" digests are
+// keyed by ID. A 404 means the machine is unknown, and a 503 that the
+// service can't answer right now.
+//
+// To serve a file, the Booter GETs <base>/v1/file/<id> and streams the
+// response body to the client, checking it against its digest if the
+// spec gave one.
+package apibooter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/danderson/pixiecore/api"
+)
+
+// New returns a Booter that asks the service at baseURL what to boot.
+// If authHeader isn't empty, it's a header of the form "Name: value"
+// (e.g. "Authorization: Bearer <token>") to send with every request.
+// Boot spec lookups time out after timeout. File transfers can take as
+// long as they need.
+func New(baseURL, authHeader string, timeout time.Duration) (api.Booter, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if !u.IsAbs() {
+		return nil, fmt.Errorf("base URL %q is not absolute", baseURL)
+	}
+	ret := &apiBooter{
+		base:       strings.TrimSuffix(baseURL, "/") + "/v1",
+		specClient: &http.Client{Timeout: timeout},
+		fileClient: &http.Client{},
+	}
+	if authHeader != "" {
+		i := strings.IndexByte(authHeader, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("auth header %q is not Name: value", authHeader)
+		}
+		ret.authName = strings.TrimSpace(authHeader[:i])
+		ret.authValue = strings.TrimSpace(authHeader[i+1:])
+	}
+	return ret, nil
+}
+
+type apiBooter struct {
+	base                   string
+	authName, authValue    string
+	specClient, fileClient *http.Client
+}
+
+// authorize adds the auth header to req, if there is one.
+func (b *apiBooter) authorize(req *http.Request) {
+	if b.authName != "" {
+		req.Header.Set(b.authName, b.authValue)
+	}
+}
+
+func (b *apiBooter) ShouldBoot(hw net.HardwareAddr) error {
+	_, err := b.BootSpec(hw)
+	return err
+}
+
+func (b *apiBooter) BootSpec(hw net.HardwareAddr) (*api.BootSpec, error) {
+	return b.BootSpecContext(context.Background(), hw)
+}
+
+func (b *apiBooter) BootSpecContext(ctx context.Context, hw net.HardwareAddr) (*api.BootSpec, error) {
+	return b.BootSpecProfile(ctx, hw, "")
+}
+
+// PeekBootSpec is BootSpecProfile: asking the API server is all
+// BootSpec does.
+func (b *apiBooter) PeekBootSpec(ctx context.Context, hw net.HardwareAddr, profile string) (*api.BootSpec, error) {
+	return b.BootSpecProfile(ctx, hw, profile)
+}
+
+func (b *apiBooter) BootSpecProfile(ctx context.Context, hw net.HardwareAddr, profile string) (*api.BootSpec, error) {
+	req, err := api.SpecRequest(ctx, b.base, hw, profile)
+	if err != nil {
+		return nil, err
+	}
+	b.authorize(req)
+	r, err := api.FetchSpec(b.specClient, req)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := r.BootSpec(api.SHA256Ref)
+	if err != nil {
+		return nil, fmt.Errorf("bad spec from %s: %s", req.URL, err)
+	}
+	return spec, nil
+}
+
+func (b *apiBooter) File(id string) (io.ReadCloser, string, error) {
+	return b.FileContext(context.Background(), id)
+}
+
+func (b *apiBooter) FileContext(ctx context.Context, id string) (io.ReadCloser, string, error) {
+	id, sum, err := api.SplitSHA256Ref(id)
+	if err != nil {
+		return nil, "", err
+	}
+	if id == "" {
+		return nil, "", errors.New("empty file ID")
+	}
+	reqURL := fmt.Sprintf("%s/file/%s", b.base, url.PathEscape(id))
+	req, err := http.NewRequest("GET", reqURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req = req.WithContext(ctx)
+	b.authorize(req)
+	resp, err := b.fileClient.Do(req)
+	if err != nil {
+		return nil, "", &api.UpstreamError{URL: reqURL, Err: err}
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, "", api.ErrNotFound
+	case http.StatusServiceUnavailable:
+		resp.Body.Close()
+		return nil, "", api.ErrTemporary
+	default:
+		resp.Body.Close()
+		return nil, "", &api.UpstreamError{URL: reqURL, Status: resp.StatusCode}
+	}
+	var f io.ReadCloser = resp.Body
+	if resp.ContentLength >= 0 {
+		f = sizedBody{resp.Body, resp.ContentLength}
+	}
+	if sum != nil {
+		f = api.WithSHA256(f, sum)
+	}
+	return f, id, nil
+}
+
+// sizedBody is a response body of known length, so that it's an
+// api.SizedReadCloser.
+type sizedBody struct {
+	io.ReadCloser
+	size int64
+}
+
+func (b sizedBody) Size() int64 { return b.size }
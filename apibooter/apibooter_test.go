@@ -0,0 +1,108 @@
+package apibooter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/danderson/pixiecore/api"
+	"github.com/danderson/pixiecore/log"
+)
+
+func TestMain(m *testing.M) {
+	stdlog.SetOutput(ioutil.Discard)
+	go log.RecordLogs(false)
+	os.Exit(m.Run())
+}
+
+var mac = net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+
+func TestBootSpecStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		want   error
+	}{
+		{http.StatusNotFound, api.ErrUnknownMAC},
+		{http.StatusServiceUnavailable, api.ErrTemporary},
+	}
+	for _, test := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+		}))
+		b, err := New(srv.URL, "", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = b.BootSpec(mac); err != test.want {
+			t.Errorf("status %d: BootSpec returned %v, want %v", test.status, err, test.want)
+		}
+		srv.Close()
+	}
+}
+
+func TestBootSpecUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	b, err := New(srv.URL, "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.BootSpec(mac); err != api.ErrTemporary {
+		t.Errorf("BootSpec returned %v, want %v", err, api.ErrTemporary)
+	}
+}
+
+func TestBootSpecSHA256(t *testing.T) {
+	kernel := []byte("kernel contents")
+	sum := sha256.Sum256(kernel)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "secret" {
+			http.Error(w, "no token", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/boot/" + mac.String():
+			fmt.Fprintf(w, `{"kernel": "k1", "efi_direct": true, "sha256": {"k1": %q}}`, hex.EncodeToString(sum[:]))
+		case "/v1/file/k1":
+			w.Write(kernel)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	b, err := New(srv.URL, "X-Token: secret", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := b.BootSpec(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !spec.EFIDirect {
+		t.Error("BootSpec dropped efi_direct")
+	}
+	f, pretty, err := b.File(spec.Kernel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if pretty != "k1" {
+		t.Errorf("File returned name %q, want %q", pretty, "k1")
+	}
+	c, ok := f.(api.Checksummed)
+	if !ok || string(c.SHA256()) != string(sum[:]) {
+		t.Errorf("File didn't return the kernel's digest")
+	}
+	if got, err := ioutil.ReadAll(f); err != nil || string(got) != string(kernel) {
+		t.Errorf("File read %q, %v, want %q", got, err, kernel)
+	}
+}
@@ -0,0 +1,262 @@
+// Package cachingbooter provides a Booter wrapper that caches file
+// contents on local disk.
+//
+// During a boot storm, every machine fetches the same kernel and
+// initrds. For Booters whose files live far away (HTTP mirrors,
+// object stores...), that means fetching the same bytes over and over
+// again. With a cache in front, the first machine populates the cache
+// and the rest read from local disk.
+package cachingbooter
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/danderson/pixiecore/api"
+	"github.com/danderson/pixiecore/log"
+)
+
+// Prefix of the names of cache files, so we can recognize them.
+const filePrefix = "pixiecore-"
+
+// New returns a Booter that passes ShouldBoot and BootSpec calls
+// through to b, and serves files from a cache in dir. The cache holds
+// at most maxBytes, evicting the least recently used files when it
+// fills up. Files bigger than maxBytes are never cached.
+//
+// Any cache files left over in dir from a previous run are removed,
+// since the file IDs they belong to may no longer mean the same
+// thing.
+func New(b api.Booter, dir string, maxBytes int64) (api.Booter, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	old, err := filepath.Glob(filepath.Join(dir, filePrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range old {
+		if err = os.Remove(f); err != nil {
+			return nil, fmt.Errorf("clearing old cache file: %s", err)
+		}
+	}
+
+	return &cachingBooter{
+		Booter:   b,
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+		filling:  map[string]chan struct{}{},
+	}, nil
+}
+
+type cachingBooter struct {
+	api.Booter
+	dir      string
+	maxBytes int64
+
+	mu sync.Mutex
+	// Cached files, most recently used at the front of lru.
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+	// Files currently being fetched. The channel is closed when the
+	// fetch completes.
+	filling map[string]chan struct{}
+}
+
+// A cacheEntry is one file in the cache.
+type cacheEntry struct {
+	key    string
+	pretty string
+	size   int64
+	// Expected SHA-256 digest of the file, if the wrapped Booter gave
+	// one.
+	sum []byte
+}
+
+// open opens the cache file for ent.
+func (b *cachingBooter) open(ent *cacheEntry) (io.ReadCloser, error) {
+	f, err := os.Open(b.path(ent.key))
+	if err != nil {
+		return nil, err
+	}
+	if ent.sum != nil {
+		return api.WithSHA256(f, ent.sum), nil
+	}
+	return f, nil
+}
+
+func (b *cachingBooter) path(key string) string {
+	return filepath.Join(b.dir, filePrefix+key)
+}
+
+func (b *cachingBooter) File(id string) (io.ReadCloser, string, error) {
+	return b.FileContext(context.Background(), id)
+}
+
+// FileContext is like File. ctx cancels fetching the file from the
+// wrapped Booter, if it's an api.ContextBooter, or waiting for
+// someone else to.
+func (b *cachingBooter) FileContext(ctx context.Context, id string) (io.ReadCloser, string, error) {
+	sum := sha256.Sum256([]byte(id))
+	key := hex.EncodeToString(sum[:])
+
+	for {
+		b.mu.Lock()
+		if e, ok := b.entries[key]; ok {
+			b.lru.MoveToFront(e)
+			ent := e.Value.(*cacheEntry)
+			// Open under the lock, so that the file can't get
+			// evicted between lookup and open. Once open, eviction
+			// doesn't affect us.
+			f, err := b.open(ent)
+			b.mu.Unlock()
+			if err != nil {
+				return nil, "", err
+			}
+			log.Debug("Cache", "Serving %s from cache", ent.pretty)
+			return f, ent.pretty, nil
+		}
+		if ch, ok := b.filling[key]; ok {
+			// Someone else is already fetching this file, wait for
+			// them and try again.
+			b.mu.Unlock()
+			select {
+			case <-ch:
+			case <-ctx.Done():
+				return nil, "", ctx.Err()
+			}
+			continue
+		}
+		ch := make(chan struct{})
+		b.filling[key] = ch
+		b.mu.Unlock()
+
+		f, pretty, err := b.fill(ctx, id, key)
+
+		b.mu.Lock()
+		delete(b.filling, key)
+		close(ch)
+		b.mu.Unlock()
+		return f, pretty, err
+	}
+}
+
+// Unwrap implements api.Wrapper. Caching doesn't change file
+// contents, so content hashes are the wrapped Booter's, and cached
+// files stay when it reloads, since a file ID's contents don't depend
+// on the config.
+func (b *cachingBooter) Unwrap() api.Booter {
+	return b.Booter
+}
+
+// BootSpecContext passes through to the wrapped Booter, so that
+// wrapping doesn't hide its api.ContextBooter implementation.
+func (b *cachingBooter) BootSpecContext(ctx context.Context, hw net.HardwareAddr) (*api.BootSpec, error) {
+	return api.WithContext(b.Booter).BootSpecContext(ctx, hw)
+}
+
+// BootSpecProfile passes through to the wrapped Booter, so that
+// wrapping doesn't hide its api.ProfileBooter implementation.
+func (b *cachingBooter) BootSpecProfile(ctx context.Context, hw net.HardwareAddr, profile string) (*api.BootSpec, error) {
+	return api.WithProfiles(b.Booter).BootSpecProfile(ctx, hw, profile)
+}
+
+// PeekBootSpec passes through to the wrapped Booter.
+func (b *cachingBooter) PeekBootSpec(ctx context.Context, hw net.HardwareAddr, profile string) (*api.BootSpec, error) {
+	return api.PeekBootSpec(ctx, b.Booter, hw, profile)
+}
+
+// fill fetches id from the underlying Booter into the cache, and
+// returns the cached copy.
+func (b *cachingBooter) fill(ctx context.Context, id, key string) (io.ReadCloser, string, error) {
+	src, pretty, err := api.WithContext(b.Booter).FileContext(ctx, id)
+	if err != nil {
+		return nil, "", err
+	}
+	defer src.Close()
+
+	tmp, err := ioutil.TempFile(b.dir, filePrefix+"tmp")
+	if err != nil {
+		return nil, "", err
+	}
+	var (
+		w   io.Writer = tmp
+		sum []byte
+		h   = sha256.New()
+	)
+	if c, ok := src.(api.Checksummed); ok {
+		sum = c.SHA256()
+		w = io.MultiWriter(tmp, h)
+	}
+	size, err := io.Copy(w, src)
+	if err == nil && sum != nil && !bytes.Equal(h.Sum(nil), sum) {
+		// Don't let a bad fetch poison the cache.
+		err = fmt.Errorf("%s has SHA-256 %x, want %x", pretty, h.Sum(nil), sum)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, "", err
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, "", err
+	}
+	var ret io.ReadCloser = tmp
+	if sum != nil {
+		ret = api.WithSHA256(tmp, sum)
+	}
+
+	if size > b.maxBytes {
+		// Too big to ever cache. Unlinking the file doesn't stop us
+		// reading the open handle, and the disk space goes away once
+		// the transfer is done.
+		log.Debug("Cache", "Not caching %s, it is bigger than the whole cache (%d bytes)", pretty, size)
+		os.Remove(tmp.Name())
+		return ret, pretty, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err = os.Rename(tmp.Name(), b.path(key)); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, "", err
+	}
+	b.entries[key] = b.lru.PushFront(&cacheEntry{key, pretty, size, sum})
+	b.size += size
+	b.evict()
+	log.Log("Cache", "Cached %s (%d bytes, cache now holds %d bytes)", pretty, size, b.size)
+	return ret, pretty, nil
+}
+
+// evict removes least recently used files until the cache fits in
+// maxBytes. Must be called with b.mu held.
+func (b *cachingBooter) evict() {
+	for b.size > b.maxBytes {
+		e := b.lru.Back()
+		ent := e.Value.(*cacheEntry)
+		b.lru.Remove(e)
+		delete(b.entries, ent.key)
+		b.size -= ent.size
+		if err := os.Remove(b.path(ent.key)); err != nil && !os.IsNotExist(err) {
+			log.Log("Cache", "Evicting %s: %s", ent.pretty, err)
+			continue
+		}
+		log.Debug("Cache", "Evicted %s (%d bytes)", ent.pretty, ent.size)
+	}
+}
@@ -0,0 +1,161 @@
+// Package defaultargsbooter provides a Booter wrapper that adds
+// default arguments to every kernel commandline, e.g.
+// "console=ttyS0,115200", so that they don't have to be repeated in
+// every BootSpec.
+package defaultargsbooter
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/danderson/pixiecore/api"
+)
+
+// A Booter boots machines according to an underlying Booter, with
+// default arguments added to their kernel commandlines.
+type Booter struct {
+	api.Booter
+	args    []string
+	prepend bool
+}
+
+// New returns a Booter that adds args, a space-separated list of
+// kernel arguments, to the commandlines of b's BootSpecs, menu
+// entries' included. They go at
+// the end of the commandline, or at the start if prepend is set.
+//
+// Arguments that a BootSpec already sets are left alone: an argument
+// is skipped if the commandline has one with the same name (the part
+// before any "="), so a BootSpec can override a default by setting
+// it itself.
+func New(b api.Booter, args string, prepend bool) *Booter {
+	return &Booter{
+		Booter:  b,
+		args:    strings.Fields(args),
+		prepend: prepend,
+	}
+}
+
+func (b *Booter) BootSpec(hw net.HardwareAddr) (*api.BootSpec, error) {
+	spec, err := b.Booter.BootSpec(hw)
+	if err != nil {
+		return nil, err
+	}
+	return b.withDefaults(spec), nil
+}
+
+// BootSpecContext is like BootSpec, passing the context through to
+// the wrapped Booter if it's an api.ContextBooter.
+func (b *Booter) BootSpecContext(ctx context.Context, hw net.HardwareAddr) (*api.BootSpec, error) {
+	spec, err := api.WithContext(b.Booter).BootSpecContext(ctx, hw)
+	if err != nil {
+		return nil, err
+	}
+	return b.withDefaults(spec), nil
+}
+
+// FileContext passes through to the wrapped Booter, so that wrapping
+// doesn't hide its api.ContextBooter implementation.
+func (b *Booter) FileContext(ctx context.Context, id string) (io.ReadCloser, string, error) {
+	return api.WithContext(b.Booter).FileContext(ctx, id)
+}
+
+// BootSpecProfile is like BootSpec, passing the profile through to
+// the wrapped Booter if it's an api.ProfileBooter.
+func (b *Booter) BootSpecProfile(ctx context.Context, hw net.HardwareAddr, profile string) (*api.BootSpec, error) {
+	spec, err := api.WithProfiles(b.Booter).BootSpecProfile(ctx, hw, profile)
+	if err != nil {
+		return nil, err
+	}
+	return b.withDefaults(spec), nil
+}
+
+// PeekBootSpec is like BootSpecProfile, without side effects in the
+// wrapped Booter.
+func (b *Booter) PeekBootSpec(ctx context.Context, hw net.HardwareAddr, profile string) (*api.BootSpec, error) {
+	spec, err := api.PeekBootSpec(ctx, b.Booter, hw, profile)
+	if err != nil || spec == nil {
+		return nil, err
+	}
+	return b.withDefaults(spec), nil
+}
+
+// ListSpecs lists the wrapped Booter's specs, with the default
+// arguments added to each.
+func (b *Booter) ListSpecs() (map[string]api.BootSpec, error) {
+	e := api.AsEnumerator(b.Booter)
+	if e == nil {
+		return nil, api.ErrNotEnumerable
+	}
+	specs, err := e.ListSpecs()
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]api.BootSpec, len(specs))
+	for mac, spec := range specs {
+		ret[mac] = *b.withDefaults(&spec)
+	}
+	return ret, nil
+}
+
+// Unwrap implements api.Wrapper.
+func (b *Booter) Unwrap() api.Booter {
+	return b.Booter
+}
+
+// withDefaults returns a copy of spec with the default arguments
+// added to all its commandlines, menu entries' included. The wrapped
+// Booter may hand out the same spec to everyone, so it mustn't be
+// modified.
+func (b *Booter) withDefaults(spec *api.BootSpec) *api.BootSpec {
+	ret := spec.Clone()
+	ret.Cmdline = b.cmdline(ret.Cmdline)
+	for arch, a := range ret.ByArch {
+		a.Cmdline = b.cmdline(a.Cmdline)
+		ret.ByArch[arch] = a
+	}
+	if ret.Menu != nil {
+		for i := range ret.Menu.Entries {
+			if e := &ret.Menu.Entries[i]; !e.LocalBoot {
+				e.Cmdline = b.cmdline(e.Cmdline)
+			}
+		}
+	}
+	return ret
+}
+
+// cmdline returns cmdline with the default arguments it doesn't
+// already set added.
+func (b *Booter) cmdline(cmdline string) string {
+	set := map[string]bool{}
+	for _, arg := range strings.Fields(cmdline) {
+		set[argName(arg)] = true
+	}
+	var add []string
+	for _, arg := range b.args {
+		if !set[argName(arg)] {
+			add = append(add, arg)
+		}
+	}
+	switch {
+	case len(add) == 0:
+		return cmdline
+	case cmdline == "":
+		return strings.Join(add, " ")
+	case b.prepend:
+		return strings.Join(add, " ") + " " + cmdline
+	default:
+		return cmdline + " " + strings.Join(add, " ")
+	}
+}
+
+// argName returns the name of a kernel argument, i.e. the part
+// before any "=".
+func argName(arg string) string {
+	if i := strings.IndexByte(arg, '='); i != -1 {
+		return arg[:i]
+	}
+	return arg
+}
@@ -0,0 +1,39 @@
+package defaultargsbooter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/danderson/pixiecore/api"
+)
+
+func TestMenuEntries(t *testing.T) {
+	mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	orig := &api.BootSpec{
+		Kernel:  "kernel",
+		Cmdline: "quiet",
+		Menu: &api.Menu{
+			Entries: []api.MenuEntry{
+				{Label: "install", Kernel: "kernel", Cmdline: "console=tty0"},
+				{Label: "local", LocalBoot: true},
+			},
+		},
+	}
+	b := New(&api.FakeBooter{Specs: map[string]*api.BootSpec{mac.String(): orig}}, "console=ttyS0 panic=10", false)
+	spec, err := b.BootSpec(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "quiet console=ttyS0 panic=10"; spec.Cmdline != want {
+		t.Errorf("got cmdline %q, want %q", spec.Cmdline, want)
+	}
+	if got, want := spec.Menu.Entries[0].Cmdline, "console=tty0 panic=10"; got != want {
+		t.Errorf("got menu entry cmdline %q, want %q", got, want)
+	}
+	if got := spec.Menu.Entries[1].Cmdline; got != "" {
+		t.Errorf("got local boot entry cmdline %q, want none", got)
+	}
+	if orig.Menu.Entries[0].Cmdline != "console=tty0" {
+		t.Error("modified the wrapped Booter's spec")
+	}
+}
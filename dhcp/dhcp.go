@@ -6,6 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/net/ipv4"
 	"github.com/danderson/pixiecore/api"
@@ -14,15 +17,148 @@ import (
 
 var DhcpMagic = []byte{99, 130, 83, 99}
 
+// HardwareTypeInfiniBand is the ARP hardware type of InfiniBand
+// clients. Per RFC 4390, they leave chaddr empty, and identify
+// themselves with their client identifier (option 61) instead.
+const HardwareTypeInfiniBand = 32
+
+// maxIBAddrLen is the length of an IPoIB link-layer address, the
+// longest client identifier we take as an InfiniBand client's
+// address.
+const maxIBAddrLen = 20
+
 type DHCPPacket struct {
-	TID  []byte
-	MAC  net.HardwareAddr
-	GUID []byte
+	TID []byte
+	// The client's hardware address, and its ARP hardware type (1
+	// for Ethernet, 32 for InfiniBand...).
+	MAC          net.HardwareAddr
+	HardwareType byte
+	GUID         []byte
+	// The client's vendor class identifier, from option 60.
+	VendorClass string
+	// The client's system architecture, from option 93, or 0 (x86
+	// BIOS) if it didn't send one.
+	Arch uint16
+	// For UEFI HTTP Boot clients, the URL of what to boot, which
+	// goes in the offer instead of PXE options.
+	BootURL string
+	// Boot menu to offer the client if it hasn't selected a boot
+	// item yet, and how long to display it before picking the first
+	// entry. If empty, a single "Pixiecore" entry is offered.
+	BootMenu        []BootItem
+	BootMenuTimeout time.Duration
+	// The DHCP relay that forwarded the request (giaddr), or nil if
+	// the client is on our local network.
+	RelayIP net.IP
 
 	ServerIP net.IP
 }
 
+// A BootItem is an entry in a PXE boot menu.
+type BootItem struct {
+	// PXE boot server type. Types 0x8000 and up are vendor-defined
+	// and free for us to use; 0 means "boot from local disk".
+	Type uint16
+	// Description shown to the user.
+	Description string
+}
+
+// IsHTTPBoot returns true if the client is UEFI firmware doing HTTP
+// Boot, rather than a PXE ROM.
+func (p *DHCPPacket) IsHTTPBoot() bool {
+	return strings.HasPrefix(p.VendorClass, "HTTPClient")
+}
+
+// shouldOffer returns why booter doesn't want mac offered a boot, or
+// nil if it does. Machines whose Booter is temporarily unavailable get
+// an offer anyway, so that they get as far as being told to retry.
+func shouldOffer(booter api.Booter, mac net.HardwareAddr) error {
+	if err := booter.ShouldBoot(mac); err != api.ErrTemporary {
+		return err
+	}
+	log.Debug("DHCP", "Offering to boot %s, though its Booter is temporarily unavailable", mac)
+	return nil
+}
+
+// A Server answers the DHCP requests of machines that want to
+// netboot.
+type Server struct {
+	// Port to listen on.
+	Port int
+	// Decides which machines get offered a boot.
+	Booter api.Booter
+	// Client architectures (option 93 codes) we have a bootloader
+	// for. If set, clients of other architectures get no offer, and
+	// fall through to their next boot method. If empty, all
+	// architectures get an offer.
+	SupportedArches []uint16
+	// Returns the URL that a UEFI HTTP Boot client should boot,
+	// given its MAC address and architecture, and the address it
+	// reached us on. If nil, HTTP Boot clients get no offer.
+	HTTPBootURL func(mac net.HardwareAddr, arch uint16, serverIP net.IP) string
+	// Boot menu offered to PXE clients, and how long they display it
+	// before picking the first entry. If empty, clients get a
+	// single-entry menu that boots straight away. Should match the
+	// PXE server's, for clients that only look at one or the other.
+	BootMenu        []BootItem
+	BootMenuTimeout time.Duration
+	// How long to remember the address of each interface we reply
+	// from. Zero means DefaultInterfaceIPTTL, negative means look it
+	// up for every request.
+	InterfaceIPTTL time.Duration
+}
+
+// interfaceIPs returns a cache of interface addresses, per
+// s.InterfaceIPTTL.
+func (s *Server) interfaceIPs() *InterfaceIPCache {
+	ttl := s.InterfaceIPTTL
+	if ttl == 0 {
+		ttl = DefaultInterfaceIPTTL
+	}
+	return NewInterfaceIPCache(ttl)
+}
+
+// supportsArch returns true if s has a bootloader for clients of the
+// given architecture.
+func (s *Server) supportsArch(arch uint16) bool {
+	if len(s.SupportedArches) == 0 {
+		return true
+	}
+	for _, a := range s.SupportedArches {
+		if a == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// canBoot returns a reason not to offer to boot p, or "" if p looks
+// like a client s can boot.
+func (s *Server) canBoot(p *DHCPPacket) string {
+	if !s.supportsArch(p.Arch) {
+		return fmt.Sprintf("no bootloader for its architecture (%d)", p.Arch)
+	}
+	if p.IsHTTPBoot() && s.HTTPBootURL == nil {
+		return "it's an HTTP Boot client, and HTTP Boot isn't set up"
+	}
+	return ""
+}
+
+// ServeProxyDHCP answers PXE clients' DHCPDISCOVERs on port with
+// ProxyDHCP offers, for the clients that booter wants to boot.
 func ServeProxyDHCP(port int, booter api.Booter) error {
+	s := &Server{
+		Port:   port,
+		Booter: booter,
+	}
+	return s.ServeProxyDHCP()
+}
+
+// ServeProxyDHCP answers netboot clients' DHCPDISCOVERs with ProxyDHCP
+// offers, leaving address assignment to the network's real DHCP
+// server.
+func (s *Server) ServeProxyDHCP() error {
+	port, booter := s.Port, s.Booter
 	conn, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return err
@@ -33,56 +169,107 @@ func ServeProxyDHCP(port int, booter api.Booter) error {
 		return err
 	}
 
+	ips := s.interfaceIPs()
 	log.Log("ProxyDHCP", "Listening on port %d", port)
-	buf := make([]byte, 1024)
+	buf := make([]byte, DefaultReadBufferSize())
 	for {
 		n, msg, addr, err := l.ReadFrom(buf)
 		if err != nil {
-			log.Log("ProxyDHCP", "Error reading from socket: %s", err)
+			log.Error("ProxyDHCP", "Error reading from socket: %s", err)
 			continue
 		}
-
-		udpAddr := addr.(*net.UDPAddr)
-		udpAddr.IP = net.IPv4bcast
+		if n == len(buf) {
+			log.Log("ProxyDHCP", "Packet from %s filled the %d byte read buffer, it was probably truncated", addr, len(buf))
+		}
 
 		req, err := ParseDHCP(buf[:n])
 		if err != nil {
-			log.Debug("ProxyDHCP", "ParseDHCP: %s", err)
+			log.Debug("ProxyDHCP", "ParseDHCP: %s (packet: %x)", err, buf[:n])
+			continue
+		}
+		if reason := s.canBoot(req); reason != "" {
+			log.Debug("ProxyDHCP", "Not offering to boot %s: %s", req.MAC, reason)
 			continue
 		}
 
-		if err = booter.ShouldBoot(req.MAC); err != nil {
+		if err = shouldOffer(booter, req.MAC); err != nil {
 			log.Debug("ProxyDHCP", "Not offering to boot %s: %s", req.MAC, err)
 			continue
 		}
 
-		req.ServerIP, err = InterfaceIP(msg.IfIndex)
+		req.ServerIP, err = ips.InterfaceIP(msg.IfIndex)
 		if err != nil {
-			log.Log("ProxyDHCP", "Couldn't find an IP address to use to reply to %s: %s", req.MAC, err)
+			log.Error("ProxyDHCP", "Couldn't find an IP address to use to reply to %s: %s", req.MAC, err)
 			continue
 		}
+		if req.IsHTTPBoot() {
+			req.BootURL = s.HTTPBootURL(req.MAC, req.Arch, req.ServerIP)
+		}
+		req.BootMenu, req.BootMenuTimeout = s.BootMenu, s.BootMenuTimeout
 
-		log.Log("ProxyDHCP", "Offering to boot %s (via %s)", req.MAC, req.ServerIP)
+		dst := &net.UDPAddr{IP: net.IPv4bcast, Port: addr.(*net.UDPAddr).Port}
+		if req.RelayIP != nil {
+			// The relay passes the offer on to the client.
+			dst = &net.UDPAddr{IP: req.RelayIP, Port: 67}
+			log.Log("ProxyDHCP", "Offering to boot %s (via %s, relayed by %s)", req.MAC, req.ServerIP, req.RelayIP)
+		} else {
+			log.Log("ProxyDHCP", "Offering to boot %s (via %s)", req.MAC, req.ServerIP)
+		}
 		if _, err := l.WriteTo(OfferDHCP(req), &ipv4.ControlMessage{
 			IfIndex: msg.IfIndex,
-		}, udpAddr); err != nil {
-			log.Log("ProxyDHCP", "Responding to %s: %s", req.MAC, err)
+		}, dst); err != nil {
+			log.Error("ProxyDHCP", "Responding to %s: %s", req.MAC, err)
 			continue
 		}
 	}
 }
 
+// MinReadBufferSize is the smallest buffer DefaultReadBufferSize
+// returns, enough for any packet on a standard Ethernet MTU.
+const MinReadBufferSize = 1500
+
+// DefaultReadBufferSize returns the size of buffer to read DHCP
+// packets into: the largest MTU of any local interface, so that no
+// packet gets truncated, but at least MinReadBufferSize.
+func DefaultReadBufferSize() int {
+	size := MinReadBufferSize
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return size
+	}
+	for _, intf := range ifs {
+		if intf.MTU > size {
+			size = intf.MTU
+		}
+	}
+	return size
+}
+
+// ListenAddr returns the address to listen on, given a bind address
+// that may be empty, a bare host, or a host:port, and the port to use
+// if it doesn't say.
+func ListenAddr(bind string, port int) string {
+	if _, _, err := net.SplitHostPort(bind); err == nil {
+		return bind
+	}
+	return net.JoinHostPort(strings.Trim(bind, "[]"), strconv.Itoa(port))
+}
+
+// OfferDHCP constructs a ProxyDHCP offer for p. The offer contains
+// no address assignment (yiaddr is zero), only boot configuration, so
+// that the network's real DHCP server remains in charge of
+// addressing.
 func OfferDHCP(p *DHCPPacket) []byte {
 	var b bytes.Buffer
 
 	// Fixed length BOOTP response
 	var bootp [236]byte
-	bootp[0] = 2     // BOOTP reply
-	bootp[1] = 1     // PHY = ethernet
-	bootp[2] = 6     // Hardware address length
-	bootp[10] = 0x80 // Please speak broadcast
+	bootp[0] = 2 // BOOTP reply
+	p.SetHardwareAddr(bootp[:])
+	p.SetRelay(bootp[:])
 	copy(bootp[4:], p.TID)
-	copy(bootp[28:], p.MAC)
+	copy(bootp[20:], p.ServerIP)
+	copy(bootp[108:], bootFileField(p))
 	b.Write(bootp[:])
 
 	// DHCP magic
@@ -92,35 +279,98 @@ func OfferDHCP(p *DHCPPacket) []byte {
 	// Server ID
 	b.Write([]byte{54, 4})
 	b.Write(p.ServerIP)
+	p.WriteClientID(&b)
+	writePXEOptions(&b, p)
+
+	// End DHCP options
+	b.WriteByte(255)
+
+	return b.Bytes()
+}
+
+// bootFileField returns what goes in the BOOTP boot file name field
+// of an offer to p.
+func bootFileField(p *DHCPPacket) string {
+	if p.IsHTTPBoot() {
+		// The field only holds 128 bytes. Longer URLs only go in
+		// option 67, which HTTP Boot clients look at first anyway.
+		if len(p.BootURL) < 128 {
+			return p.BootURL
+		}
+		return ""
+	}
+	// PXE ROMs should follow the boot menu to our PXE server rather
+	// than use this directly, but some look for it regardless, and
+	// our TFTP server serves pxelinux no matter what name is asked
+	// for.
+	return "boot"
+}
+
+// writePXEOptions writes the DHCP options that point PXE client p at
+// our PXE boot server, or HTTP Boot client p at p.BootURL.
+func writePXEOptions(b *bytes.Buffer, p *DHCPPacket) {
+	if p.IsHTTPBoot() {
+		// HTTP Boot clients ignore offers that don't identify as
+		// HTTPClient.
+		WriteOption(b, 60, []byte("HTTPClient"))
+		if p.GUID != nil {
+			WriteOption(b, 97, append([]byte{0}, p.GUID...))
+		}
+		WriteOption(b, 67, []byte(p.BootURL))
+		return
+	}
 	// Vendor class
 	b.Write([]byte{60, 9})
 	b.WriteString("PXEClient")
 	// Client UUID
 	b.Write([]byte{97, 17, 0})
 	b.Write(p.GUID)
+	WriteBootMenu(b, p)
+}
+
+// WriteBootMenu writes the PXE vendor options (option 43) that offer
+// p.BootMenu to PXE client p, with our PXE boot server behind every
+// entry.
+func WriteBootMenu(b *bytes.Buffer, p *DHCPPacket) {
+	items, timeout := p.BootMenu, p.BootMenuTimeout
+	if len(items) == 0 {
+		items = []BootItem{{0x8000, "Pixiecore"}}
+		timeout = 0
+	}
 
-	// PXE vendor options
 	var pxe bytes.Buffer
-	// Discovery Control - disable broadcast and multicast boot server discovery
-	pxe.Write([]byte{6, 1, 3})
-	// PXE boot server
-	pxe.Write([]byte{8, 7, 0x80, 0x00, 1})
-	pxe.Write(p.ServerIP)
-	// PXE boot menu - one entry, pointing to the above PXE boot server
-	pxe.Write([]byte{9, 12, 0x80, 0x00, 9})
-	pxe.WriteString("Pixiecore")
+	// Discovery Control - disable broadcast and multicast boot server
+	// discovery, only use the boot servers below.
+	WriteOption(&pxe, 6, []byte{3})
+	// PXE boot servers - us, for every type in the menu. Type 0 is
+	// local boot, which needs no server.
+	var servers bytes.Buffer
+	for _, item := range items {
+		if item.Type == 0 {
+			continue
+		}
+		binary.Write(&servers, binary.BigEndian, item.Type)
+		servers.WriteByte(1)
+		servers.Write(p.ServerIP.To4())
+	}
+	WriteOption(&pxe, 8, servers.Bytes())
+	// PXE boot menu
+	var menu bytes.Buffer
+	for _, item := range items {
+		binary.Write(&menu, binary.BigEndian, item.Type)
+		menu.WriteByte(byte(len(item.Description)))
+		menu.WriteString(item.Description)
+	}
+	WriteOption(&pxe, 9, menu.Bytes())
 	// PXE menu prompt+timeout
-	pxe.Write([]byte{10, 10, 0})
-	pxe.WriteString("Pixiecore")
+	secs := timeout / time.Second
+	if secs > 254 {
+		secs = 254
+	}
+	WriteOption(&pxe, 10, append([]byte{byte(secs)}, "Pixiecore"...))
 	// End vendor options
 	pxe.WriteByte(255)
-	b.Write([]byte{43, byte(pxe.Len())})
-	pxe.WriteTo(&b)
-
-	// End DHCP options
-	b.WriteByte(255)
-
-	return b.Bytes()
+	WriteOption(b, 43, pxe.Bytes())
 }
 
 func ParseDHCP(b []byte) (req *DHCPPacket, err error) {
@@ -128,24 +378,27 @@ func ParseDHCP(b []byte) (req *DHCPPacket, err error) {
 		return nil, errors.New("packet too short")
 	}
 
+	htype, mac, err := HardwareAddr(b)
+	if err != nil {
+		return nil, err
+	}
 	ret := &DHCPPacket{
-		TID: b[4:8],
-		MAC: net.HardwareAddr(b[28:34]),
+		TID:          b[4:8],
+		MAC:          mac,
+		HardwareType: htype,
+		RelayIP:      RelayIP(b[24:28]),
 	}
 
 	// BOOTP operation type
 	if b[0] != 1 {
 		return nil, fmt.Errorf("packet from %s is not a BOOTP request", ret.MAC)
 	}
-	if b[1] != 1 && b[2] != 6 {
-		return nil, fmt.Errorf("packet from %s is not for an Ethernet PHY", ret.MAC)
-	}
 	if !bytes.Equal(b[236:240], DhcpMagic) {
 		return nil, fmt.Errorf("packet from %s is not a DHCP request", ret.MAC)
 	}
 
-	typ, val, opts := DhcpOption(b[240:])
-	for typ != 255 {
+	typ, val, opts, err := NextOption(b[240:])
+	for err == nil && typ != 255 {
 		switch typ {
 		case 53:
 			if len(val) != 1 {
@@ -154,22 +407,34 @@ func ParseDHCP(b []byte) (req *DHCPPacket, err error) {
 			if val[0] != 1 {
 				return nil, fmt.Errorf("packet from %s is not a DHCPDISCOVER", ret.MAC)
 			}
+		case 60:
+			ret.VendorClass = string(val)
 		case 93:
-			if len(val) != 2 {
+			// Clients may list several architectures, the first is
+			// the one they're running.
+			if len(val) < 2 || len(val)%2 != 0 {
 				return nil, fmt.Errorf("packet from %s has malformed option 93", ret.MAC)
 			}
-			if binary.BigEndian.Uint16(val) != 0 {
-				return nil, fmt.Errorf("%s is not an x86 PXE client", ret.MAC)
-			}
+			ret.Arch = binary.BigEndian.Uint16(val)
 		case 97:
 			if len(val) != 17 || val[0] != 0 {
 				return nil, fmt.Errorf("packet from %s has malformed option 97", ret.MAC)
 			}
 			ret.GUID = val[1:]
 		}
-		typ, val, opts = DhcpOption(opts)
+		typ, val, opts, err = NextOption(opts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("packet from %s has malformed options: %s", ret.MAC, err)
 	}
 
+	if ret.IsHTTPBoot() {
+		// Valid HTTP Boot request!
+		return ret, nil
+	}
+	if !strings.HasPrefix(ret.VendorClass, "PXEClient") {
+		return nil, fmt.Errorf("%s is not a PXE or HTTP Boot client (vendor class %q)", ret.MAC, ret.VendorClass)
+	}
 	if ret.GUID == nil {
 		return nil, fmt.Errorf("%s is not a PXE client", ret.MAC)
 	}
@@ -178,15 +443,156 @@ func ParseDHCP(b []byte) (req *DHCPPacket, err error) {
 	return ret, nil
 }
 
+// HardwareAddr returns the ARP hardware type and client hardware
+// address of the BOOTP packet b. Addresses can be longer than
+// Ethernet's 6 bytes. InfiniBand clients' addresses are their client
+// identifier (option 61), per RFC 4390.
+func HardwareAddr(b []byte) (htype byte, mac net.HardwareAddr, err error) {
+	if len(b) < 44 {
+		return 0, nil, errors.New("packet too short")
+	}
+	if b[1] == HardwareTypeInfiniBand {
+		if len(b) < 240 {
+			return 0, nil, errors.New("packet too short")
+		}
+		typ, val, opts := DhcpOption(b[240:])
+		for typ != 255 && typ != 61 {
+			typ, val, opts = DhcpOption(opts)
+		}
+		if typ != 61 || len(val) == 0 || len(val) > maxIBAddrLen {
+			return 0, nil, errors.New("InfiniBand packet has no usable client identifier")
+		}
+		return b[1], net.HardwareAddr(val), nil
+	}
+	hlen := int(b[2])
+	if hlen == 0 || hlen > 16 {
+		return 0, nil, fmt.Errorf("packet has invalid hardware address length %d", hlen)
+	}
+	return b[1], net.HardwareAddr(b[28 : 28+hlen]), nil
+}
+
+// RelayIP returns the giaddr field ip, or nil if it's unset.
+func RelayIP(ip net.IP) net.IP {
+	if ip.Equal(net.IPv4zero) {
+		return nil
+	}
+	return ip
+}
+
+// SetRelay sets the fields of bootp, a BOOTP reply to p, that depend
+// on whether p came through a DHCP relay.
+func (p *DHCPPacket) SetRelay(bootp []byte) {
+	if p.RelayIP == nil {
+		bootp[10] = 0x80 // Please speak broadcast
+		return
+	}
+	// The relay unicasts replies to the client, and needs giaddr
+	// to know which of its networks to send it on.
+	copy(bootp[24:], p.RelayIP.To4())
+}
+
+// SetHardwareAddr sets the hardware type, length and address fields
+// of bootp, a BOOTP reply to p.
+func (p *DHCPPacket) SetHardwareAddr(bootp []byte) {
+	bootp[1] = p.HardwareType
+	if p.HardwareType == HardwareTypeInfiniBand {
+		// No chaddr, the client matches up replies by xid and
+		// client identifier (see WriteClientID).
+		return
+	}
+	bootp[2] = byte(len(p.MAC))
+	copy(bootp[28:], p.MAC)
+}
+
+// WriteClientID echoes an InfiniBand client's identifier back at it in
+// option 61, as RFC 4390 requires. It writes nothing for other
+// clients.
+func (p *DHCPPacket) WriteClientID(b *bytes.Buffer) {
+	if p.HardwareType == HardwareTypeInfiniBand {
+		WriteOption(b, 61, p.MAC)
+	}
+}
+
+// VendorClassArch extracts the client architecture from a PXE vendor
+// class of the form "PXEClient:Arch:xxxxx:UNDI:yyyzzz". ok is false if
+// the class doesn't include an architecture.
+func VendorClassArch(class string) (arch uint16, ok bool) {
+	fields := strings.Split(class, ":")
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "Arch" {
+			n, err := strconv.ParseUint(fields[i+1], 10, 16)
+			if err != nil {
+				return 0, false
+			}
+			return uint16(n), true
+		}
+	}
+	return 0, false
+}
+
+// DhcpOption is like NextOption, but treats malformed options as the
+// end of the options.
 func DhcpOption(b []byte) (typ byte, val []byte, next []byte) {
-	if len(b) < 2 || b[0] == 255 {
+	typ, val, next, err := NextOption(b)
+	if err != nil {
 		return 255, nil, nil
 	}
+	return typ, val, next
+}
+
+// NextOption parses the DHCP option at the start of b, and returns its
+// type and value, and the rest of the options. At the end of the
+// options, it returns type 255. Pad options are skipped. An option
+// whose length runs past the end of b is an error.
+func NextOption(b []byte) (typ byte, val []byte, next []byte, err error) {
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+	if len(b) == 0 || b[0] == 255 {
+		return 255, nil, nil, nil
+	}
+	if len(b) < 2 {
+		return 0, nil, nil, fmt.Errorf("option %d is truncated before its length", b[0])
+	}
 	typ, l := b[0], int(b[1])
 	if len(b) < l+2 {
-		return 255, nil, nil
+		return 0, nil, nil, fmt.Errorf("option %d claims %d bytes, but only %d remain", typ, l, len(b)-2)
+	}
+	return typ, b[2 : 2+l], b[2+l:], nil
+}
+
+// WriteOption writes a DHCP option, or a sub-option in the same
+// format, to b. Values longer than an option can hold are split
+// across several instances of the option, per RFC 3396.
+func WriteOption(b *bytes.Buffer, code byte, data []byte) {
+	for {
+		n := len(data)
+		if n > 255 {
+			n = 255
+		}
+		b.WriteByte(code)
+		b.WriteByte(byte(n))
+		b.Write(data[:n])
+		data = data[n:]
+		if len(data) == 0 {
+			return
+		}
 	}
-	return typ, b[2 : 2+l], b[2+l:]
+}
+
+// ParseOptions parses a block of encapsulated options, such as the
+// PXE sub-options in option 43, into a map keyed by option type.
+func ParseOptions(b []byte) (map[byte][]byte, error) {
+	ret := map[byte][]byte{}
+	typ, val, b, err := NextOption(b)
+	for err == nil && typ != 255 {
+		ret[typ] = val
+		typ, val, b, err = NextOption(b)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
 }
 
 func InterfaceIP(ifIdx int) (net.IP, error) {
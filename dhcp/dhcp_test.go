@@ -0,0 +1,144 @@
+package dhcp
+
+import (
+	"bytes"
+	"io/ioutil"
+	stdlog "log"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/danderson/pixiecore/api"
+	"github.com/danderson/pixiecore/log"
+)
+
+func TestMain(m *testing.M) {
+	stdlog.SetOutput(ioutil.Discard)
+	go log.RecordLogs(false)
+	os.Exit(m.Run())
+}
+
+func TestNextOption(t *testing.T) {
+	tests := []struct {
+		in      []byte
+		typ     byte
+		val     []byte
+		next    []byte
+		wantErr bool
+	}{
+		{in: []byte{53, 1, 3, 255}, typ: 53, val: []byte{3}, next: []byte{255}},
+		{in: []byte{0, 0, 53, 1, 3}, typ: 53, val: []byte{3}, next: []byte{}},
+		{in: []byte{43, 0}, typ: 43, val: []byte{}, next: []byte{}},
+		{in: []byte{}, typ: 255},
+		{in: []byte{0, 0}, typ: 255},
+		{in: []byte{255, 1, 2}, typ: 255},
+		// Truncated before the length byte.
+		{in: []byte{43}, wantErr: true},
+		// Length runs past the end.
+		{in: []byte{43, 3, 1, 2}, wantErr: true},
+		{in: []byte{43, 255}, wantErr: true},
+	}
+	for _, test := range tests {
+		typ, val, next, err := NextOption(test.in)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("NextOption(%x) = %d, %x, want error", test.in, typ, val)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NextOption(%x): %s", test.in, err)
+			continue
+		}
+		if typ != test.typ || !bytes.Equal(val, test.val) || !bytes.Equal(next, test.next) {
+			t.Errorf("NextOption(%x) = %d, %x, %x, want %d, %x, %x", test.in, typ, val, next, test.typ, test.val, test.next)
+		}
+	}
+}
+
+func TestParseOptionsTruncated(t *testing.T) {
+	// Option 43 contents with sub-option 71 cut short.
+	if opts, err := ParseOptions([]byte{71, 4, 0x80, 0}); err == nil {
+		t.Errorf("ParseOptions accepted truncated sub-option, got %v", opts)
+	}
+}
+
+func TestPoolKeepsMACs(t *testing.T) {
+	p := &Pool{
+		Start:   net.IPv4(192, 168, 0, 10),
+		End:     net.IPv4(192, 168, 0, 20),
+		Netmask: net.IPv4Mask(255, 255, 255, 0),
+	}
+	// Like a packet buffer, reused for every request.
+	buf := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	first, err := p.Offer(buf, nil)
+	if err != nil {
+		t.Fatalf("Offer: %s", err)
+	}
+	copy(buf, net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x66})
+	second, err := p.Offer(buf, nil)
+	if err != nil {
+		t.Fatalf("Offer: %s", err)
+	}
+	if first.Equal(second) {
+		t.Errorf("two machines were both offered %s", first)
+	}
+}
+
+// uefiDiscover returns a DHCPDISCOVER from a UEFI PXE client of the given
+// architecture.
+func uefiDiscover(arch uint16) []byte {
+	b := make([]byte, 240)
+	b[0], b[1], b[2] = 1, 1, 6
+	copy(b[28:], []byte{0, 0x11, 0x22, 0x33, 0x44, 0x55})
+	copy(b[236:], DhcpMagic)
+	b = append(b, 53, 1, 1)
+	b = append(b, 60, 9)
+	b = append(b, "PXEClient"...)
+	b = append(b, 93, 2, byte(arch>>8), byte(arch))
+	b = append(b, 97, 17, 0)
+	b = append(b, make([]byte, 16)...)
+	return append(b, 255)
+}
+
+func TestServerBootsUEFI(t *testing.T) {
+	req, err := parseRequest(uefiDiscover(7))
+	if err != nil {
+		t.Fatalf("parseRequest: %s", err)
+	}
+	if !req.Netboot || req.Arch != 7 {
+		t.Fatalf("got Netboot %v, Arch %d, want true, 7", req.Netboot, req.Arch)
+	}
+	if reason := (&Server{}).canBoot(&req.DHCPPacket); reason != "" {
+		t.Errorf("won't boot x64 UEFI client: %s", reason)
+	}
+	if reason := (&Server{SupportedArches: []uint16{0}}).canBoot(&req.DHCPPacket); reason == "" {
+		t.Error("boots x64 UEFI client without a loader for it")
+	}
+}
+
+func TestShouldOffer(t *testing.T) {
+	mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	tests := []struct {
+		shouldBoot error
+		want       error
+	}{
+		{nil, nil},
+		{api.ErrTemporary, nil},
+		{api.ErrBootFromDisk, api.ErrBootFromDisk},
+		{api.ErrUnknownMAC, api.ErrUnknownMAC},
+	}
+	for _, test := range tests {
+		b := &api.FakeBooter{
+			BootSpecFunc: func(net.HardwareAddr) (*api.BootSpec, error) {
+				if test.shouldBoot != nil {
+					return nil, test.shouldBoot
+				}
+				return &api.BootSpec{Kernel: "kernel"}, nil
+			},
+		}
+		if err := shouldOffer(b, mac); err != test.want {
+			t.Errorf("ShouldBoot returning %v: shouldOffer returned %v, want %v", test.shouldBoot, err, test.want)
+		}
+	}
+}
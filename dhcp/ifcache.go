@@ -0,0 +1,55 @@
+package dhcp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// How long InterfaceIPCache remembers an interface's address.
+const DefaultInterfaceIPTTL = 30 * time.Second
+
+// An InterfaceIPCache wraps InterfaceIP, remembering answers for a
+// while. Failures aren't remembered: an interface that's still coming
+// up gets looked up again on the next packet, rather than holding up
+// the caller's receive loop with retries.
+type InterfaceIPCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[int]cachedIP
+}
+
+type cachedIP struct {
+	ip      net.IP
+	expires time.Time
+}
+
+// NewInterfaceIPCache returns a cache whose entries live for ttl.
+func NewInterfaceIPCache(ttl time.Duration) *InterfaceIPCache {
+	return &InterfaceIPCache{
+		ttl:     ttl,
+		entries: map[int]cachedIP{},
+	}
+}
+
+// InterfaceIP returns the IP address to use for replies sent from the
+// interface with index ifIdx, like the package-level InterfaceIP.
+func (c *InterfaceIPCache) InterfaceIP(ifIdx int) (net.IP, error) {
+	c.mu.Lock()
+	e, ok := c.entries[ifIdx]
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.ip, nil
+	}
+
+	ip, err := InterfaceIP(ifIdx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.entries[ifIdx] = cachedIP{ip, time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return ip, nil
+}
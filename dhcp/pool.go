@@ -0,0 +1,239 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultLeaseTime is how long a Pool leases addresses for, if
+	// not told otherwise.
+	DefaultLeaseTime = time.Hour
+	// How long an offered address stays reserved for the client it
+	// was offered to, waiting for a DHCPREQUEST.
+	offerHoldTime = time.Minute
+)
+
+// errPoolExhausted is returned when a Pool has no free addresses left.
+var errPoolExhausted = errors.New("no free addresses left in the pool")
+
+// A Pool is a range of IPv4 addresses that ServeDHCP leases out to
+// clients, along with the network configuration that goes with them.
+type Pool struct {
+	// First and last addresses of the range, inclusive. The range
+	// must not include pixiecore's own address.
+	Start, End net.IP
+	// Subnet mask (option 1) to give clients.
+	Netmask net.IPMask
+	// Default gateway (option 3) to give clients, or nil for none.
+	Router net.IP
+	// How long leases last. Zero means DefaultLeaseTime.
+	LeaseTime time.Duration
+
+	mu     sync.Mutex
+	leases map[string]*Lease // by MAC
+	byIP   map[uint32]*Lease
+}
+
+// A Lease is an address handed out by a Pool.
+type Lease struct {
+	MAC     net.HardwareAddr
+	IP      net.IP
+	Expires time.Time
+	// Whether the address has only been offered so far, and is
+	// reserved waiting for the client's DHCPREQUEST.
+	Offered bool
+}
+
+// ParsePool parses an address range of the form "first-last", e.g.
+// "192.168.1.100-192.168.1.200", into a Pool with the given netmask.
+func ParsePool(rng string, mask net.IPMask) (*Pool, error) {
+	fs := strings.Split(rng, "-")
+	if len(fs) != 2 {
+		return nil, fmt.Errorf("invalid address range %q, want first-last", rng)
+	}
+	start, end := net.ParseIP(strings.TrimSpace(fs[0])).To4(), net.ParseIP(strings.TrimSpace(fs[1])).To4()
+	if start == nil || end == nil {
+		return nil, fmt.Errorf("invalid address range %q, want two IPv4 addresses", rng)
+	}
+	if ip2int(start) > ip2int(end) {
+		return nil, fmt.Errorf("invalid address range %q, first address is after the last", rng)
+	}
+	if len(mask) != net.IPv4len {
+		return nil, fmt.Errorf("invalid netmask %s", mask)
+	}
+	if !start.Mask(mask).Equal(end.Mask(mask)) {
+		return nil, fmt.Errorf("address range %q spans more than one subnet of netmask %s", rng, net.IP(mask))
+	}
+	return &Pool{
+		Start:   start,
+		End:     end,
+		Netmask: mask,
+	}, nil
+}
+
+func (p *Pool) leaseTime() time.Duration {
+	if p.LeaseTime == 0 {
+		return DefaultLeaseTime
+	}
+	return p.LeaseTime
+}
+
+// contains returns true if ip is in the pool's range.
+func (p *Pool) contains(ip net.IP) bool {
+	ip = ip.To4()
+	if ip == nil {
+		return false
+	}
+	n := ip2int(ip)
+	return n >= ip2int(p.Start) && n <= ip2int(p.End)
+}
+
+// free returns true if n can be handed to mac. Must be called with
+// p.mu held.
+func (p *Pool) free(n uint32, mac net.HardwareAddr, now time.Time) bool {
+	l := p.byIP[n]
+	return l == nil || now.After(l.Expires) || macEqual(l.MAC, mac)
+}
+
+// init makes the lease maps. Must be called with p.mu held.
+func (p *Pool) init() {
+	if p.leases == nil {
+		p.leases = map[string]*Lease{}
+		p.byIP = map[uint32]*Lease{}
+	}
+}
+
+// set records l as the lease for its MAC, replacing whatever that
+// MAC or address had before. Must be called with p.mu held.
+func (p *Pool) set(l *Lease) {
+	p.remove(l.MAC)
+	if old := p.byIP[ip2int(l.IP)]; old != nil {
+		p.remove(old.MAC)
+	}
+	p.leases[string(l.MAC)] = l
+	p.byIP[ip2int(l.IP)] = l
+}
+
+// remove forgets mac's lease, if it has one. Must be called with p.mu
+// held.
+func (p *Pool) remove(mac net.HardwareAddr) {
+	if l := p.leases[string(mac)]; l != nil {
+		delete(p.leases, string(mac))
+		delete(p.byIP, ip2int(l.IP))
+	}
+}
+
+// Offer picks an address for mac and holds it for a short while, to
+// put in a DHCPOFFER. mac gets back the address it already has if
+// there is one, else requested if that's free, else the first free
+// address in the pool.
+func (p *Pool) Offer(mac net.HardwareAddr, requested net.IP) (net.IP, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.init()
+	now := time.Now()
+
+	var (
+		n  uint32
+		ok bool
+	)
+	if l := p.leases[string(mac)]; l != nil {
+		n, ok = ip2int(l.IP), true
+	}
+	if !ok && p.contains(requested) && p.free(ip2int(requested.To4()), mac, now) {
+		n, ok = ip2int(requested.To4()), true
+	}
+	for i := ip2int(p.Start); !ok && i <= ip2int(p.End) && i != 0; i++ {
+		if p.free(i, mac, now) {
+			n, ok = i, true
+		}
+	}
+	if !ok {
+		return nil, errPoolExhausted
+	}
+
+	if l := p.leases[string(mac)]; l != nil && ip2int(l.IP) == n && !l.Offered && now.Before(l.Expires) {
+		// Still bound, don't shorten the lease to an offer.
+		return l.IP, nil
+	}
+	p.set(&Lease{
+		// mac usually points into a packet buffer that's about to
+		// be reused.
+		MAC:     append(net.HardwareAddr(nil), mac...),
+		IP:      int2ip(n),
+		Expires: now.Add(offerHoldTime),
+		Offered: true,
+	})
+	return int2ip(n), nil
+}
+
+// Request binds ip to mac for the pool's lease time, in answer to a
+// DHCPREQUEST. It returns false if ip isn't in the pool, or belongs to
+// another client.
+func (p *Pool) Request(mac net.HardwareAddr, ip net.IP) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.init()
+	if !p.contains(ip) {
+		return false
+	}
+	n := ip2int(ip.To4())
+	now := time.Now()
+	if !p.free(n, mac, now) {
+		return false
+	}
+	p.set(&Lease{
+		MAC:     append(net.HardwareAddr(nil), mac...),
+		IP:      int2ip(n),
+		Expires: now.Add(p.leaseTime()),
+	})
+	return true
+}
+
+// Release frees whatever address mac holds, in answer to a
+// DHCPRELEASE or DHCPDECLINE, or when it picks another server's
+// offer.
+func (p *Pool) Release(mac net.HardwareAddr) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.leases != nil {
+		p.remove(mac)
+	}
+}
+
+// Leases returns the pool's current leases and offers, sorted by
+// address. Expired leases are left out.
+func (p *Pool) Leases() []Lease {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	ret := []Lease{}
+	for _, l := range p.leases {
+		if now.Before(l.Expires) {
+			ret = append(ret, *l)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ip2int(ret[i].IP) < ip2int(ret[j].IP) })
+	return ret
+}
+
+func macEqual(a, b net.HardwareAddr) bool {
+	return string(a) == string(b)
+}
+
+func ip2int(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func int2ip(n uint32) net.IP {
+	ret := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ret, n)
+	return ret
+}
@@ -0,0 +1,310 @@
+package dhcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/danderson/pixiecore/api"
+	"github.com/danderson/pixiecore/log"
+	"golang.org/x/net/ipv4"
+)
+
+// DHCP message types, from option 53.
+const (
+	msgDiscover = 1
+	msgOffer    = 2
+	msgRequest  = 3
+	msgDecline  = 4
+	msgAck      = 5
+	msgNak      = 6
+	msgRelease  = 7
+)
+
+// A dhcpRequest is any DHCP request, from PXE clients or not, as seen
+// by ServeDHCP.
+type dhcpRequest struct {
+	DHCPPacket
+	// DHCP message type, from option 53.
+	Type byte
+	// The client's current address (ciaddr), if it has one.
+	ClientIP net.IP
+	// The address the client would like, from option 50.
+	RequestedIP net.IP
+	// The server whose offer the client picked, from option 54.
+	ServerID net.IP
+	// Whether the client is a PXE or HTTP Boot client, that we might
+	// offer to boot.
+	Netboot bool
+}
+
+// ServeDHCP runs a full DHCP server on port, handing out addresses
+// from pool along with the usual network configuration, and offering
+// to boot the PXE clients that booter wants to boot. It takes the
+// place of ServeProxyDHCP on networks with no other DHCP server.
+func ServeDHCP(port int, booter api.Booter, pool *Pool) error {
+	s := &Server{
+		Port:   port,
+		Booter: booter,
+	}
+	return s.ServeDHCP(pool)
+}
+
+// ServeDHCP runs a full DHCP server, handing out addresses from pool
+// along with the usual network configuration, and offering to boot
+// the netboot clients that ServeProxyDHCP would. It takes the place of
+// ServeProxyDHCP on networks with no other DHCP server.
+func (s *Server) ServeDHCP(pool *Pool) error {
+	port, booter := s.Port, s.Booter
+	conn, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	l := ipv4.NewPacketConn(conn)
+	if err = l.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+		return err
+	}
+
+	ips := s.interfaceIPs()
+	log.Log("DHCP", "Listening on port %d, leasing %s-%s", port, pool.Start, pool.End)
+	buf := make([]byte, DefaultReadBufferSize())
+	for {
+		n, msg, addr, err := l.ReadFrom(buf)
+		if err != nil {
+			log.Error("DHCP", "Error reading from socket: %s", err)
+			continue
+		}
+		if n == len(buf) {
+			log.Log("DHCP", "Packet from %s filled the %d byte read buffer, it was probably truncated", addr, len(buf))
+		}
+
+		req, err := parseRequest(buf[:n])
+		if err != nil {
+			log.Debug("DHCP", "parseRequest: %s (packet: %x)", err, buf[:n])
+			continue
+		}
+		if req.RelayIP != nil {
+			// The pool is for the local network, handing its
+			// addresses to other subnets would break them.
+			log.Debug("DHCP", "Ignoring request from %s relayed by %s, the pool only serves the local network", req.MAC, req.RelayIP)
+			continue
+		}
+
+		req.ServerIP, err = ips.InterfaceIP(msg.IfIndex)
+		if err != nil {
+			log.Error("DHCP", "Couldn't find an IP address to use to reply to %s: %s", req.MAC, err)
+			continue
+		}
+
+		boot := false
+		if req.Netboot {
+			if reason := s.canBoot(&req.DHCPPacket); reason != "" {
+				log.Debug("DHCP", "Not offering to boot %s: %s", req.MAC, reason)
+			} else if err = shouldOffer(booter, req.MAC); err != nil {
+				log.Debug("DHCP", "Not offering to boot %s: %s", req.MAC, err)
+			} else {
+				boot = true
+			}
+		}
+		if boot {
+			if req.IsHTTPBoot() {
+				req.BootURL = s.HTTPBootURL(req.MAC, req.Arch, req.ServerIP)
+			}
+			req.BootMenu, req.BootMenuTimeout = s.BootMenu, s.BootMenuTimeout
+		}
+
+		var (
+			typ byte
+			ip  net.IP
+		)
+		switch req.Type {
+		case msgDiscover:
+			if ip, err = pool.Offer(req.MAC, req.RequestedIP); err != nil {
+				log.Error("DHCP", "Couldn't offer an address to %s: %s", req.MAC, err)
+				continue
+			}
+			typ = msgOffer
+			log.Log("DHCP", "Offering %s to %s", ip, req.MAC)
+		case msgRequest:
+			if req.ServerID != nil && !req.ServerID.Equal(req.ServerIP) {
+				log.Debug("DHCP", "%s picked another server's offer (%s)", req.MAC, req.ServerID)
+				pool.Release(req.MAC)
+				continue
+			}
+			ip = req.RequestedIP
+			if ip == nil {
+				ip = req.ClientIP
+			}
+			if ip != nil && pool.Request(req.MAC, ip) {
+				typ = msgAck
+				log.Log("DHCP", "Leased %s to %s", ip, req.MAC)
+			} else {
+				typ, ip = msgNak, nil
+				log.Log("DHCP", "Refusing %s's request for %s", req.MAC, req.RequestedIP)
+			}
+		case msgDecline, msgRelease:
+			log.Log("DHCP", "%s released its address", req.MAC)
+			pool.Release(req.MAC)
+			continue
+		default:
+			log.Debug("DHCP", "Ignoring DHCP message type %d from %s", req.Type, req.MAC)
+			continue
+		}
+
+		// Clients that already have an address can take a unicast
+		// reply, everyone else needs a broadcast.
+		udpAddr := addr.(*net.UDPAddr)
+		if req.ClientIP == nil || typ == msgNak {
+			udpAddr.IP = net.IPv4bcast
+		} else {
+			udpAddr.IP = req.ClientIP
+		}
+		if _, err := l.WriteTo(replyDHCP(req, typ, ip, pool, boot), &ipv4.ControlMessage{
+			IfIndex: msg.IfIndex,
+		}, udpAddr); err != nil {
+			log.Error("DHCP", "Responding to %s: %s", req.MAC, err)
+			continue
+		}
+	}
+}
+
+// replyDHCP constructs a DHCP reply of type typ to p, assigning it ip
+// from pool. If boot is true, the reply also offers to boot p, like
+// OfferDHCP.
+func replyDHCP(p *dhcpRequest, typ byte, ip net.IP, pool *Pool, boot bool) []byte {
+	var b bytes.Buffer
+
+	// Fixed length BOOTP response
+	var bootp [236]byte
+	bootp[0] = 2 // BOOTP reply
+	p.SetHardwareAddr(bootp[:])
+	if p.ClientIP == nil {
+		bootp[10] = 0x80 // Please speak broadcast
+	}
+	copy(bootp[4:], p.TID)
+	copy(bootp[12:], p.ClientIP.To4())
+	copy(bootp[16:], ip.To4())
+	copy(bootp[20:], p.ServerIP)
+	if boot {
+		copy(bootp[108:], bootFileField(&p.DHCPPacket))
+	}
+	b.Write(bootp[:])
+
+	// DHCP magic
+	b.Write(DhcpMagic)
+	b.Write([]byte{53, 1, typ})
+	// Server ID
+	b.Write([]byte{54, 4})
+	b.Write(p.ServerIP)
+	p.WriteClientID(&b)
+	if typ == msgNak {
+		b.WriteByte(255)
+		return b.Bytes()
+	}
+
+	// Lease time
+	var secs [4]byte
+	binary.BigEndian.PutUint32(secs[:], uint32(pool.leaseTime().Seconds()))
+	b.Write([]byte{51, 4})
+	b.Write(secs[:])
+	// Subnet mask
+	b.Write([]byte{1, 4})
+	b.Write(pool.Netmask)
+	// Router
+	if r := pool.Router.To4(); r != nil {
+		b.Write([]byte{3, 4})
+		b.Write(r)
+	}
+	if boot {
+		writePXEOptions(&b, &p.DHCPPacket)
+	}
+
+	// End DHCP options
+	b.WriteByte(255)
+
+	return b.Bytes()
+}
+
+// parseRequest parses any DHCP request, unlike ParseDHCP which only
+// accepts PXE DHCPDISCOVERs.
+func parseRequest(b []byte) (*dhcpRequest, error) {
+	if len(b) < 240 {
+		return nil, errors.New("packet too short")
+	}
+
+	htype, mac, err := HardwareAddr(b)
+	if err != nil {
+		return nil, err
+	}
+	ret := &dhcpRequest{
+		DHCPPacket: DHCPPacket{
+			TID:          b[4:8],
+			MAC:          mac,
+			HardwareType: htype,
+			RelayIP:      RelayIP(b[24:28]),
+		},
+	}
+	if b[0] != 1 {
+		return nil, fmt.Errorf("packet from %s is not a BOOTP request", ret.MAC)
+	}
+	if !bytes.Equal(b[236:240], DhcpMagic) {
+		return nil, fmt.Errorf("packet from %s is not a DHCP request", ret.MAC)
+	}
+	if ciaddr := net.IP(b[12:16]); !ciaddr.Equal(net.IPv4zero) {
+		ret.ClientIP = net.IP(append([]byte(nil), ciaddr...))
+	}
+
+	malformedArch := false
+	typ, val, opts, err := NextOption(b[240:])
+	for err == nil && typ != 255 {
+		switch typ {
+		case 50:
+			if len(val) != 4 {
+				return nil, fmt.Errorf("packet from %s has malformed option 50", ret.MAC)
+			}
+			ret.RequestedIP = net.IP(append([]byte(nil), val...))
+		case 53:
+			if len(val) != 1 {
+				return nil, fmt.Errorf("packet from %s has malformed option 53", ret.MAC)
+			}
+			ret.Type = val[0]
+		case 54:
+			if len(val) != 4 {
+				return nil, fmt.Errorf("packet from %s has malformed option 54", ret.MAC)
+			}
+			ret.ServerID = net.IP(append([]byte(nil), val...))
+		case 60:
+			ret.VendorClass = string(val)
+		case 93:
+			// As in ParseDHCP, but a malformed architecture only
+			// stops the client netbooting, it still gets an
+			// address.
+			if len(val) < 2 || len(val)%2 != 0 {
+				malformedArch = true
+			} else {
+				ret.Arch = binary.BigEndian.Uint16(val)
+			}
+		case 97:
+			if len(val) == 17 && val[0] == 0 {
+				ret.GUID = val[1:]
+			}
+		}
+		typ, val, opts, err = NextOption(opts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("packet from %s has malformed options: %s", ret.MAC, err)
+	}
+	if ret.Type == 0 {
+		return nil, fmt.Errorf("packet from %s has no DHCP message type", ret.MAC)
+	}
+
+	// Same tests as ParseDHCP. Which architectures we can boot is up
+	// to Server.canBoot.
+	pxe := ret.GUID != nil && strings.HasPrefix(ret.VendorClass, "PXEClient")
+	ret.Netboot = !malformedArch && (pxe || ret.IsHTTPBoot())
+	return ret, nil
+}
@@ -0,0 +1,383 @@
+// Package dhcp6 answers DHCPv6 requests from netbooting machines.
+//
+// Over IPv6, there is no PXE menu dance and no ProxyDHCP. Instead,
+// clients solicit DHCPv6 servers, and expect a bootfile URL (RFC 5970)
+// in the answer. We answer UEFI HTTP Boot clients with the URL of an
+// EFI bootloader on our HTTP server, and leave addressing to whatever
+// else runs the network (SLAAC or a real DHCPv6 server).
+package dhcp6
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/danderson/pixiecore/api"
+	"github.com/danderson/pixiecore/log"
+	"github.com/danderson/pixiecore/pxe"
+	"golang.org/x/net/ipv6"
+)
+
+// DHCPv6 message types.
+const (
+	msgSolicit   = 1
+	msgAdvertise = 2
+	msgRequest   = 3
+	msgReply     = 7
+	msgRelayForw = 12
+	msgRelayRepl = 13
+)
+
+// DHCPv6 option codes.
+const (
+	optClientID     = 1
+	optServerID     = 2
+	optIANA         = 3
+	optStatusCode   = 13
+	optVendorClass  = 16
+	optRelayMsg     = 9
+	optInterfaceID  = 18
+	optBootfileURL  = 59
+	optClientArch   = 61
+	optClientLLAddr = 79
+)
+
+// Status code we put in the IA_NA of replies: we give out no
+// addresses, only boot URLs.
+const statusNoAddrsAvail = 2
+
+// The All_DHCP_Relay_Agents_and_Servers multicast group.
+var allDHCPServers = net.ParseIP("ff02::1:2")
+
+// A Packet is a parsed DHCPv6 request from a netbooting client.
+type Packet struct {
+	Type byte
+	TID  []byte
+	// Client DUID, from option 1.
+	ClientID []byte
+	// Server DUID, from option 2. Only set in Requests.
+	ServerID []byte
+	// Client MAC address, from the DUID or the relay agent.
+	MAC net.HardwareAddr
+	// First architecture listed in option 61.
+	Arch uint16
+	// IAIDs of the IA_NA options (option 3) the client sent, which
+	// replies must answer.
+	IAIDs [][]byte
+}
+
+// A Relay is the relay agent wrapping of a request, which we need
+// to mirror in the reply.
+type Relay struct {
+	hopCount    byte
+	linkAddr    []byte
+	peerAddr    []byte
+	interfaceID []byte
+}
+
+// ServeDHCPv6 listens for DHCPv6 requests on port, and points x64
+// UEFI HTTP Boot clients that booter wants to boot at the URL bootURL
+// returns for them, given their MAC address and architecture, and the
+// address they reached us on (see pxe.Server.HTTPBootURL).
+func ServeDHCPv6(port int, booter api.Booter, bootURL func(mac net.HardwareAddr, arch uint16, serverIP net.IP) string) error {
+	conn, err := net.ListenPacket("udp6", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	l := ipv6.NewPacketConn(conn)
+	if err = l.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+		return err
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagMulticast == 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		iface := iface
+		if err := l.JoinGroup(&iface, &net.UDPAddr{IP: allDHCPServers}); err != nil {
+			log.Debug("DHCPv6", "Couldn't join DHCPv6 multicast group on %s: %s", iface.Name, err)
+		}
+	}
+
+	log.Log("DHCPv6", "Listening on port %d", port)
+	buf := make([]byte, 1500)
+	for {
+		n, msg, addr, err := l.ReadFrom(buf)
+		if err != nil {
+			log.Log("DHCPv6", "Error reading from socket: %s", err)
+			continue
+		}
+
+		req, relay, err := Parse(buf[:n])
+		if err != nil {
+			log.Debug("DHCPv6", "Parse: %s", err)
+			continue
+		}
+		if req.Arch != pxe.ArchEFIx64HTTP {
+			log.Debug("DHCPv6", "Ignoring %s, only UEFI HTTP Boot clients are supported over IPv6 (got %s)", req.MAC, pxe.ArchName(req.Arch))
+			continue
+		}
+
+		iface, err := net.InterfaceByIndex(msg.IfIndex)
+		if err != nil {
+			log.Log("DHCPv6", "Couldn't find interface for request from %s: %s", req.MAC, err)
+			continue
+		}
+		serverID := duid(iface.HardwareAddr)
+		if req.Type == msgRequest && !bytes.Equal(req.ServerID, serverID) {
+			// Request directed at some other server.
+			continue
+		}
+
+		if err = booter.ShouldBoot(req.MAC); err != nil {
+			log.Debug("DHCPv6", "Not offering to boot %s: %s", req.MAC, err)
+			continue
+		}
+
+		serverIP, err := interfaceIP6(iface)
+		if err != nil {
+			log.Log("DHCPv6", "Couldn't find an IP address to use to reply to %s: %s", req.MAC, err)
+			continue
+		}
+		u := bootURL(req.MAC, req.Arch, serverIP)
+
+		log.Log("DHCPv6", "Pointing UEFI HTTP Boot client %s at %s", req.MAC, u)
+		if _, err := l.WriteTo(Reply(req, relay, serverID, u), &ipv6.ControlMessage{
+			IfIndex: msg.IfIndex,
+		}, addr); err != nil {
+			log.Log("DHCPv6", "Responding to %s: %s", req.MAC, err)
+			continue
+		}
+	}
+}
+
+// Parse parses a DHCPv6 Solicit or Request, possibly wrapped in relay
+// agent messages. Only requests from netbooting clients (those that
+// state their architecture) are accepted.
+func Parse(b []byte) (*Packet, *Relay, error) {
+	var relay *Relay
+	var relayMAC net.HardwareAddr
+	for len(b) > 0 && b[0] == msgRelayForw {
+		if relay != nil {
+			return nil, nil, errors.New("nested relay messages are not supported")
+		}
+		if len(b) < 34 {
+			return nil, nil, errors.New("relay message too short")
+		}
+		relay = &Relay{
+			hopCount: b[1],
+			linkAddr: b[2:18],
+			peerAddr: b[18:34],
+		}
+		var inner []byte
+		opts, err := options(b[34:])
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, o := range opts {
+			switch o.code {
+			case optRelayMsg:
+				inner = o.val
+			case optInterfaceID:
+				relay.interfaceID = o.val
+			case optClientLLAddr:
+				if len(o.val) > 2 {
+					relayMAC = net.HardwareAddr(o.val[2:])
+				}
+			}
+		}
+		if inner == nil {
+			return nil, nil, errors.New("relay message has no relayed message")
+		}
+		b = inner
+	}
+
+	if len(b) < 4 {
+		return nil, nil, errors.New("packet too short")
+	}
+	if b[0] != msgSolicit && b[0] != msgRequest {
+		return nil, nil, fmt.Errorf("message type %d is not a Solicit or Request", b[0])
+	}
+	ret := &Packet{
+		Type: b[0],
+		TID:  b[1:4],
+		MAC:  relayMAC,
+	}
+
+	opts, err := options(b[4:])
+	if err != nil {
+		return nil, nil, err
+	}
+	hasArch := false
+	for _, o := range opts {
+		switch o.code {
+		case optClientID:
+			ret.ClientID = o.val
+		case optServerID:
+			ret.ServerID = o.val
+		case optIANA:
+			if len(o.val) < 12 {
+				return nil, nil, errors.New("malformed option 3")
+			}
+			ret.IAIDs = append(ret.IAIDs, o.val[:4])
+		case optClientArch:
+			if len(o.val) < 2 {
+				return nil, nil, errors.New("malformed option 61")
+			}
+			ret.Arch = binary.BigEndian.Uint16(o.val)
+			hasArch = true
+		}
+	}
+	if ret.ClientID == nil {
+		return nil, nil, errors.New("request has no client ID")
+	}
+	if ret.MAC == nil {
+		ret.MAC = duidMAC(ret.ClientID)
+	}
+	if ret.MAC == nil {
+		return nil, nil, fmt.Errorf("can't find a MAC address for client %x", ret.ClientID)
+	}
+	if !hasArch {
+		return nil, nil, fmt.Errorf("%s is not a netboot client", ret.MAC)
+	}
+	return ret, relay, nil
+}
+
+// Reply constructs an Advertise (for Solicits) or Reply (for
+// Requests) that points the client at bootURL. Each of the client's
+// IA_NAs is answered with NoAddrsAvail, so that it takes its address
+// from the network's real DHCPv6 server or SLAAC, and only its boot
+// URL from us.
+func Reply(p *Packet, relay *Relay, serverID []byte, bootURL string) []byte {
+	var b bytes.Buffer
+	if p.Type == msgSolicit {
+		b.WriteByte(msgAdvertise)
+	} else {
+		b.WriteByte(msgReply)
+	}
+	b.Write(p.TID)
+	writeOption(&b, optClientID, p.ClientID)
+	writeOption(&b, optServerID, serverID)
+	for _, iaid := range p.IAIDs {
+		var ia bytes.Buffer
+		ia.Write(iaid)
+		// T1 and T2, which mean nothing without addresses.
+		ia.Write(make([]byte, 8))
+		var status bytes.Buffer
+		binary.Write(&status, binary.BigEndian, uint16(statusNoAddrsAvail))
+		status.WriteString("boot URL only, no addresses")
+		writeOption(&ia, optStatusCode, status.Bytes())
+		writeOption(&b, optIANA, ia.Bytes())
+	}
+	// UEFI HTTP Boot clients ignore answers that don't identify as
+	// HTTPClient. The enterprise number is Intel's, as in the UEFI
+	// spec.
+	var vc bytes.Buffer
+	vc.Write([]byte{0, 0, 0x01, 0x57})
+	binary.Write(&vc, binary.BigEndian, uint16(len("HTTPClient")))
+	vc.WriteString("HTTPClient")
+	writeOption(&b, optVendorClass, vc.Bytes())
+	writeOption(&b, optBootfileURL, []byte(bootURL))
+
+	if relay == nil {
+		return b.Bytes()
+	}
+
+	var r bytes.Buffer
+	r.WriteByte(msgRelayRepl)
+	r.WriteByte(relay.hopCount)
+	r.Write(relay.linkAddr)
+	r.Write(relay.peerAddr)
+	if relay.interfaceID != nil {
+		writeOption(&r, optInterfaceID, relay.interfaceID)
+	}
+	writeOption(&r, optRelayMsg, b.Bytes())
+	return r.Bytes()
+}
+
+type option struct {
+	code uint16
+	val  []byte
+}
+
+// options parses a sequence of DHCPv6 options.
+func options(b []byte) ([]option, error) {
+	var ret []option
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errors.New("truncated option header")
+		}
+		code, l := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+l {
+			return nil, fmt.Errorf("option %d claims %d bytes, only %d left", code, l, len(b)-4)
+		}
+		ret = append(ret, option{code, b[4 : 4+l]})
+		b = b[4+l:]
+	}
+	return ret, nil
+}
+
+func writeOption(b *bytes.Buffer, code uint16, val []byte) {
+	binary.Write(b, binary.BigEndian, code)
+	binary.Write(b, binary.BigEndian, uint16(len(val)))
+	b.Write(val)
+}
+
+// duid returns a DUID-LL (RFC 8415 section 11.4) for mac.
+func duid(mac net.HardwareAddr) []byte {
+	return append([]byte{0, 3, 0, 1}, mac...)
+}
+
+// duidMAC extracts the MAC address from a DUID-LLT or DUID-LL, or
+// returns nil for other DUID types.
+func duidMAC(d []byte) net.HardwareAddr {
+	if len(d) < 4 || binary.BigEndian.Uint16(d[2:]) != 1 {
+		return nil
+	}
+	switch binary.BigEndian.Uint16(d) {
+	case 1:
+		if len(d) == 14 {
+			return net.HardwareAddr(d[8:])
+		}
+	case 3:
+		if len(d) == 10 {
+			return net.HardwareAddr(d[4:])
+		}
+	}
+	return nil
+}
+
+// interfaceIP6 returns an IPv6 address on iface that clients can
+// reach us at, preferring global addresses over link-local ones.
+func interfaceIP6(iface *net.Interface) (net.IP, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var linkLocal net.IP
+	for _, a := range addrs {
+		ipaddr, ok := a.(*net.IPNet)
+		if !ok || ipaddr.IP.To4() != nil {
+			continue
+		}
+		if ipaddr.IP.IsGlobalUnicast() {
+			return ipaddr.IP, nil
+		}
+		if ipaddr.IP.IsLinkLocalUnicast() && linkLocal == nil {
+			linkLocal = ipaddr.IP
+		}
+	}
+	if linkLocal != nil {
+		// A link-local URL would need a zone, which firmware doesn't
+		// understand. Better than nothing on a flat network, though.
+		return linkLocal, nil
+	}
+	return nil, fmt.Errorf("interface %s has no usable IPv6 addresses", iface.Name)
+}
@@ -0,0 +1,80 @@
+// Package embedbooter provides a Booter that boots every machine from
+// files in an fs.FS, typically an embed.FS baked into the binary with
+// //go:embed, for self-contained boot appliances.
+package embedbooter
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+
+	"github.com/danderson/pixiecore/api"
+)
+
+// NewEmbedBooter returns a Booter that boots all machines with spec.
+// The kernel, initrds and auxiliary files of spec are paths within
+// fsys, as accepted by fs.Open, e.g. "boot/vmlinuz".
+func NewEmbedBooter(fsys fs.FS, spec api.BootSpec) api.Booter {
+	return &embedBooter{fsys: fsys, spec: spec}
+}
+
+type embedBooter struct {
+	fsys fs.FS
+	spec api.BootSpec
+}
+
+func (b *embedBooter) ShouldBoot(net.HardwareAddr) error {
+	return nil
+}
+
+func (b *embedBooter) BootSpec(net.HardwareAddr) (*api.BootSpec, error) {
+	return b.spec.Clone(), nil
+}
+
+func (b *embedBooter) PeekBootSpec(ctx context.Context, hw net.HardwareAddr, profile string) (*api.BootSpec, error) {
+	return b.BootSpec(hw)
+}
+
+func (b *embedBooter) File(id string) (io.ReadCloser, string, error) {
+	if !fs.ValidPath(id) {
+		return nil, "", api.ErrNotFound
+	}
+	f, err := b.fsys.Open(id)
+	if os.IsNotExist(err) {
+		return nil, "", api.ErrNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, "", err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, "", api.ErrNotFound
+	}
+	if _, ok := f.(io.Seeker); ok {
+		// embed.FS files can seek, which also gets them Range
+		// requests.
+		return f, path.Base(id), nil
+	}
+	return sizedFile{f, fi.Size()}, path.Base(id), nil
+}
+
+// ListSpecs implements api.Enumerator.
+func (b *embedBooter) ListSpecs() (map[string]api.BootSpec, error) {
+	return map[string]api.BootSpec{"*": *b.spec.Clone()}, nil
+}
+
+// sizedFile is a file that can't seek, but knows its size.
+type sizedFile struct {
+	fs.File
+	size int64
+}
+
+func (f sizedFile) Size() int64 { return f.size }
@@ -0,0 +1,147 @@
+// Package execbooter provides a Booter that delegates to external
+// commands, so that boot decisions can be made by a script.
+//
+// To decide what a machine boots, the spec command is run with the
+// machine's MAC address as its last argument. It should exit 0 and
+// print a JSON object to stdout, in the same format as the API
+// server's boot response (see README.api.md):
+//
+//	{"kernel": "...", "initrd": ["..."], "cmdline": "..."}
+//
+// A non-zero exit means the machine shouldn't netboot, and so does
+// taking longer than the Booter's timeout, since machines can't wait
+// forever for an answer.
+//
+// To serve a file, the file command is run with the file ID (a kernel,
+// initrd or files string from the spec, including menu entries') as
+// its last argument, and its
+// stdout is sent to the client, checked against its digest if the spec
+// gave one.
+package execbooter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/danderson/pixiecore/api"
+)
+
+// New returns a Booter that runs specCmd to get BootSpecs, and
+// fileCmd to get file contents. Each is a command and its leading
+// arguments, to which the MAC address or file ID is appended. specCmd
+// gets killed if it runs for longer than timeout. fileCmd can take as
+// long as the transfer needs.
+func New(specCmd, fileCmd []string, timeout time.Duration) (api.Booter, error) {
+	if len(specCmd) == 0 {
+		return nil, errors.New("no spec command given")
+	}
+	if len(fileCmd) == 0 {
+		return nil, errors.New("no file command given")
+	}
+	return &execBooter{specCmd, fileCmd, timeout}, nil
+}
+
+type execBooter struct {
+	specCmd, fileCmd []string
+	timeout          time.Duration
+}
+
+func (b *execBooter) ShouldBoot(hw net.HardwareAddr) error {
+	_, err := b.BootSpec(hw)
+	return err
+}
+
+// PeekBootSpec is BootSpec: the command is only asked, and what it
+// does with the question is up to it.
+func (b *execBooter) PeekBootSpec(ctx context.Context, hw net.HardwareAddr, profile string) (*api.BootSpec, error) {
+	return b.BootSpec(hw)
+}
+
+func (b *execBooter) BootSpec(hw net.HardwareAddr) (*api.BootSpec, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+	cmd := command(ctx, b.specCmd, hw.String())
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("%s: timed out after %s", b.specCmd[0], b.timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s (%s)", b.specCmd[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	var r api.SpecResponse
+	if err = json.Unmarshal(out, &r); err != nil {
+		return nil, fmt.Errorf("non-json output from %s: %s", b.specCmd[0], err)
+	}
+	spec, err := r.BootSpec(api.SHA256Ref)
+	if err != nil {
+		return nil, fmt.Errorf("bad spec from %s for %s: %s", b.specCmd[0], hw, err)
+	}
+	return spec, nil
+}
+
+func (b *execBooter) File(id string) (io.ReadCloser, string, error) {
+	id, sum, err := api.SplitSHA256Ref(id)
+	if err != nil {
+		return nil, "", err
+	}
+	cmd := command(context.Background(), b.fileCmd, id)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, "", err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, "", fmt.Errorf("%s: %s", b.fileCmd[0], err)
+	}
+	var f io.ReadCloser = &cmdOutput{stdout, cmd, &stderr}
+	if sum != nil {
+		f = api.WithSHA256(f, sum)
+	}
+	return f, id, nil
+}
+
+func command(ctx context.Context, argv []string, arg string) *exec.Cmd {
+	args := append(append([]string(nil), argv[1:]...), arg)
+	return exec.CommandContext(ctx, argv[0], args...)
+}
+
+// cmdOutput is the stdout of a running command. Reading it to the end
+// reports an error if the command fails, so that a truncated
+// transfer doesn't look like a complete one.
+type cmdOutput struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func (c *cmdOutput) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	if err == io.EOF && c.cmd.ProcessState == nil {
+		if werr := c.cmd.Wait(); werr != nil {
+			return n, fmt.Errorf("%s: %s (%s)", c.cmd.Path, werr, strings.TrimSpace(c.stderr.String()))
+		}
+	}
+	return n, err
+}
+
+func (c *cmdOutput) Close() error {
+	if c.cmd.ProcessState == nil {
+		// The client went away before we read everything, don't
+		// leave the command hanging around.
+		c.cmd.Process.Kill()
+		c.cmd.Wait()
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+// Package failbooter provides a Booter wrapper that stops netbooting
+// machines that keep failing to boot.
+//
+// Without it, a machine whose install fails reboots, netboots the
+// installer again, fails again, and so on forever. failbooter breaks
+// the loop: machines report their progress to the signed URL that
+// their cmdline gets as {{.ProgressURL}}, and after too many
+// consecutive "failed" reports, the machine is told to boot from disk
+// instead.
+package failbooter
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/danderson/pixiecore/api"
+	"github.com/danderson/pixiecore/log"
+)
+
+// Progress statuses that failbooter understands. Any other status is
+// ignored.
+const (
+	StatusFailed = "failed"
+	StatusBooted = "booted"
+)
+
+// How long failures are remembered. After this long without a new
+// failure, the machine gets another chance to netboot.
+const failureTTL = time.Hour
+
+// A Booter netboots machines according to an underlying Booter, until
+// they fail too many times in a row.
+type Booter struct {
+	api.Booter
+	maxFailures int
+
+	mu       sync.Mutex
+	failures map[string]failures
+}
+
+type failures struct {
+	count int
+	last  time.Time
+}
+
+// New returns a Booter that stops netbooting a machine after it
+// reports maxFailures consecutive failures.
+func New(b api.Booter, maxFailures int) *Booter {
+	return &Booter{
+		Booter:      b,
+		maxFailures: maxFailures,
+		failures:    map[string]failures{},
+	}
+}
+
+// RecordProgress implements api.ProgressRecorder. A StatusFailed
+// report counts as a failure, and a StatusBooted one clears past
+// failures.
+func (b *Booter) RecordProgress(hw net.HardwareAddr, status string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Sweep out forgotten failures as we go, so that machines that
+	// never come back don't stay around forever.
+	for mac, f := range b.failures {
+		if time.Since(f.last) > failureTTL {
+			delete(b.failures, mac)
+		}
+	}
+	switch status {
+	case StatusFailed:
+		f := b.failures[hw.String()]
+		f.count++
+		f.last = time.Now()
+		b.failures[hw.String()] = f
+	case StatusBooted:
+		delete(b.failures, hw.String())
+	}
+}
+
+// Unwrap implements api.Wrapper.
+func (b *Booter) Unwrap() api.Booter {
+	return b.Booter
+}
+
+// check returns api.ErrBootFromDisk if hw has failed too many times.
+func (b *Booter) check(hw net.HardwareAddr) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.failures[hw.String()]
+	if !ok {
+		return nil
+	}
+	if time.Since(f.last) > failureTTL {
+		delete(b.failures, hw.String())
+		return nil
+	}
+	if f.count >= b.maxFailures {
+		log.Debug("BootFailures", "Booting %s from disk, it failed to boot %d times in a row, last at %s", hw, f.count, f.last.Format(time.RFC3339))
+		return api.ErrBootFromDisk
+	}
+	return nil
+}
+
+func (b *Booter) ShouldBoot(hw net.HardwareAddr) error {
+	if err := b.check(hw); err != nil {
+		return err
+	}
+	return b.Booter.ShouldBoot(hw)
+}
+
+func (b *Booter) BootSpec(hw net.HardwareAddr) (*api.BootSpec, error) {
+	if err := b.check(hw); err != nil {
+		return nil, err
+	}
+	return b.Booter.BootSpec(hw)
+}
+
+// BootSpecContext is like BootSpec, passing the context through to
+// the wrapped Booter if it's an api.ContextBooter.
+func (b *Booter) BootSpecContext(ctx context.Context, hw net.HardwareAddr) (*api.BootSpec, error) {
+	if err := b.check(hw); err != nil {
+		return nil, err
+	}
+	return api.WithContext(b.Booter).BootSpecContext(ctx, hw)
+}
+
+// FileContext passes through to the wrapped Booter, so that wrapping
+// doesn't hide its api.ContextBooter implementation.
+func (b *Booter) FileContext(ctx context.Context, id string) (io.ReadCloser, string, error) {
+	return api.WithContext(b.Booter).FileContext(ctx, id)
+}
+
+// BootSpecProfile is like BootSpec, passing the profile through to
+// the wrapped Booter if it's an api.ProfileBooter.
+func (b *Booter) BootSpecProfile(ctx context.Context, hw net.HardwareAddr, profile string) (*api.BootSpec, error) {
+	if err := b.check(hw); err != nil {
+		return nil, err
+	}
+	return api.WithProfiles(b.Booter).BootSpecProfile(ctx, hw, profile)
+}
+
+// PeekBootSpec is like BootSpecProfile, without side effects in the
+// wrapped Booter.
+func (b *Booter) PeekBootSpec(ctx context.Context, hw net.HardwareAddr, profile string) (*api.BootSpec, error) {
+	if err := b.check(hw); err != nil {
+		return nil, err
+	}
+	return api.PeekBootSpec(ctx, b.Booter, hw, profile)
+}
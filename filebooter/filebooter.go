@@ -0,0 +1,411 @@
+// Package filebooter provides a Booter that reads boot configurations
+// from a YAML file.
+//
+// The file maps MAC addresses to the kernel, initrds and commandline
+// that the machine should boot. The special key "*" provides a
+// default for machines that aren't listed. For example:
+//
+//	"*":
+//	  kernel: /srv/boot/vmlinuz
+//	  initrd: [/srv/boot/initrd.img]
+//	"00:11:22:33:44:55":
+//	  kernel: /srv/boot/rescue/vmlinuz
+//	  initrd: [/srv/boot/rescue/initrd.img]
+//	  cmdline: console=ttyS0 inst.ks={{.Files.kickstart}}
+//	  files:
+//	    kickstart: /srv/boot/rescue/ks.cfg
+//
+// Kernels, initrds and auxiliary files can be local paths, or
+// http(s) URLs to fetch them from. A spec can list the SHA-256
+// digests the files should have, and transfers that don't match are
+// cut off:
+//
+//	"*":
+//	  kernel: https://mirror.example.com/vmlinuz
+//	  sha256:
+//	    https://mirror.example.com/vmlinuz: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+//
+// A kernel that's an EFI executable with its initrd and commandline
+// built in, like a unified kernel image, can be marked efi_direct, and
+// UEFI HTTP Boot clients then boot it without a bootloader:
+//
+//	"*":
+//	  kernel: /srv/boot/linux.efi
+//	  efi_direct: true
+//
+// A machine can also get a pxelinux boot menu, for which menu.c32 and
+// its library modules must be served (see -syslinux-modules). Entries
+// boot their own kernel, or the local disk. For example:
+//
+//	"*":
+//	  kernel: /srv/boot/vmlinuz
+//	  initrd: [/srv/boot/initrd.img]
+//	  menu:
+//	    title: Lab machines
+//	    timeout: 10s
+//	    default: local
+//	    entries:
+//	      - label: install
+//	        title: Install
+//	        kernel: /srv/boot/vmlinuz
+//	        initrd: [/srv/boot/initrd.img]
+//	      - label: rescue
+//	        title: Rescue shell
+//	        kernel: /srv/boot/rescue/vmlinuz
+//	        initrd: [/srv/boot/rescue/initrd.img]
+//	      - label: local
+//	        title: Boot from local disk
+//	        local: true
+//
+// The file is watched for changes, and reloaded when it changes. It
+// can also be reloaded on demand, see api.Reloader.
+package filebooter
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danderson/pixiecore/api"
+	"github.com/danderson/pixiecore/log"
+	"gopkg.in/yaml.v2"
+)
+
+// How often to check the config file for changes.
+const pollInterval = 2 * time.Second
+
+// The key for the spec that applies to unlisted machines.
+const wildcard = "*"
+
+type spec struct {
+	Kernel  string   `yaml:"kernel"`
+	Initrd  []string `yaml:"initrd"`
+	Cmdline string   `yaml:"cmdline"`
+	// Auxiliary files, by name.
+	Files map[string]string `yaml:"files"`
+	// Optional pxelinux boot menu.
+	Menu *menu `yaml:"menu"`
+	// Expected SHA-256 digests of files, in hex, by path or URL.
+	SHA256 map[string]string `yaml:"sha256"`
+	// Whether UEFI HTTP Boot clients can boot Kernel without a
+	// bootloader.
+	EFIDirect bool `yaml:"efi_direct"`
+}
+
+type menu struct {
+	Title   string        `yaml:"title"`
+	Default string        `yaml:"default"`
+	Timeout time.Duration `yaml:"timeout"`
+	Entries []struct {
+		Label   string   `yaml:"label"`
+		Title   string   `yaml:"title"`
+		Local   bool     `yaml:"local"`
+		Kernel  string   `yaml:"kernel"`
+		Initrd  []string `yaml:"initrd"`
+		Cmdline string   `yaml:"cmdline"`
+	} `yaml:"entries"`
+}
+
+// apiMenu returns m as an api.Menu, or nil if there's no menu. The
+// menu shares slices with m.
+func (m *menu) apiMenu() *api.Menu {
+	if m == nil {
+		return nil
+	}
+	ret := &api.Menu{
+		Title:   m.Title,
+		Default: m.Default,
+		Timeout: m.Timeout,
+	}
+	for _, e := range m.Entries {
+		ret.Entries = append(ret.Entries, api.MenuEntry{
+			Label:     e.Label,
+			Title:     e.Title,
+			LocalBoot: e.Local,
+			Kernel:    e.Kernel,
+			Initrd:    e.Initrd,
+			Cmdline:   e.Cmdline,
+		})
+	}
+	return ret
+}
+
+// config is a parsed boot config file.
+type config struct {
+	specs map[string]spec
+	// Set of local paths referenced by specs, which are the only
+	// files we'll serve.
+	files map[string]bool
+	// Expected SHA-256 digests of files.
+	sums map[string][]byte
+}
+
+// NewFileBooter returns a Booter that boots machines according to the
+// YAML file at path. The file is reloaded whenever it changes. If a
+// reload fails, the previous config stays in effect.
+func NewFileBooter(path string) (api.Booter, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	ret := &fileBooter{
+		path: path,
+		cfg:  cfg,
+	}
+	go ret.watch(fi.ModTime())
+	return ret, nil
+}
+
+type fileBooter struct {
+	path string
+
+	mu  sync.RWMutex
+	cfg *config
+
+	hashMu sync.Mutex
+	hashes map[string]fileHash
+}
+
+// fileHash is the cached digest of a local file, valid as long as the
+// file's size and mtime don't change.
+type fileHash struct {
+	size  int64
+	mtime time.Time
+	hash  string
+}
+
+func (b *fileBooter) config() *config {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.cfg
+}
+
+// watch polls the config file, and swaps in a new config whenever
+// the file's modification time changes.
+func (b *fileBooter) watch(mtime time.Time) {
+	for range time.Tick(pollInterval) {
+		fi, err := os.Stat(b.path)
+		if err != nil {
+			log.Debug("FileBooter", "Checking %s for changes: %s", b.path, err)
+			continue
+		}
+		if fi.ModTime().Equal(mtime) {
+			continue
+		}
+		mtime = fi.ModTime()
+
+		if err = b.Reload(); err != nil {
+			log.Log("FileBooter", "Not reloading %s: %s", b.path, err)
+		}
+	}
+}
+
+// Reload implements api.Reloader. If the file doesn't load, the
+// current config stays in effect.
+func (b *fileBooter) Reload() error {
+	cfg, err := load(b.path)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.cfg = cfg
+	b.mu.Unlock()
+	log.Log("FileBooter", "Reloaded boot configs from %s", b.path)
+	return nil
+}
+
+// load reads and validates the config file at path.
+func load(path string) (*config, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]spec
+	if err = yaml.Unmarshal(bs, &raw); err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", path, err)
+	}
+
+	ret := &config{
+		specs: map[string]spec{},
+		files: map[string]bool{},
+		sums:  map[string][]byte{},
+	}
+	for k, s := range raw {
+		if k != wildcard {
+			mac, err := net.ParseMAC(k)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid MAC address %q: %s", path, k, err)
+			}
+			k = mac.String()
+		}
+		if s.Kernel == "" {
+			return nil, fmt.Errorf("%s: no kernel specified for %s", path, k)
+		}
+		ret.specs[k] = s
+		ret.files[s.Kernel] = true
+		for _, f := range s.Initrd {
+			ret.files[f] = true
+		}
+		for _, f := range s.Files {
+			ret.files[f] = true
+		}
+		if s.Menu != nil {
+			if err := s.Menu.apiMenu().Check(); err != nil {
+				return nil, fmt.Errorf("%s: bad menu for %s: %s", path, k, err)
+			}
+			for _, e := range s.Menu.Entries {
+				if e.Kernel != "" {
+					ret.files[e.Kernel] = true
+				}
+				for _, f := range e.Initrd {
+					ret.files[f] = true
+				}
+			}
+		}
+		for f, hexSum := range s.SHA256 {
+			if !ret.files[f] {
+				return nil, fmt.Errorf("%s: digest given for %s, which %s doesn't use", path, f, k)
+			}
+			sum, err := api.ParseSHA256(hexSum)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", path, err)
+			}
+			if old, ok := ret.sums[f]; ok && !bytes.Equal(old, sum) {
+				return nil, fmt.Errorf("%s: conflicting digests given for %s", path, f)
+			}
+			ret.sums[f] = sum
+		}
+	}
+	return ret, nil
+}
+
+func (b *fileBooter) spec(hw net.HardwareAddr) (spec, error) {
+	cfg := b.config()
+	if s, ok := cfg.specs[hw.String()]; ok {
+		return s, nil
+	}
+	if s, ok := cfg.specs[wildcard]; ok {
+		return s, nil
+	}
+	return spec{}, api.ErrUnknownMAC
+}
+
+func (b *fileBooter) ShouldBoot(hw net.HardwareAddr) error {
+	_, err := b.spec(hw)
+	return err
+}
+
+func (b *fileBooter) BootSpec(hw net.HardwareAddr) (*api.BootSpec, error) {
+	s, err := b.spec(hw)
+	if err != nil {
+		return nil, err
+	}
+	return s.bootSpec(), nil
+}
+
+func (b *fileBooter) PeekBootSpec(ctx context.Context, hw net.HardwareAddr, profile string) (*api.BootSpec, error) {
+	return b.BootSpec(hw)
+}
+
+// bootSpec returns s as an api.BootSpec, which callers can modify
+// without affecting the config.
+func (s spec) bootSpec() *api.BootSpec {
+	ret := &api.BootSpec{
+		Kernel:  s.Kernel,
+		Initrd:  s.Initrd,
+		Cmdline: s.Cmdline,
+		Files:   s.Files,
+		Menu:    s.Menu.apiMenu(),
+
+		EFIDirect: s.EFIDirect,
+	}
+	return ret.Clone()
+}
+
+func (b *fileBooter) File(id string) (io.ReadCloser, string, error) {
+	cfg := b.config()
+	if !cfg.files[id] {
+		return nil, "", api.ErrNotFound
+	}
+	f, pretty, err := open(id)
+	if err == nil && cfg.sums[id] != nil {
+		f = api.WithSHA256(f, cfg.sums[id])
+	}
+	return f, pretty, err
+}
+
+// open opens the local path or URL id.
+func open(id string) (io.ReadCloser, string, error) {
+	if strings.HasPrefix(id, "http://") || strings.HasPrefix(id, "https://") {
+		f, err := api.FetchURL(http.DefaultClient, id)
+		return f, id, err
+	}
+	f, err := os.Open(id)
+	return f, filepath.Base(id), err
+}
+
+// ListSpecs implements api.Enumerator.
+func (b *fileBooter) ListSpecs() (map[string]api.BootSpec, error) {
+	ret := map[string]api.BootSpec{}
+	for mac, s := range b.config().specs {
+		ret[mac] = *s.bootSpec()
+	}
+	return ret, nil
+}
+
+// ContentHash implements api.ContentHasher for local files.
+func (b *fileBooter) ContentHash(id string) (string, error) {
+	if !b.config().files[id] {
+		return "", fmt.Errorf("no file with ID %q", id)
+	}
+	if strings.HasPrefix(id, "http://") || strings.HasPrefix(id, "https://") {
+		return "", errors.New("can't hash remote files")
+	}
+	fi, err := os.Stat(id)
+	if err != nil {
+		return "", err
+	}
+
+	b.hashMu.Lock()
+	h, ok := b.hashes[id]
+	b.hashMu.Unlock()
+	if ok && h.size == fi.Size() && h.mtime.Equal(fi.ModTime()) {
+		return h.hash, nil
+	}
+
+	// Hash without holding the lock, so that hashing one big file
+	// doesn't hold up lookups of others.
+	f, err := os.Open(id)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	h = fileHash{fi.Size(), fi.ModTime(), hex.EncodeToString(hash.Sum(nil))}
+	b.hashMu.Lock()
+	if b.hashes == nil {
+		b.hashes = map[string]fileHash{}
+	}
+	b.hashes[id] = h
+	b.hashMu.Unlock()
+	return h.hash, nil
+}
@@ -0,0 +1,100 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/danderson/pixiecore/api"
+)
+
+// discardWriter is a ResponseWriter that throws the response away,
+// so that benchmarks measure the server rather than the recorder.
+type discardWriter struct {
+	h http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.h }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+// streamFile is a Booter file that can't seek, like an upstream HTTP
+// body, so that it goes through File's copy loop rather than
+// http.ServeContent.
+type streamFile struct {
+	io.Reader
+	size int64
+}
+
+func (f streamFile) Close() error { return nil }
+func (f streamFile) Size() int64  { return f.size }
+
+// BenchmarkFile measures concurrent transfers of a 1 MiB file under
+// /f/.
+func BenchmarkFile(b *testing.B) {
+	benchmarkFile(b, "kernel", "")
+}
+
+// BenchmarkFileGzip is BenchmarkFile for a client that takes gzip.
+func BenchmarkFileGzip(b *testing.B) {
+	benchmarkFile(b, "config.txt", "gzip")
+}
+
+func benchmarkFile(b *testing.B, name, encoding string) {
+	contents := bytes.Repeat([]byte("pixiecore"), 1<<20/9)
+	s := testServer(b, &api.FakeBooter{
+		FileFunc: func(id string) (io.ReadCloser, string, error) {
+			return streamFile{bytes.NewReader(contents), int64(len(contents))}, id, nil
+		},
+	})
+	path := "/" + s.signedFileURL(name, time.Now().Add(time.Hour))
+
+	b.SetBytes(int64(len(contents)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req := httptest.NewRequest("GET", path, nil)
+			if encoding != "" {
+				req.Header.Set("Accept-Encoding", encoding)
+			}
+			s.mux.ServeHTTP(&discardWriter{h: http.Header{}}, req)
+		}
+	})
+}
+
+// BenchmarkPxelinuxConfig measures rendering pxelinux configs for
+// different machines.
+func BenchmarkPxelinuxConfig(b *testing.B) {
+	spec := &api.BootSpec{
+		Kernel:  "kernel",
+		Initrd:  []string{"initrd-0", "initrd-1", "initrd-2"},
+		Cmdline: "console=ttyS0 ip=dhcp",
+	}
+	s := testServer(b, &api.FakeBooter{
+		BootSpecFunc: func(net.HardwareAddr) (*api.BootSpec, error) {
+			return spec, nil
+		},
+	})
+	var paths []string
+	for i := 0; i < 256; i++ {
+		paths = append(paths, fmt.Sprintf("/pxelinux.cfg/01-00-11-22-33-44-%02x", i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			req := httptest.NewRequest("GET", paths[i%len(paths)], nil)
+			w := &discardWriter{h: http.Header{}}
+			s.mux.ServeHTTP(w, req)
+			i++
+		}
+	})
+}
@@ -0,0 +1,57 @@
+package http
+
+import (
+	"sync"
+
+	"github.com/danderson/pixiecore/api"
+	"github.com/danderson/pixiecore/log"
+)
+
+// contentURLs hands out content-addressed file URLs, and remembers
+// which file ID each one stands for.
+//
+// Content-addressed URLs aren't signed: the URL is only valid if we
+// previously handed it out, which gives the same guarantee, and
+// keeping them stable lets caching proxies share one copy of a file
+// between all the machines that boot it.
+type contentURLs struct {
+	hasher api.ContentHasher
+
+	mu  sync.Mutex
+	ids map[string]string // hash -> file ID
+}
+
+// url returns the content-addressed URL for id, or "" if the Booter
+// can't hash it.
+func (c *contentURLs) url(id string) string {
+	hash, err := c.hasher.ContentHash(id)
+	if err != nil {
+		log.Debug("HTTP", "Can't content-address %q, using a signed URL: %s", id, err)
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ids[hash] = id
+	return "f/sha256/" + hash
+}
+
+// id returns the file ID for a content hash we handed out, if the
+// file still has that hash. Files that changed since are forgotten,
+// so that the old URL doesn't serve new bytes.
+func (c *contentURLs) id(hash string) (string, bool) {
+	c.mu.Lock()
+	id, ok := c.ids[hash]
+	c.mu.Unlock()
+	if !ok {
+		return "", false
+	}
+	if now, err := c.hasher.ContentHash(id); err != nil || now != hash {
+		c.mu.Lock()
+		if c.ids[hash] == id {
+			delete(c.ids, hash)
+		}
+		c.mu.Unlock()
+		return "", false
+	}
+	return id, true
+}
@@ -0,0 +1,46 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/danderson/pixiecore/log"
+)
+
+// Events streams live boot events (PXE requests, boot decisions, file
+// transfers...) as server-sent events, one JSON log entry per event.
+// Only events that concern a particular machine are sent.
+func (s *httpServer) Events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	entries, cancel := log.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-entries:
+			if e.MAC == "" && e.RemoteAddr == "" {
+				continue
+			}
+			bs, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Subsystem, bs); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
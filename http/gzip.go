@@ -0,0 +1,74 @@
+package http
+
+import (
+	"compress/gzip"
+	"net/http"
+)
+
+// gzipped wraps h to gzip its successful responses for clients that
+// accept it. Handlers that set their own Content-Encoding are left
+// alone.
+func gzipped(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) || r.Header.Get("Range") != "" {
+			h(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w, head: r.Method == "HEAD"}
+		defer gw.close()
+		h(gw, r)
+	}
+}
+
+// gzipWriter is an http.ResponseWriter that decides whether to
+// compress when the response headers are written.
+type gzipWriter struct {
+	http.ResponseWriter
+	head        bool
+	wroteHeader bool
+	gz          *gzip.Writer
+}
+
+func (w *gzipWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	if status == http.StatusOK && h.Get("Content-Encoding") == "" {
+		h.Set("Content-Encoding", "gzip")
+		// The handler's Content-Length is for the uncompressed
+		// body.
+		h.Del("Content-Length")
+		if !w.head {
+			w.gz = getGzip(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+// close finishes the response, writing the gzip trailer if it was
+// compressed.
+func (w *gzipWriter) close() error {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz == nil {
+		return nil
+	}
+	err := w.gz.Close()
+	putGzip(w.gz)
+	w.gz = nil
+	return err
+}
@@ -1,17 +1,36 @@
 package http
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	mrand "math/rand"
+	"mime"
 	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
 
 	"github.com/danderson/pixiecore/api"
+	"github.com/danderson/pixiecore/dhcp"
 	"github.com/danderson/pixiecore/log"
+	"github.com/danderson/pixiecore/metrics"
+	"github.com/danderson/pixiecore/pxe"
+	"github.com/danderson/pixiecore/tftp"
 )
 
 // pxelinux configuration that tells the PXE/UNDI stack to boot from
@@ -22,9 +41,62 @@ LABEL local
 LOCALBOOT 0
 `
 
-// A silly limerick displayed while pxelinux loads big OS
+// iPXE script that tells iPXE to give up on netbooting, and let the
+// firmware carry on to the next boot device.
+const ipxeBootFromDisk = `#!ipxe
+exit
+`
+
+// pxelinux configuration that reboots the machine, so that it tries
+// netbooting again. If reboot.c32 isn't available, pxelinux reboots
+// on its own a while after failing to load it.
+const rebootConfig = `
+SAY Nothing to boot, rebooting.
+DEFAULT reboot
+LABEL reboot
+COM32 reboot.c32
+`
+
+// iPXE script that reboots the machine.
+const ipxeReboot = `#!ipxe
+echo Nothing to boot, rebooting.
+reboot
+`
+
+// pxelinux configuration that waits, then reboots the machine so it
+// tries netbooting again, for when the Booter can't answer right now.
+const retryConfig = `
+SAY The boot server is busy, retrying in %d seconds.
+PROMPT 1
+TIMEOUT %d
+DEFAULT retry
+LABEL retry
+COM32 reboot.c32
+`
+
+// iPXE script that waits, then fetches the script at %[2]s again.
+const ipxeRetry = `#!ipxe
+echo The boot server is busy, retrying in %[1]d seconds.
+sleep %[1]d
+chain --autofree %[2]s || reboot
+`
+
+// A FallbackPolicy says what to do with machines that end up in
+// pxelinux or iPXE, but shouldn't netboot.
+type FallbackPolicy int
+
+const (
+	// Boot from the local disk.
+	FallbackDisk FallbackPolicy = iota
+	// Reboot, to try netbooting again.
+	FallbackReboot
+	// Serve Server.FallbackConfig to pxelinux. iPXE clients reboot.
+	FallbackCustom
+)
+
+// Limerick is a silly limerick displayed while pxelinux loads big OS
 // images. Possibly the most important piece of this program.
-const limerick = `
+const Limerick = `
 	        There once was a protocol called PXE,
 	        Whose specification was overly tricksy.
 	        A committee refined it,
@@ -32,105 +104,1794 @@ const limerick = `
 	        And now you're using it to boot your PC.
 `
 
+// How long the signed file URLs in a pxelinux config remain
+// valid. pxelinux fetches everything right after it gets its config,
+// so this only needs to cover a slow boot, not a long-lived link.
+const fileURLLifetime = 10 * time.Minute
+
+// How long the URLs of a BootSpec's auxiliary files remain valid.
+// These get fetched by the booted OS, e.g. an installer, which can
+// take a while to get going.
+const auxFileURLLifetime = time.Hour
+
+// How long the signed progress URLs handed out in cmdlines remain
+// valid. They're used throughout an install, and installs can be
+// slow.
+const progressURLLifetime = 24 * time.Hour
+
+// Maximum length of a decoded file ID. Booter file IDs are things like
+// paths or signed URLs, so anything longer is garbage and gets
+// rejected before we allocate memory for it.
+const maxFileIDLen = 4096
+
+// How long to wait for in-flight transfers to finish when shutting
+// down.
+const shutdownTimeout = 30 * time.Second
+
+// Default connection timeouts, see Server.
+const (
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultIdleTimeout       = 2 * time.Minute
+	DefaultWriteTimeout      = time.Hour
+)
+
+// Default delay before machines retry when the Booter is temporarily
+// unavailable, see Server.
+const (
+	DefaultRetryDelay  = 10 * time.Second
+	DefaultRetryJitter = 20 * time.Second
+)
+
+// archKey is the context key for the client architecture of a request
+// that came in under /arch/<n>/.
+type archKey struct{}
+
+// bootIDKey is the context key for the boot ID of a request that came
+// in under /id/<boot ID>/.
+type bootIDKey struct{}
+
+// profileKey is the context key for the boot profile a request asked
+// for.
+type profileKey struct{}
+
+// A Server serves pxelinux, its configuration, and the files it
+// boots over HTTP.
+type Server struct {
+	// Port to listen on.
+	Port int
+	// Address to listen on, as a host or host:port. If it includes a
+	// port, it overrides Port. If empty, listen on all addresses.
+	BindAddr string
+	// If set, the address that pxelinux configs served by
+	// TFTPHandler point clients at, e.g. a load balancer in front of
+	// us. If unset, the address the client reached us on is used.
+	// Should match the PXE server's AdvertiseIP.
+	AdvertiseIP net.IP
+	// Booter that decides what machines boot.
+	Booter api.Booter
+	// The ldlinux.c32 blob that pxelinux needs.
+	Ldlinux []byte
+	// The EFI build of syslinux for x64 UEFI clients, and the
+	// ldlinux.e64 it needs. If unset, x64 UEFI clients have nothing
+	// to boot, unless Loaders has one for them.
+	EFILoader, EFILdlinux []byte
+	// First stage bootloaders for UEFI clients, by client
+	// architecture (see the pxe.Arch constants). Each is served at
+	// pxe.LoaderPath(arch), over HTTP and by LoaderTFTPHandler.
+	Loaders map[uint16][]byte
+	// Extra syslinux modules, e.g. menu.c32 and the libraries it
+	// needs, keyed by name without the .c32 suffix. Each is served
+	// at /<name>.c32. Ldlinux always serves ldlinux.c32.
+	Modules map[string][]byte
+	// Arbitrary files to serve at /static/<name>, keyed by name, for
+	// things like installer MOTDs, kickstarts or config fragments
+	// that don't need to go through the Booter.
+	Static map[string][]byte
+	// If set, serve HTTPS instead of HTTP, using the certificate and
+	// key in these PEM files.
+	CertFile, KeyFile string
+	// Message displayed by pxelinux while it loads the OS, e.g. for
+	// branding or support contact details. If empty, nothing is
+	// displayed.
+	BootMessage string
+	// If set, compute and log what machines would boot, but tell
+	// them all to boot from disk instead.
+	DryRun bool
+	// How many times to resume a file transfer whose source stream
+	// fails partway through, before giving up.
+	FileRetries int
+	// If positive, the most bytes any one file may have. Bigger
+	// transfers are aborted, on the theory that the Booter is
+	// serving something it shouldn't, like a device or a growing
+	// log. Zero means no limit.
+	MaxFileSize int64
+	// Content-Type to send Booter files with, by extension of the
+	// file's pretty name (e.g. ".yaml"), on top of
+	// DefaultContentTypes. Files with other extensions are sent as
+	// application/octet-stream.
+	ContentTypes map[string]string
+	// Path under which to serve everything, e.g. "/pixiecore/", for
+	// running behind a reverse proxy. Defaults to "/". The PXE
+	// server must be told the same prefix.
+	PathPrefix string
+	// If set, write a line in Apache Combined Log Format here for
+	// every request.
+	AccessLog io.Writer
+	// If set, serve Go's profiling handlers under /debug/pprof/.
+	// Anyone who can reach the server can use them, so only turn
+	// this on when debugging.
+	Pprof bool
+	// File holding the key used to sign file URLs, so that URLs
+	// handed out before a restart still work after it. Created with
+	// a fresh key if it doesn't exist. If unset, a new key is
+	// generated every time the server starts.
+	SigningKeyFile string
+	// Maximum number of concurrent file transfers. Requests beyond
+	// that wait up to TransferQueueTimeout (default
+	// DefaultTransferQueueTimeout) for a slot, and then get a 503.
+	// Zero means no limit.
+	MaxTransfers         int
+	TransferQueueTimeout time.Duration
+	// If set, and the Booter is an api.ContentHasher, file URLs are
+	// based on the file contents, so identical files get identical
+	// URLs.
+	ContentAddressed bool
+	// If set, turns the URL of a file, relative to the server root
+	// (e.g. "f/..."), into the URL handed out in configs and
+	// scripts, for clients that need absolute URLs or files served
+	// from another host. See BaseURL. By default, file URLs are
+	// relative.
+	FileURL func(path string) string
+	// What to do with machines that shouldn't netboot. Defaults to
+	// FallbackDisk. For locked down setups where machines must never
+	// boot from their own disk, use FallbackReboot, or FallbackCustom
+	// with the pxelinux config to serve in FallbackConfig.
+	Fallback       FallbackPolicy
+	FallbackConfig string
+	// When the Booter returns api.ErrTemporary, machines are told to
+	// wait RetryDelay plus a random part of RetryJitter, and then
+	// ask again. The jitter spreads the retries out, so that the
+	// Booter's backend isn't swamped when it comes back. Zero means
+	// the Default constant, negative means none.
+	RetryDelay, RetryJitter time.Duration
+	// pxelinux config and iPXE script for machines the Booter doesn't
+	// know (api.ErrUnknownMAC), e.g. to boot an inventory image on
+	// brand new hardware. If unset, unknown machines get the
+	// fallback.
+	OnboardingConfig, OnboardingScript string
+	// Connection timeouts, so that slow or stuck clients can't hold
+	// connections open forever. ReadHeaderTimeout limits how long a
+	// client can take to send its request headers, IdleTimeout how
+	// long a keep-alive connection can sit idle, and WriteTimeout how
+	// long a whole response can take, which must allow for big
+	// images over slow links. Long-lived /events streams are cut off
+	// after WriteTimeout too, and have to reconnect. Zero means the
+	// Default constant, negative means no timeout.
+	ReadHeaderTimeout, IdleTimeout, WriteTimeout time.Duration
+	// If set, machines the filter doesn't allow are told to boot
+	// from disk, whatever the Booter says.
+	MACFilter *api.MACFilter
+	// If set, /api/leases lists what this returns, e.g. the leases of
+	// a full DHCP server's dhcp.Pool.
+	Leases func() []dhcp.Lease
+	// If set, log entries and metrics about pxelinux configs are
+	// tagged with the site the machine is at.
+	Sites *pxe.SiteMap
+
+	// Hooks for integrating with other systems, e.g. to update an
+	// inventory when machines boot. They're called synchronously,
+	// so slow hooks hold up the request that triggered them.
+	//
+	// OnConfigServed is called when a machine is given a pxelinux
+	// config or iPXE script that boots spec, after commandline
+	// expansion.
+	OnConfigServed func(mac net.HardwareAddr, spec *api.BootSpec)
+	// OnFileServed is called after each successful file transfer,
+	// with the Booter's ID for the file and the number of bytes
+	// sent, which is the compressed size if it was compressed. mac
+	// is nil if the request doesn't say which machine it's for.
+	OnFileServed func(mac net.HardwareAddr, fileID string, bytes int64)
+
+	initOnce sync.Once
+	internal *httpServer
+	initErr  error
+
+	listenMu sync.Mutex
+	listener net.Listener
+}
+
 type httpServer struct {
-	booter  api.Booter
-	ldlinux []byte
-	key     [32]byte // to sign URLs
+	booter      api.ContextBooter
+	profiles    api.ProfileBooter
+	ldlinux     []byte
+	bootMessage string
+	dryRun      bool
+	fileRetries int
+	maxFileSize int64
+	progress    progressStore
+	transfers   *transferLimiter
+	content     *contentURLs   // nil if not content addressing
+	enumerator  api.Enumerator // nil if the Booter isn't one
+	urlFunc     func(string) string
+	pathPrefix  string // "/" or "/<prefix>/"
+	macFilter   *api.MACFilter
+	static      map[string][]byte
+	types       map[string]string   // extension to Content-Type
+	leases      func() []dhcp.Lease // nil if not leasing addresses
+	sites       *pxe.SiteMap
+
+	onConfigServed func(mac net.HardwareAddr, spec *api.BootSpec)
+	onFileServed   func(mac net.HardwareAddr, fileID string, bytes int64)
+	// Configs for machines that shouldn't netboot.
+	fallback, ipxeFallback  string
+	retryDelay, retryJitter time.Duration
+	// Configs for machines the Booter doesn't know, if any.
+	onboarding, ipxeOnboarding string
+	key                        [32]byte // to sign URLs
+	mux                        *http.ServeMux
+}
+
+// Arch serves requests under /arch/<n>/ by stripping the prefix and
+// handing them to the regular handlers, remembering that the client
+// has architecture n. The PXE server points clients that aren't
+// legacy BIOS machines at this prefix.
+func (s *httpServer) Arch(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/arch/")
+	i := strings.IndexByte(rest, '/')
+	if i == -1 {
+		http.NotFound(w, r)
+		return
+	}
+	arch, err := strconv.ParseUint(rest[:i], 10, 16)
+	if err != nil {
+		log.Debug("HTTP", "Bad architecture in URL %q from %s", r.URL, r.RemoteAddr)
+		http.Error(w, "Malformed architecture in request", http.StatusBadRequest)
+		return
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), archKey{}, uint16(arch)))
+	u := *r.URL
+	u.Path = rest[i:]
+	r.URL = &u
+	s.mux.ServeHTTP(w, r)
+}
+
+// BootID serves requests under /id/<boot ID>/ by stripping the
+// prefix and handing them to the regular handlers, remembering the
+// boot ID for logging. The PXE server tags each boot it starts this
+// way.
+func (s *httpServer) BootID(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/id/")
+	i := strings.IndexByte(rest, '/')
+	if i == -1 {
+		http.NotFound(w, r)
+		return
+	}
+	// Boot IDs end up in logs, so don't take just anything.
+	if i == 0 || i > 64 || strings.Trim(rest[:i], "0123456789abcdef-") != "" {
+		log.Debug("HTTP", "Bad boot ID in URL %q from %s", r.URL, r.RemoteAddr)
+		http.Error(w, "Malformed boot ID in request", http.StatusBadRequest)
+		return
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), bootIDKey{}, log.BootID(rest[:i])))
+	u := *r.URL
+	u.Path = rest[i:]
+	r.URL = &u
+	s.mux.ServeHTTP(w, r)
+}
+
+// Profile serves requests under /profile/<name>/ by stripping the
+// prefix and handing them to the regular handlers, remembering that
+// the client asked for the named boot profile.
+func (s *httpServer) Profile(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/profile/")
+	i := strings.IndexByte(rest, '/')
+	if i == -1 {
+		http.NotFound(w, r)
+		return
+	}
+	if !pxe.ValidProfile(rest[:i]) {
+		log.Debug("HTTP", "Bad profile in URL %q from %s", r.URL, r.RemoteAddr)
+		http.Error(w, "Malformed profile in request", http.StatusBadRequest)
+		return
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), profileKey{}, rest[:i]))
+	u := *r.URL
+	u.Path = rest[i:]
+	r.URL = &u
+	s.mux.ServeHTTP(w, r)
+}
+
+// requestProfile returns the context of r, noting the boot profile
+// asked for by its "profile" query parameter, if any.
+func requestProfile(r *http.Request) (context.Context, error) {
+	profile := r.URL.Query().Get("profile")
+	if profile == "" {
+		return r.Context(), nil
+	}
+	if !pxe.ValidProfile(profile) {
+		return nil, fmt.Errorf("malformed profile %q", profile)
+	}
+	return context.WithValue(r.Context(), profileKey{}, profile), nil
+}
+
+// profile returns the boot profile noted in ctx, or "" if there isn't
+// one.
+func profile(ctx context.Context) string {
+	p, _ := ctx.Value(profileKey{}).(string)
+	return p
+}
+
+// bootID returns the boot ID of r, as noted by BootID, or "" if it
+// doesn't have one.
+func bootID(ctx context.Context) log.BootID {
+	id, _ := ctx.Value(bootIDKey{}).(log.BootID)
+	return id
+}
+
+// fileBootID returns the boot ID to tag the file URLs handed out to
+// mac with, and the path to put in front of them to do so. The path
+// is empty if the file URLs are relative to a URL that's already
+// tagged.
+func (s *httpServer) fileBootID(ctx context.Context, mac net.HardwareAddr, urlPrefix string) (log.BootID, string) {
+	id := bootID(ctx)
+	if id != "" && urlPrefix == "" && s.urlFunc == nil {
+		return id, ""
+	}
+	if id == "" {
+		id = log.NewBootID(mac)
+	}
+	return id, "id/" + string(id) + "/"
+}
+
+// clientArch returns the architecture of the client making r, as
+// noted by Arch. Requests outside of /arch/ come from legacy BIOS
+// clients.
+func clientArch(r *http.Request) uint16 {
+	arch, _ := r.Context().Value(archKey{}).(uint16)
+	return arch
 }
 
 func (s *httpServer) Ldlinux(w http.ResponseWriter, r *http.Request) {
-	log.Debug("HTTP", "Starting send of ldlinux.c32 to %s (%d bytes)", r.RemoteAddr, len(s.ldlinux))
 	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(s.ldlinux)))
+	if r.Method == "HEAD" {
+		return
+	}
+	log.Debug("HTTP", "Starting send of ldlinux.c32 to %s (%d bytes)", r.RemoteAddr, len(s.ldlinux))
 	w.Write(s.ldlinux)
 	log.Log("HTTP", "Sent ldlinux.c32 to %s (%d bytes)", r.RemoteAddr, len(s.ldlinux))
 }
 
+// NotFound answers requests that no other handler takes. Requests
+// for syslinux modules get logged, since they're usually from a
+// config that needs a module nobody gave us.
+func (s *httpServer) NotFound(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, ".c32") {
+		log.Debug("HTTP", "%s asked for syslinux module %s, which we don't have", r.RemoteAddr, path.Base(r.URL.Path))
+	}
+	http.NotFound(w, r)
+}
+
+// parsePxelinuxMAC parses the name of a per-machine pxelinux config
+// file, which is the client's ARP hardware type followed by its
+// hardware address, in hex bytes separated by dashes, e.g.
+// "01-88-99-aa-bb-cc-dd" for Ethernet. Addresses can be up to 20
+// bytes, the length of an IPoIB address.
+func parsePxelinuxMAC(name string) (net.HardwareAddr, error) {
+	parts := strings.Split(name, "-")
+	if len(parts) < 2 || len(parts) > 21 {
+		return nil, fmt.Errorf("%q is not a hardware type and address", name)
+	}
+	var mac net.HardwareAddr
+	for _, p := range parts {
+		if len(p) != 2 {
+			return nil, fmt.Errorf("%q is not a hardware type and address", name)
+		}
+		b, err := strconv.ParseUint(p, 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a hardware type and address", name)
+		}
+		mac = append(mac, byte(b))
+	}
+	// Drop the hardware type, the Booter only cares about the
+	// address.
+	return mac[1:], nil
+}
+
+// serveBlob returns a handler that serves b as the file name.
+func serveBlob(name string, b []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		if r.Method == "HEAD" {
+			return
+		}
+		w.Write(b)
+		log.Log("HTTP", "Sent %s to %s (%d bytes)", name, r.RemoteAddr, len(b))
+	}
+}
+
 func (s *httpServer) PxelinuxConfig(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 
-	macStr := filepath.Base(r.URL.Path)
-	errStr := fmt.Sprintf("%s requested a pxelinux config from URL %q, which does not include a MAC address", r.RemoteAddr, r.URL)
-	if !strings.HasPrefix(macStr, "01-") {
-		log.Debug("HTTP", errStr)
-		http.Error(w, "Missing MAC address in request", http.StatusBadRequest)
+	mac, err := parsePxelinuxMAC(filepath.Base(r.URL.Path))
+	if err != nil {
+		log.Debug("HTTP", "%s requested a pxelinux config from URL %q, which does not include a MAC address: %s", r.RemoteAddr, r.URL, err)
+		http.Error(w, "Malformed MAC address in request", http.StatusBadRequest)
 		return
 	}
-	mac, err := net.ParseMAC(macStr[3:])
+	ctx, err := requestProfile(r)
 	if err != nil {
-		log.Debug("HTTP", errStr)
-		http.Error(w, "Malformed MAC address in request", http.StatusBadRequest)
+		log.Debug("HTTP", "%s requested a pxelinux config from URL %q: %s", r.RemoteAddr, r.URL, err)
+		http.Error(w, "Malformed profile in request", http.StatusBadRequest)
 		return
 	}
 
-	spec, err := s.booter.BootSpec(mac)
-	if err != nil {
+	cfg, id := s.pxelinuxConfig(ctx, mac, clientArch(r), "", s.baseURL(r), r.RemoteAddr)
+	w.Write([]byte(cfg))
+	log.WithBoot(id).WithSite(s.site(r.RemoteAddr)).Log("HTTP", "Sent pxelinux config to %s (%s)", mac, r.RemoteAddr)
+}
+
+// pxelinuxConfig returns the pxelinux config for mac, as seen from
+// remoteAddr, and the ID of the boot it's for. File URLs in the config
+// are prefixed with urlPrefix, which can be empty if the config is
+// fetched from the HTTP server itself. baseURL is the absolute URL of
+// the server root, for the URLs of auxiliary files in the cmdline.
+func (s *httpServer) pxelinuxConfig(ctx context.Context, mac net.HardwareAddr, arch uint16, urlPrefix, baseURL, remoteAddr string) (string, log.BootID) {
+	id, idPath := s.fileBootID(ctx, mac, urlPrefix)
+	site := s.site(remoteAddr)
+	if !s.macFilter.Allows(mac) {
+		log.WithBoot(id).WithSite(site).Log("HTTP", "Telling pxelinux on %s (%s) to boot from disk, its MAC address is not allowed", mac, remoteAddr)
+		s.countBootSpec(site, "disk")
+		return bootFromDisk, id
+	}
+	archSpec, err := s.profiles.BootSpecProfile(ctx, mac, profile(ctx))
+	switch {
+	case err == api.ErrUnknownMAC && s.onboarding != "":
+		log.WithBoot(id).WithSite(site).Log("HTTP", "Giving pxelinux on %s (%s) the onboarding config, the Booter doesn't know it", mac, remoteAddr)
+		s.countBootSpec(site, "onboarding")
+		return s.onboarding, id
+	case err == api.ErrBootFromDisk:
+		log.WithBoot(id).WithSite(site).Debug("HTTP", "Telling pxelinux on %s (%s) to boot from disk, as the Booter asked", mac, remoteAddr)
+		s.countBootSpec(site, "disk")
+		return bootFromDisk, id
+	case err == api.ErrTemporary:
+		wait := s.retryWait()
+		log.WithBoot(id).WithSite(site).Log("HTTP", "Telling pxelinux on %s (%s) to retry in %s, the Booter is temporarily unavailable", mac, remoteAddr, wait)
+		s.countBootSpec(site, "retry")
+		secs := int(wait.Seconds())
+		return fmt.Sprintf(retryConfig, secs, secs*10), id
+	case err != nil:
 		// We have a machine sitting in pxelinux, but the Booter says
 		// we shouldn't be netbooting. So, give it a config that tells
 		// pxelinux to shut down PXE booting and continue with the
 		// next local boot method.
-		log.Debug("HTTP", "Telling pxelinux on %s (%s) to boot from disk because of API server verdict: %s", mac, r.RemoteAddr, err)
-		w.Write([]byte(bootFromDisk))
+		log.WithBoot(id).WithSite(site).Debug("HTTP", "Giving pxelinux on %s (%s) the fallback config because of API server verdict: %s", mac, remoteAddr, err)
+		s.countBootSpec(site, "fallback")
+		return s.fallback, id
+	}
+	spec := archSpec.ForArch(arch)
+	files := s.auxFileURLs(spec.Files, baseURL, id)
+	progress := s.progressURL(mac, baseURL, id)
+	if spec.Cmdline, err = expandCmdline(spec.Cmdline, mac, remoteAddr, arch, files, progress); err != nil {
+		log.WithBoot(id).WithSite(site).Log("HTTP", "Giving pxelinux on %s (%s) the fallback config, couldn't expand its cmdline: %s", mac, remoteAddr, err)
+		s.countBootSpec(site, "fallback")
+		return s.fallback, id
+	}
+	if spec.Menu != nil {
+		for i := range spec.Menu.Entries {
+			e := &spec.Menu.Entries[i]
+			if e.Cmdline, err = expandCmdline(e.Cmdline, mac, remoteAddr, arch, files, progress); err != nil {
+				log.WithBoot(id).WithSite(site).Log("HTTP", "Giving pxelinux on %s (%s) the fallback config, couldn't expand the cmdline of menu entry %q: %s", mac, remoteAddr, e.Label, err)
+				s.countBootSpec(site, "fallback")
+				return s.fallback, id
+			}
+		}
+	}
+	if s.dryRun {
+		logDryRun("pxelinux", mac, remoteAddr, spec, id, site)
+		s.countBootSpec(site, "disk")
+		return bootFromDisk, id
+	}
+
+	cfg, err := s.renderPxelinuxConfig(*spec, urlPrefix, idPath)
+	if err != nil {
+		log.WithBoot(id).WithSite(site).Log("HTTP", "Giving pxelinux on %s (%s) the fallback config, couldn't render its config: %s", mac, remoteAddr, err)
+		s.countBootSpec(site, "fallback")
+		return s.fallback, id
+	}
+	s.countBootSpec(site, "netboot")
+	if s.onConfigServed != nil {
+		s.onConfigServed(mac, spec)
+	}
+	return cfg, id
+}
+
+// site returns the site of the machine at remoteAddr, an "ip:port"
+// string.
+func (s *httpServer) site(remoteAddr string) log.Site {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return s.sites.Site(net.ParseIP(host))
+}
+
+// logDryRun logs what the bootloader client on mac would have booted,
+// had this not been a dry run. spec must still have file IDs, not
+// signed URLs, so that the log says which files rather than how to
+// fetch them.
+func logDryRun(client string, mac net.HardwareAddr, remoteAddr string, spec *api.BootSpec, id log.BootID, site log.Site) {
+	log.WithBoot(id).WithSite(site).Log("HTTP", "Dry run: would have booted %s (%s) into kernel %q, initrds %q, cmdline %q, telling %s to boot from disk", mac, remoteAddr, spec.Kernel, spec.Initrd, spec.Cmdline, client)
+}
+
+// countBootSpec counts a boot spec decision for a machine at site.
+func (s *httpServer) countBootSpec(site log.Site, result string) {
+	metrics.BootSpecs.Inc(result)
+	if site != "" {
+		metrics.SiteBootSpecs.Inc(string(site), result)
+	}
+}
+
+// retryWait returns how long a machine should wait before asking
+// again for a boot spec the Booter couldn't give right now.
+func (s *httpServer) retryWait() time.Duration {
+	wait := s.retryDelay
+	if s.retryJitter > 0 {
+		wait += time.Duration(mrand.Int63n(int64(s.retryJitter)))
+	}
+	// pxelinux and iPXE count in whole seconds, and a zero timeout
+	// means forever to pxelinux.
+	if wait < time.Second {
+		return time.Second
+	}
+	return wait.Truncate(time.Second)
+}
+
+// expandCmdline expands cmdline as a Go template, so that BootSpecs
+// can customize it for each machine with e.g. "ip={{.ClientIP}}", or
+// point at auxiliary files, whose URLs are given in files, or at the
+// URL to report boot progress to.
+func expandCmdline(cmdline string, mac net.HardwareAddr, remoteAddr string, arch uint16, files map[string]string, progressURL string) (string, error) {
+	if !strings.Contains(cmdline, "{{") {
+		return cmdline, nil
+	}
+	tmpl, err := template.New("cmdline").Option("missingkey=error").Parse(cmdline)
+	if err != nil {
+		return "", err
+	}
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+	var b bytes.Buffer
+	err = tmpl.Execute(&b, struct {
+		MAC         string
+		ClientIP    string
+		Arch        uint16
+		Files       map[string]string
+		ProgressURL string
+	}{mac.String(), ip, arch, files, progressURL})
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+var pxelinuxConfigTemplate = template.Must(template.New("pxelinux").Funcs(template.FuncMap{"join": strings.Join}).Parse(`
+{{range .Say}}SAY {{.}}
+{{end}}DEFAULT linux
+LABEL linux
+LINUX {{.Kernel}}
+APPEND{{if .Initrd}} initrd={{join .Initrd ","}}{{end}}{{if .Cmdline}} {{.Cmdline}}{{end}}
+`))
+
+var pxelinuxMenuTemplate = template.Must(template.New("pxelinux").Funcs(template.FuncMap{"join": strings.Join}).Parse(`
+{{range .Say}}SAY {{.}}
+{{end}}UI menu.c32
+{{if .Title}}MENU TITLE {{.Title}}
+{{end}}TIMEOUT {{.Timeout}}
+{{range .Entries}}
+LABEL {{.Label}}
+MENU LABEL {{.Title}}
+{{if .Default}}MENU DEFAULT
+{{end}}{{if .LocalBoot}}LOCALBOOT 0
+{{else}}LINUX {{.Kernel}}
+APPEND{{if .Initrd}} initrd={{join .Initrd ","}}{{end}}{{if .Cmdline}} {{.Cmdline}}{{end}}
+{{end}}{{end}}`))
+
+// menuEntry is an api.MenuEntry as pxelinuxMenuTemplate wants it.
+type menuEntry struct {
+	api.MenuEntry
+	Default bool
+}
+
+// renderPxelinuxConfig returns the pxelinux config that boots spec, or
+// shows its menu, with its file IDs turned into signed URLs under
+// httpPrefix, tagged with idPath.
+func (s *httpServer) renderPxelinuxConfig(spec api.BootSpec, httpPrefix, idPath string) (string, error) {
+	var say []string
+	if s.bootMessage != "" {
+		say = strings.Split(s.bootMessage, "\n")
+	}
+	var b bytes.Buffer
+	var err error
+	if spec.Menu != nil {
+		err = pxelinuxMenuTemplate.Execute(&b, struct {
+			Title   string
+			Timeout int64
+			Entries []menuEntry
+			Say     []string
+		}{spec.Menu.Title, int64(spec.Menu.Timeout / (100 * time.Millisecond)), s.menuEntries(spec.Menu, httpPrefix, idPath), say})
+	} else {
+		spec.Initrd = append([]string(nil), spec.Initrd...)
+		s.signURLs(&spec, httpPrefix, idPath)
+		err = pxelinuxConfigTemplate.Execute(&b, struct {
+			api.BootSpec
+			Say []string
+		}{spec, say})
+	}
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// menuEntries returns the entries of menu, with their file IDs signed
+// like in renderPxelinuxConfig, and the default entry marked.
+func (s *httpServer) menuEntries(menu *api.Menu, httpPrefix, idPath string) []menuEntry {
+	ret := make([]menuEntry, 0, len(menu.Entries))
+	def := menu.Default
+	for i, e := range menu.Entries {
+		if e.Label == "" {
+			e.Label = fmt.Sprintf("entry%d", i)
+		}
+		if e.Title == "" {
+			e.Title = e.Label
+		}
+		if def == "" {
+			def = e.Label
+		}
+		if !e.LocalBoot {
+			signed := api.BootSpec{Kernel: e.Kernel, Initrd: append([]string(nil), e.Initrd...)}
+			s.signURLs(&signed, httpPrefix, idPath)
+			e.Kernel, e.Initrd = signed.Kernel, signed.Initrd
+		}
+		ret = append(ret, menuEntry{e, e.Label == def})
+	}
+	return ret
+}
+
+// TFTPHandler returns a TFTP handler that serves pxelinux configs,
+// for pxelinux builds that insist on fetching their config over TFTP
+// rather than from the HTTP path prefix they were given. The configs
+// point at this server for the actual files. Requests for anything
+// other than a pxelinux config are passed on to fallback.
+func (srv *Server) TFTPHandler(fallback tftp.Handler) tftp.Handler {
+	return func(path string, clientAddr net.Addr) (io.ReadCloser, error) {
+		if !strings.HasPrefix(path, "pxelinux.cfg/") {
+			return fallback(path, clientAddr)
+		}
+		mac, err := parsePxelinuxMAC(strings.TrimPrefix(path, "pxelinux.cfg/"))
+		if err != nil {
+			// Probably one of the fallback names pxelinux tries
+			// (UUID, IP address, "default"). Only MACs get a config.
+			return fallback(path, clientAddr)
+		}
+		s, err := srv.state()
+		if err != nil {
+			return nil, err
+		}
+		ip := srv.AdvertiseIP
+		if ip == nil {
+			if ip, err = localIPFor(clientAddr); err != nil {
+				return nil, err
+			}
+		}
+		scheme := "http"
+		if srv.CertFile != "" {
+			scheme = "https"
+		}
+		base := fmt.Sprintf("%s://%s:%d%s", scheme, ip, srv.port(), s.pathPrefix)
+		// pxelinux only does TFTP for BIOS machines.
+		cfg, id := s.pxelinuxConfig(context.Background(), mac, 0, base, base, clientAddr.String())
+		log.WithBoot(id).Log("HTTP", "Sent pxelinux config to %s (%s) over TFTP", mac, clientAddr)
+		return tftp.Blob([]byte(cfg))(path, clientAddr)
+	}
+}
+
+// LoaderTFTPHandler returns a TFTP handler that serves the UEFI
+// loaders, for PXE firmware that fetches its first bootloader over
+// TFTP. Requests for anything else are passed on to fallback.
+func (srv *Server) LoaderTFTPHandler(fallback tftp.Handler) tftp.Handler {
+	loaders := srv.loaders()
+	return func(path string, clientAddr net.Addr) (io.ReadCloser, error) {
+		if blob, ok := loaders[path]; ok {
+			return tftp.Blob(blob)(path, clientAddr)
+		}
+		return fallback(path, clientAddr)
+	}
+}
+
+// loaders returns the UEFI loaders to serve, by path.
+func (srv *Server) loaders() map[string][]byte {
+	ret := map[string][]byte{}
+	if len(srv.EFILoader) > 0 {
+		ret[pxe.EFILoaderPath] = srv.EFILoader
+	}
+	for arch, blob := range srv.Loaders {
+		ret[pxe.LoaderPath(arch)] = blob
+	}
+	return ret
+}
+
+// httpBootLoader serves loader, the bootloader that UEFI HTTP Boot
+// clients are pointed at, unless the Booter marks the client's kernel
+// as api.BootSpec.EFIDirect. Then the client gets the kernel instead,
+// and boots it without a bootloader. Deciding here, rather than when
+// the PXE server points the client at us, keeps Booter lookups out of
+// the PXE server's loop, and only asks once per boot rather than once
+// per DHCP retransmit.
+func (s *httpServer) httpBootLoader(loader http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		kernel := s.directKernel(r)
+		if kernel == "" {
+			loader(w, r)
+			return
+		}
+		u := *r.URL
+		u.Path = "/" + kernel
+		r = r.WithContext(r.Context())
+		r.URL = &u
+		s.mux.ServeHTTP(w, r)
+	}
+}
+
+// directKernel returns the path, relative to the server root, of the
+// kernel that the UEFI HTTP Boot client making r should boot
+// directly, or "" if it should get its loader.
+func (s *httpServer) directKernel(r *http.Request) string {
+	ctx := r.Context()
+	mac := bootID(ctx).MAC()
+	if mac == nil || clientArch(r) != pxe.ArchEFIx64HTTP || s.dryRun || !s.macFilter.Allows(mac) {
+		return ""
+	}
+	archSpec, err := s.profiles.BootSpecProfile(ctx, mac, profile(ctx))
+	if err != nil || !archSpec.EFIDirect {
+		return ""
+	}
+	spec := archSpec.ForArch(clientArch(r))
+	site := s.site(r.RemoteAddr)
+	if r.Method != "HEAD" {
+		// The machine won't ask for a config, so this is the only
+		// chance to count it.
+		s.countBootSpec(site, "netboot")
+		if s.onConfigServed != nil {
+			s.onConfigServed(mac, spec)
+		}
+	}
+	log.WithBoot(bootID(ctx)).WithSite(site).Log("HTTP", "Sending UEFI HTTP Boot client %s its kernel instead of a loader", mac)
+	return s.fileURL(spec.Kernel, time.Now().Add(fileURLLifetime))
+}
+
+// localIPFor returns the local IP address that traffic to addr goes
+// out from.
+func localIPFor(addr net.Addr) (net.IP, error) {
+	// Connecting a UDP socket sends nothing, it just makes the
+	// kernel pick a route and source address.
+	conn, err := net.Dial("udp4", addr.String())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't find a local address to reach %s: %s", addr, err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// Healthz reports that the server is up.
+func (s *httpServer) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+// Readyz reports whether the server is ready to boot machines: it has
+// a bootloader to serve, and the Booter says it's healthy.
+func (s *httpServer) Readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if len(s.ldlinux) == 0 {
+		http.Error(w, "ldlinux.c32 not loaded", http.StatusServiceUnavailable)
+		return
+	}
+	if err := api.Healthy(s.booter); err != nil {
+		log.Debug("HTTP", "Readiness check failed, Booter is unhealthy: %s", err)
+		http.Error(w, fmt.Sprintf("Booter unhealthy: %s", err), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// IPXEScript serves an iPXE script that boots the machine whose MAC
+// address is given in the "mac" query parameter. It's the iPXE
+// equivalent of PxelinuxConfig.
+func (s *httpServer) IPXEScript(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+
+	mac, err := net.ParseMAC(r.URL.Query().Get("mac"))
+	if err != nil {
+		log.Debug("HTTP", "%s requested an iPXE script from URL %q, which does not include a valid MAC address", r.RemoteAddr, r.URL)
+		http.Error(w, "Malformed MAC address in request", http.StatusBadRequest)
+		return
+	}
+
+	ctx, err := requestProfile(r)
+	if err != nil {
+		log.Debug("HTTP", "%s requested an iPXE script from URL %q: %s", r.RemoteAddr, r.URL, err)
+		http.Error(w, "Malformed profile in request", http.StatusBadRequest)
+		return
+	}
+	id, idPath := s.fileBootID(ctx, mac, "")
+	site := s.site(r.RemoteAddr)
+	if !s.macFilter.Allows(mac) {
+		log.WithBoot(id).WithSite(site).Log("HTTP", "Telling iPXE on %s (%s) to boot from disk, its MAC address is not allowed", mac, r.RemoteAddr)
+		s.countBootSpec(site, "disk")
+		w.Write([]byte(ipxeBootFromDisk))
+		return
+	}
+	archSpec, err := s.profiles.BootSpecProfile(ctx, mac, profile(ctx))
+	switch {
+	case err == api.ErrUnknownMAC && s.ipxeOnboarding != "":
+		log.WithBoot(id).WithSite(site).Log("HTTP", "Giving iPXE on %s (%s) the onboarding script, the Booter doesn't know it", mac, r.RemoteAddr)
+		s.countBootSpec(site, "onboarding")
+		w.Write([]byte(s.ipxeOnboarding))
+		return
+	case err == api.ErrBootFromDisk:
+		log.WithBoot(id).WithSite(site).Debug("HTTP", "Telling iPXE on %s (%s) to boot from disk, as the Booter asked", mac, r.RemoteAddr)
+		s.countBootSpec(site, "disk")
+		w.Write([]byte(ipxeBootFromDisk))
+		return
+	case err == api.ErrTemporary:
+		wait := s.retryWait()
+		log.WithBoot(id).WithSite(site).Log("HTTP", "Telling iPXE on %s (%s) to retry in %s, the Booter is temporarily unavailable", mac, r.RemoteAddr, wait)
+		s.countBootSpec(site, "retry")
+		// Relative to this script's URL, so any /id/ or /profile/
+		// prefix is kept.
+		fmt.Fprintf(w, ipxeRetry, int(wait.Seconds()), "ipxe?"+r.URL.RawQuery)
+		return
+	case err != nil:
+		log.WithBoot(id).WithSite(site).Debug("HTTP", "Giving iPXE on %s (%s) the fallback script because of API server verdict: %s", mac, r.RemoteAddr, err)
+		s.countBootSpec(site, "fallback")
+		w.Write([]byte(s.ipxeFallback))
+		return
+	}
+	spec := archSpec.ForArch(clientArch(r))
+	files := s.auxFileURLs(spec.Files, s.baseURL(r), id)
+	progress := s.progressURL(mac, s.baseURL(r), id)
+	if spec.Cmdline, err = expandCmdline(spec.Cmdline, mac, r.RemoteAddr, clientArch(r), files, progress); err != nil {
+		log.WithBoot(id).WithSite(site).Log("HTTP", "Giving iPXE on %s (%s) the fallback script, couldn't expand its cmdline: %s", mac, r.RemoteAddr, err)
+		s.countBootSpec(site, "fallback")
+		w.Write([]byte(s.ipxeFallback))
+		return
+	}
+	if s.dryRun {
+		logDryRun("iPXE", mac, r.RemoteAddr, spec, id, site)
+		s.countBootSpec(site, "disk")
+		w.Write([]byte(ipxeBootFromDisk))
 		return
 	}
 
+	// The script lives next to f/, so iPXE resolves the relative
+	// file URLs to the right place.
+	signed := spec.Clone()
+	s.signURLs(signed, "", idPath)
+	var b bytes.Buffer
+	b.WriteString("#!ipxe\n")
+	fmt.Fprintf(&b, "kernel --name kernel %s %s\n", signed.Kernel, signed.Cmdline)
+	for _, initrd := range signed.Initrd {
+		fmt.Fprintf(&b, "initrd %s\n", initrd)
+	}
+	b.WriteString("boot\n")
+
+	b.WriteTo(w)
+	s.countBootSpec(site, "netboot")
+	log.WithBoot(id).WithSite(site).Log("HTTP", "Sent iPXE script to %s (%s)", mac, r.RemoteAddr)
+	if s.onConfigServed != nil {
+		s.onConfigServed(mac, spec)
+	}
+}
+
+// signURLs replaces the file IDs in spec with signed URLs under
+// urlPrefix. idPath goes in front of each URL's path, to tag it with
+// a boot ID.
+func (s *httpServer) signURLs(spec *api.BootSpec, urlPrefix, idPath string) {
 	// The file IDs can be arbitrary blobs that make sense to the
-	// Booter, but pxelinux speaks URL, so we need to encode the
-	// blobs.
-	spec.Kernel = "f/" + base64.URLEncoding.EncodeToString([]byte(spec.Kernel))
+	// Booter, but bootloaders speak URL, so we need to encode the
+	// blobs. We also sign them, so that File only serves things we
+	// actually handed out in a config.
+	expires := time.Now().Add(fileURLLifetime)
+	// Loading the same initrd twice is wasted time at best, so drop
+	// repeats, keeping the first of each.
+	spec.Initrd = dedup(spec.Initrd)
+	spec.Kernel = s.externalURL(idPath+s.fileURL(spec.Kernel, expires), urlPrefix)
 	for i := range spec.Initrd {
-		spec.Initrd[i] = "f/" + base64.URLEncoding.EncodeToString([]byte(spec.Initrd[i]))
+		spec.Initrd[i] = s.externalURL(idPath+s.fileURL(spec.Initrd[i], expires), urlPrefix)
 	}
+}
 
-	cfg := fmt.Sprintf(`
-SAY %s
-DEFAULT linux
-LABEL linux
-LINUX %s
-APPEND initrd=%s %s
-`, strings.Replace(limerick, "\n", "\nSAY ", -1), spec.Kernel, strings.Join(spec.Initrd, ","), spec.Cmdline)
+// auxFileURLs returns signed absolute URLs under baseURL for the
+// auxiliary files in files, tagged with boot ID id.
+func (s *httpServer) auxFileURLs(files map[string]string, baseURL string, id log.BootID) map[string]string {
+	if len(files) == 0 {
+		return nil
+	}
+	expires := time.Now().Add(auxFileURLLifetime)
+	ret := make(map[string]string, len(files))
+	for name, fileID := range files {
+		ret[name] = s.externalURL("id/"+string(id)+"/"+s.fileURL(fileID, expires), baseURL)
+	}
+	return ret
+}
 
-	w.Write([]byte(cfg))
-	log.Log("HTTP", "Sent pxelinux config to %s (%s)", mac, r.RemoteAddr)
+// progressURL returns the signed absolute URL under baseURL that the
+// machine mac can POST its boot progress to, tagged with boot ID id.
+func (s *httpServer) progressURL(mac net.HardwareAddr, baseURL string, id log.BootID) string {
+	sig := s.sign(progressSigningID(mac), time.Now().Add(progressURLLifetime))
+	return baseURL + "id/" + string(id) + "/boot/progress/" + mac.String() + "/" + base64.URLEncoding.EncodeToString(sig)
+}
+
+// progressSigningID is what progress URLs for mac sign, distinct from
+// any file ID so that one can't stand in for the other.
+func progressSigningID(mac net.HardwareAddr) string {
+	return "\x00progress/" + mac.String()
+}
+
+// baseURL returns the absolute URL of the server root, as seen by the
+// client making r.
+func (s *httpServer) baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + s.pathPrefix
+}
+
+// dedup returns ss without repeated strings, in the same order.
+func dedup(ss []string) []string {
+	seen := map[string]bool{}
+	ret := ss[:0]
+	for _, s := range ss {
+		if !seen[s] {
+			seen[s] = true
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// externalURL returns the URL to hand out for the file at path,
+// relative to the server root. Without a FileURL function, that's
+// path under urlPrefix.
+func (s *httpServer) externalURL(path, urlPrefix string) string {
+	if s.urlFunc != nil {
+		return s.urlFunc(path)
+	}
+	return urlPrefix + path
+}
+
+// BaseURL returns a Server.FileURL function that makes file URLs
+// absolute by resolving them against base, e.g.
+// "https://boot.example.com/pixiecore/".
+func BaseURL(base string) func(string) string {
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return func(path string) string {
+		return base + path
+	}
+}
+
+// fileURL returns the URL, relative to the server root, at which the
+// Booter file id can be fetched until expires.
+func (s *httpServer) fileURL(id string, expires time.Time) string {
+	if s.content != nil {
+		if u := s.content.url(id); u != "" {
+			return u
+		}
+	}
+	return s.signedFileURL(id, expires)
 }
 
 func (s *httpServer) File(w http.ResponseWriter, r *http.Request) {
-	encodedID := filepath.Base(r.URL.Path)
-	id, err := base64.URLEncoding.DecodeString(encodedID)
+	id := bootID(r.Context())
+	var fileID, contentHash string
+	if hash := strings.TrimPrefix(r.URL.Path, "/f/sha256/"); hash != r.URL.Path {
+		contentID, ok := "", false
+		if s.content != nil {
+			contentID, ok = s.content.id(hash)
+		}
+		if !ok {
+			log.WithBoot(id).Debug("HTTP", "Unknown content hash in %q from %s", r.URL, r.RemoteAddr)
+			http.NotFound(w, r)
+			return
+		}
+		fileID, contentHash = contentID, hash
+	} else {
+		encodedID, sig := strings.TrimPrefix(r.URL.Path, "/f/"), ""
+		if i := strings.IndexByte(encodedID, '/'); i != -1 {
+			encodedID, sig = encodedID[:i], encodedID[i+1:]
+		}
+		if base64.URLEncoding.DecodedLen(len(encodedID)) > maxFileIDLen {
+			log.WithBoot(id).Debug("HTTP", "Rejected %d byte file ID from %s", len(encodedID), r.RemoteAddr)
+			http.Error(w, "File ID too long", http.StatusBadRequest)
+			return
+		}
+		// Decoding onto the stack leaves fileID as the only
+		// allocation.
+		var buf [maxFileIDLen]byte
+		n, err := base64.URLEncoding.Decode(buf[:], []byte(encodedID))
+		if err != nil {
+			log.WithBoot(id).Log("HTTP", "Bad base64 encoding for URL %q from %s: %s", r.URL, r.RemoteAddr, err)
+			http.Error(w, "Malformed file ID", http.StatusBadRequest)
+			return
+		}
+		fileID = string(buf[:n])
+		if err = s.checkSignature(fileID, sig); err != nil {
+			log.WithBoot(id).Log("HTTP", "Rejected request for %q from %s: %s", r.URL, r.RemoteAddr, err)
+			http.Error(w, "Invalid file URL signature", http.StatusForbidden)
+			return
+		}
+	}
+	if r.Method == "HEAD" {
+		s.fileHead(w, r, fileID, id)
+		return
+	}
+	ok, queued := s.transfers.acquire(r.Context())
+	if queued > 0 {
+		log.WithBoot(id).Debug("HTTP", "Request for %q from %s queued behind %d others for a transfer slot", r.URL, r.RemoteAddr, queued-1)
+	}
+	if !ok && r.Context().Err() != nil {
+		log.WithBoot(id).Log("HTTP", "Dropping request for %q from %s, the client went away while queued", r.URL, r.RemoteAddr)
+		return
+	}
+	if !ok {
+		log.WithBoot(id).Log("HTTP", "Turning away request for %q from %s, too many transfers in progress", r.URL, r.RemoteAddr)
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "Too many transfers in progress, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.transfers.release()
+	start := time.Now()
+	f, pretty, err := s.booter.FileContext(r.Context(), fileID)
 	if err != nil {
-		log.Log("http", "Bad base64 encoding for URL %q from %s: %s", r.URL, r.RemoteAddr, err)
-		http.Error(w, "Malformed file ID", http.StatusBadRequest)
+		metrics.FileErrors.Inc()
+		log.WithBoot(id).Error("HTTP", "Couldn't get byte stream for %q from %s: %s", r.URL, r.RemoteAddr, err)
+		fileError(w, err)
+		return
+	}
+	if _, ok := f.(api.Checksummed); !ok && contentHash != "" {
+		// The file could still change between hashing and
+		// serving, so hold it to the hash in its URL.
+		if sum, err := api.ParseSHA256(contentHash); err == nil {
+			f = api.WithSHA256(f, sum)
+		}
+	}
+	src := &retryReader{
+		ctx: r.Context(),
+		f:   f,
+		reopen: func() (io.ReadCloser, error) {
+			f, _, err := s.booter.FileContext(r.Context(), fileID)
+			return f, err
+		},
+		pretty:  pretty,
+		retries: s.fileRetries,
+	}
+	defer src.Close()
+	// If the client goes away, close the Booter's stream right away,
+	// rather than whenever the next write fails, so that whatever is
+	// behind it (e.g. an upstream HTTP request) gets freed.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			src.abort()
+		case <-stop:
+		}
+	}()
+	if size, ok := fileSize(f); ok && s.maxFileSize > 0 && size > s.maxFileSize {
+		metrics.FileErrors.Inc()
+		log.WithBoot(id).Log("HTTP", "Refusing to send %s to %s: it has %d bytes, over the %d byte limit", pretty, r.RemoteAddr, size, s.maxFileSize)
+		http.Error(w, "File too large", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", s.contentType(pretty))
+	w.Header().Add("Vary", "Accept-Encoding")
+	if name := downloadName(pretty); name != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	}
+	var (
+		reader io.Reader = src
+		want   []byte
+		hash   = sha256.New()
+	)
+	if c, ok := f.(api.Checksummed); ok {
+		want = c.SHA256()
+		reader = io.TeeReader(src, hash)
+	}
+	if s.maxFileSize > 0 {
+		reader = &sizeCapReader{r: reader, left: s.maxFileSize}
+	}
+	if shouldCompress(r, f, pretty) {
+		w.Header().Set("Content-Encoding", "gzip")
+		cw := &countingWriter{ResponseWriter: w}
+		gz := getGzip(cw)
+		defer putGzip(gz)
+		read, err := copyFile(gz, reader)
+		if err == errFileTooLarge {
+			s.abortTooLarge(pretty, r, id)
+		}
+		if err == nil && src.err == nil {
+			// Hold back the gzip trailer until we know the
+			// contents are right.
+			checkDigest(pretty, r, want, hash.Sum(nil))
+			err = gz.Close()
+		}
+		metrics.FileBytes.Add(uint64(cw.written))
+		if (err != nil || src.err != nil) && clientGone(r, pretty, cw.written, id) {
+			return
+		}
+		if src.err != nil {
+			metrics.FileErrors.Inc()
+			log.WithBoot(id).Error("HTTP", "Truncated transfer of %s to %s after %d bytes: reading the file failed: %s", pretty, r.RemoteAddr, src.offset, src.err)
+			return
+		}
+		if err != nil {
+			metrics.FileErrors.Inc()
+			log.WithBoot(id).Error("HTTP", "Error serving %s to %s: %s", pretty, r.RemoteAddr, err)
+			return
+		}
+		metrics.FileDuration.ObserveSince(start)
+		if read > 0 {
+			log.WithBoot(id).Debug("HTTP", "Compressed %s from %d to %d bytes (%.1f%%)", pretty, read, cw.written, 100*float64(cw.written)/float64(read))
+		}
+		log.WithBoot(id).Log("HTTP", "Sent %s to %s (%d bytes, gzipped)", pretty, r.RemoteAddr, cw.written)
+		s.fileServed(id, fileID, cw.written)
+		return
+	}
+	if _, ok := f.(io.ReadSeeker); ok && (want == nil || r.Header.Get("Range") != "") {
+		// We can seek, so let net/http take care of Range requests
+		// for clients resuming interrupted downloads. It reads
+		// through src, so failed reads still get retried.
+		cw := &countingWriter{ResponseWriter: w}
+		http.ServeContent(cw, r, pretty, time.Time{}, src)
+		metrics.FileBytes.Add(uint64(cw.written))
+		if clientGone(r, pretty, cw.written, id) {
+			return
+		}
+		if src.err != nil {
+			metrics.FileErrors.Inc()
+			log.WithBoot(id).Error("HTTP", "Truncated transfer of %s to %s after %d bytes: reading the file failed: %s", pretty, r.RemoteAddr, cw.written, src.err)
+			return
+		}
+		metrics.FileDuration.ObserveSince(start)
+		log.WithBoot(id).Log("HTTP", "Sent %s to %s (%d bytes)", pretty, r.RemoteAddr, cw.written)
+		s.fileServed(id, fileID, cw.written)
+		return
+	}
+	if sf, ok := f.(api.SizedReadCloser); ok {
+		w.Header().Set("Content-Length", strconv.FormatInt(sf.Size(), 10))
+	}
+	var written int64
+	if want == nil {
+		written, err = copyFile(w, reader)
+	} else {
+		// Hold back the last byte until we know the contents are
+		// right, so that the client doesn't think it got the whole
+		// file if we have to cut it off.
+		hw := &holdbackWriter{w: w}
+		written, err = copyFile(hw, reader)
+		if err == nil && src.err == nil {
+			checkDigest(pretty, r, want, hash.Sum(nil))
+			err = hw.flush()
+		}
+		written -= int64(len(hw.held))
+	}
+	if err == errFileTooLarge {
+		s.abortTooLarge(pretty, r, id)
+	}
+	metrics.FileBytes.Add(uint64(written))
+	if (err != nil || src.err != nil) && clientGone(r, pretty, written, id) {
+		return
+	}
+	if src.err != nil {
+		metrics.FileErrors.Inc()
+		log.WithBoot(id).Error("HTTP", "Truncated transfer of %s to %s after %d bytes: reading the file failed: %s", pretty, r.RemoteAddr, written, src.err)
 		return
 	}
-	f, pretty, err := s.booter.File(string(id))
 	if err != nil {
-		log.Log("HTTP", "Couldn't get byte stream for %q from %s: %s", r.URL, r.RemoteAddr, err)
-		http.Error(w, "Couldn't get byte stream", http.StatusInternalServerError)
+		metrics.FileErrors.Inc()
+		log.WithBoot(id).Error("HTTP", "Error serving %s to %s: %s", pretty, r.RemoteAddr, err)
 		return
 	}
-	defer f.Close()
+	metrics.FileDuration.ObserveSince(start)
+	log.WithBoot(id).Log("HTTP", "Sent %s to %s (%d bytes)", pretty, r.RemoteAddr, written)
+	s.fileServed(id, fileID, written)
+}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	written, err := io.Copy(w, f)
+// clientGone returns true, after logging it, if the transfer of
+// pretty to r ended early because the client went away, after sent
+// bytes.
+func clientGone(r *http.Request, pretty string, sent int64, id log.BootID) bool {
+	if r.Context().Err() == nil {
+		return false
+	}
+	log.WithBoot(id).Log("HTTP", "Aborted transfer of %s to %s after %d bytes, the client went away", pretty, r.RemoteAddr, sent)
+	return true
+}
+
+// fileServed calls the OnFileServed hook, if any, for a transfer of
+// n bytes of fileID in boot id.
+func (s *httpServer) fileServed(id log.BootID, fileID string, n int64) {
+	if s.onFileServed != nil {
+		s.onFileServed(id.MAC(), fileID, n)
+	}
+}
+
+// fileError answers a file request that failed with the Booter
+// error err.
+func fileError(w http.ResponseWriter, err error) {
+	switch err {
+	case api.ErrNotFound:
+		http.Error(w, "No such file", http.StatusNotFound)
+		return
+	case api.ErrTemporary:
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "File temporarily unavailable, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	if _, ok := err.(*api.UpstreamError); ok {
+		http.Error(w, "Couldn't get byte stream from upstream", http.StatusBadGateway)
+		return
+	}
+	http.Error(w, "Couldn't get byte stream", http.StatusInternalServerError)
+}
+
+// fileHead answers a HEAD request r for the Booter file fileID with
+// the headers a GET would get, without transferring the file.
+func (s *httpServer) fileHead(w http.ResponseWriter, r *http.Request, fileID string, id log.BootID) {
+	f, pretty, err := s.booter.FileContext(r.Context(), fileID)
 	if err != nil {
-		log.Log("HTTP", "Error serving %s to %s: %s", pretty, r.RemoteAddr, err)
+		log.WithBoot(id).Error("HTTP", "Couldn't get byte stream for %q from %s: %s", r.URL, r.RemoteAddr, err)
+		fileError(w, err)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", s.contentType(pretty))
+	w.Header().Add("Vary", "Accept-Encoding")
+	if name := downloadName(pretty); name != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	}
+	if shouldCompress(r, f, pretty) {
+		// There's no knowing the compressed size without
+		// compressing.
+		w.Header().Set("Content-Encoding", "gzip")
+	} else if size, ok := fileSize(f); ok {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	log.WithBoot(id).Debug("HTTP", "Answered HEAD for %s from %s", pretty, r.RemoteAddr)
+}
+
+// checkDigest aborts the response to r if the file pretty, which
+// should have SHA-256 digest want, actually had digest got.
+func checkDigest(pretty string, r *http.Request, want, got []byte) {
+	if want == nil || bytes.Equal(want, got) {
 		return
 	}
-	log.Log("HTTP", "Sent %s to %s (%d bytes)", pretty, r.RemoteAddr, written)
+	metrics.FileErrors.Inc()
+	log.Error("HTTP", "CORRUPT FILE: %s has SHA-256 %x, expected %x. Aborting its transfer to %s", pretty, got, want, r.RemoteAddr)
+	// Kills the connection, so the client knows it didn't get the
+	// whole file.
+	panic(http.ErrAbortHandler)
 }
 
+// fileSize returns the size of f, if it can tell without reading it.
+func fileSize(f io.ReadCloser) (int64, bool) {
+	if sf, ok := f.(api.SizedReadCloser); ok {
+		return sf.Size(), true
+	}
+	rs, ok := f.(io.Seeker)
+	if !ok {
+		return 0, false
+	}
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, false
+	}
+	if _, err = rs.Seek(0, io.SeekStart); err != nil {
+		return 0, false
+	}
+	return size, true
+}
+
+// errFileTooLarge is returned by a sizeCapReader that went over its
+// limit.
+var errFileTooLarge = errors.New("file is over the maximum file size")
+
+// sizeCapReader passes reads through to r, until reading more than
+// left bytes, at which point it fails with errFileTooLarge.
+type sizeCapReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (c *sizeCapReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > c.left+1 {
+		p = p[:c.left+1]
+	}
+	n, err := c.r.Read(p)
+	if int64(n) > c.left {
+		return int(c.left), errFileTooLarge
+	}
+	c.left -= int64(n)
+	return n, err
+}
+
+// abortTooLarge kills the transfer of pretty to r, which went over
+// the maximum file size.
+func (s *httpServer) abortTooLarge(pretty string, r *http.Request, id log.BootID) {
+	metrics.FileErrors.Inc()
+	log.WithBoot(id).Error("HTTP", "Aborting transfer of %s to %s, it went over the %d byte file size limit", pretty, r.RemoteAddr, s.maxFileSize)
+	// Kills the connection, so the client knows it didn't get the
+	// whole file.
+	panic(http.ErrAbortHandler)
+}
+
+// holdbackWriter passes writes through to w, except for the last
+// byte written so far, which it keeps until flush is called.
+type holdbackWriter struct {
+	w    io.Writer
+	held []byte
+}
+
+func (h *holdbackWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if len(h.held) > 0 {
+		if _, err := h.w.Write(h.held); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := h.w.Write(b[:len(b)-1]); err != nil {
+		return 0, err
+	}
+	h.held = append(h.held[:0], b[len(b)-1])
+	return len(b), nil
+}
+
+func (h *holdbackWriter) flush() error {
+	_, err := h.w.Write(h.held)
+	h.held = nil
+	return err
+}
+
+// downloadName turns a Booter's pretty name for a file, which may be
+// a path or URL, into a bare file name that's safe to put in a
+// Content-Disposition header. It returns "" if there's nothing
+// sensible to use.
+func downloadName(pretty string) string {
+	if u, err := url.Parse(pretty); err == nil && u.Path != "" {
+		pretty = u.Path
+	}
+	name := []byte(path.Base(strings.Replace(pretty, "\\", "/", -1)))
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '-', c == '_':
+		default:
+			name[i] = '_'
+		}
+	}
+	if s := string(name); s != "." && s != "/" && strings.Trim(s, "_.") != "" {
+		return s
+	}
+	return ""
+}
+
+// DefaultContentTypes are the Content-Types of Booter files with
+// text-like extensions, which some clients (e.g. Ignition) want typed
+// correctly. Everything else is application/octet-stream.
+var DefaultContentTypes = map[string]string{
+	".json": "application/json",
+	".ign":  "application/vnd.coreos.ignition+json",
+	".yaml": "application/yaml",
+	".yml":  "application/yaml",
+	".txt":  "text/plain; charset=utf-8",
+	".cfg":  "text/plain; charset=utf-8",
+	".ks":   "text/plain; charset=utf-8",
+	".ipxe": "text/plain; charset=utf-8",
+	".sh":   "text/x-shellscript",
+}
+
+// contentType returns the Content-Type to serve the Booter file with
+// pretty name pretty as.
+func (s *httpServer) contentType(pretty string) string {
+	if typ, ok := s.types[strings.ToLower(path.Ext(downloadName(pretty)))]; ok {
+		return typ
+	}
+	return "application/octet-stream"
+}
+
+// Suffixes of file names whose contents are already compressed, and
+// not worth compressing again.
+var compressedSuffixes = []string{".gz", ".xz", ".bz2", ".lzma", ".zst", ".img", ".iso", ".squashfs"}
+
+// shouldCompress returns true if f, whose pretty name is pretty,
+// should be gzipped on the fly in response to r.
+func shouldCompress(r *http.Request, f io.ReadCloser, pretty string) bool {
+	if !acceptsGzip(r) {
+		return false
+	}
+	if pc, ok := f.(api.Precompressed); ok && pc.Precompressed() {
+		return false
+	}
+	name := strings.ToLower(pretty)
+	if strings.Contains(name, "vmlinuz") {
+		// Linux kernels are self-decompressing archives.
+		return false
+	}
+	for _, suffix := range compressedSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return false
+		}
+	}
+	return true
+}
+
+// acceptsGzip returns true if r's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(enc)
+		if i := strings.IndexByte(enc, ';'); i != -1 {
+			if strings.TrimSpace(enc[i+1:]) == "q=0" {
+				continue
+			}
+			enc = strings.TrimSpace(enc[:i])
+		}
+		if enc == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// countingWriter is an http.ResponseWriter that counts the body bytes
+// written through it.
+type countingWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// signedFileURL returns the relative URL at which File will serve id,
+// signed to be valid until expires.
+func (s *httpServer) signedFileURL(id string, expires time.Time) string {
+	return "f/" + base64.URLEncoding.EncodeToString([]byte(id)) + "/" + base64.URLEncoding.EncodeToString(s.sign(id, expires))
+}
+
+// sign returns a signature for id that expires at the given time. The
+// signature is the expiry time (big-endian unix seconds) followed by
+// an HMAC-SHA256 over the expiry and the file ID.
+func (s *httpServer) sign(id string, expires time.Time) []byte {
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(expires.Unix()))
+	mac := hmac.New(sha256.New, s.key[:])
+	mac.Write(ts[:])
+	mac.Write([]byte(id))
+	return mac.Sum(ts[:])
+}
+
+// checkSignature verifies that encodedSig is a valid, unexpired
+// signature for id.
+func (s *httpServer) checkSignature(id, encodedSig string) error {
+	if encodedSig == "" {
+		return errors.New("URL is not signed")
+	}
+	if len(encodedSig) != base64.URLEncoding.EncodedLen(8+sha256.Size) {
+		return errors.New("signature has the wrong length")
+	}
+	sig, err := base64.URLEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return fmt.Errorf("malformed signature: %s", err)
+	}
+	if len(sig) != 8+sha256.Size {
+		return errors.New("signature has the wrong length")
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint64(sig[:8])), 0)
+	if !hmac.Equal(sig, s.sign(id, expires)) {
+		return errors.New("signature verification failed")
+	}
+	if time.Now().After(expires) {
+		return fmt.Errorf("signature expired at %s", expires)
+	}
+	return nil
+}
+
+// ServeHTTP serves pxelinux and friends on the given port, displaying
+// Limerick while machines boot.
 func ServeHTTP(port int, booter api.Booter, ldlinux []byte) error {
+	return ServeHTTPContext(context.Background(), port, booter, ldlinux)
+}
+
+// ServeHTTPContext is like ServeHTTP, but shuts the server down and
+// returns ctx.Err() when ctx is cancelled. In-flight transfers get a
+// grace period to complete.
+func ServeHTTPContext(ctx context.Context, port int, booter api.Booter, ldlinux []byte) error {
+	s := &Server{
+		Port:        port,
+		Booter:      booter,
+		Ldlinux:     ldlinux,
+		BootMessage: Limerick,
+	}
+	return s.Serve(ctx)
+}
+
+// ServeHTTPS is like ServeHTTP, but speaks HTTPS using the
+// certificate and key in the given PEM files.
+//
+// Boot firmware generally has no way to verify certificates, so a
+// self-signed certificate is as good as any here. Note that pxelinux
+// only speaks plain HTTP, so this is only useful with clients that
+// are chainloaded into something that speaks TLS, like iPXE.
+func ServeHTTPS(port int, booter api.Booter, ldlinux []byte, certFile, keyFile string) error {
+	return ServeHTTPSContext(context.Background(), port, booter, ldlinux, certFile, keyFile)
+}
+
+// ServeHTTPSContext is like ServeHTTPS, but shuts the server down
+// and returns ctx.Err() when ctx is cancelled.
+func ServeHTTPSContext(ctx context.Context, port int, booter api.Booter, ldlinux []byte, certFile, keyFile string) error {
+	s := &Server{
+		Port:        port,
+		Booter:      booter,
+		Ldlinux:     ldlinux,
+		CertFile:    certFile,
+		KeyFile:     keyFile,
+		BootMessage: Limerick,
+	}
+	return s.Serve(ctx)
+}
+
+// state returns the internals shared by Serve and TFTPHandler,
+// setting them up on first use.
+func (srv *Server) state() (*httpServer, error) {
+	srv.initOnce.Do(func() {
+		srv.internal, srv.initErr = srv.newHTTPServer()
+	})
+	return srv.internal, srv.initErr
+}
+
+func (srv *Server) newHTTPServer() (*httpServer, error) {
 	s := &httpServer{
-		booter:  booter,
-		ldlinux: ldlinux,
+		booter:      api.WithContext(srv.Booter),
+		profiles:    api.WithProfiles(srv.Booter),
+		ldlinux:     srv.Ldlinux,
+		bootMessage: srv.BootMessage,
+		dryRun:      srv.DryRun,
+		fileRetries: srv.FileRetries,
+		maxFileSize: srv.MaxFileSize,
+		urlFunc:     srv.FileURL,
+		pathPrefix:  "/",
+		macFilter:   srv.MACFilter,
+		static:      srv.Static,
+		leases:      srv.Leases,
+		sites:       srv.Sites,
+		types:       map[string]string{},
+		mux:         http.NewServeMux(),
+
+		onboarding:     srv.OnboardingConfig,
+		retryDelay:     timeout(srv.RetryDelay, DefaultRetryDelay),
+		retryJitter:    timeout(srv.RetryJitter, DefaultRetryJitter),
+		ipxeOnboarding: srv.OnboardingScript,
+		onConfigServed: srv.OnConfigServed,
+		onFileServed:   srv.OnFileServed,
+	}
+	if p := strings.Trim(srv.PathPrefix, "/"); p != "" {
+		s.pathPrefix = "/" + p + "/"
+	}
+	for _, types := range []map[string]string{DefaultContentTypes, srv.ContentTypes} {
+		for ext, typ := range types {
+			s.types[strings.ToLower(ext)] = typ
+		}
+	}
+	switch srv.Fallback {
+	case FallbackDisk:
+		s.fallback, s.ipxeFallback = bootFromDisk, ipxeBootFromDisk
+	case FallbackReboot:
+		s.fallback, s.ipxeFallback = rebootConfig, ipxeReboot
+	case FallbackCustom:
+		if srv.FallbackConfig == "" {
+			return nil, errors.New("custom fallback policy without a fallback config")
+		}
+		s.fallback, s.ipxeFallback = srv.FallbackConfig, ipxeReboot
+	default:
+		return nil, fmt.Errorf("unknown fallback policy %d", srv.Fallback)
+	}
+	s.enumerator = api.AsEnumerator(srv.Booter)
+	s.transfers = newTransferLimiter(srv.MaxTransfers, srv.TransferQueueTimeout)
+	if hasher := api.AsContentHasher(srv.Booter); hasher != nil && srv.ContentAddressed {
+		s.content = &contentURLs{hasher: hasher, ids: map[string]string{}}
+	}
+	if srv.SigningKeyFile != "" {
+		key, err := loadSigningKey(srv.SigningKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		s.key = key
+	} else if _, err := io.ReadFull(rand.Reader, s.key[:]); err != nil {
+		return nil, fmt.Errorf("cannot initialize ephemeral signing key: %s", err)
+	}
+
+	// Boot files and configs all get compressed the same way. File
+	// does its own compression, since it has to know which files
+	// are worth it and keep the gzip trailer back until the contents
+	// are verified.
+	s.mux.HandleFunc("/ldlinux.c32", gzipped(s.Ldlinux))
+	for name, blob := range srv.Modules {
+		if name == "ldlinux" {
+			continue
+		}
+		path := name + ".c32"
+		s.mux.HandleFunc("/"+path, gzipped(serveBlob(path, blob)))
+	}
+	s.mux.HandleFunc("/", s.NotFound)
+	// UEFI HTTP Boot clients may get their kernel in place of their
+	// loader, so that path is served even without a loader.
+	httpBootPath := pxe.LoaderPath(pxe.ArchEFIx64HTTP)
+	httpBootLoader := http.HandlerFunc(s.NotFound)
+	for path, blob := range srv.loaders() {
+		if path == httpBootPath {
+			httpBootLoader = gzipped(serveBlob(path, blob))
+			continue
+		}
+		s.mux.HandleFunc("/"+path, gzipped(serveBlob(path, blob)))
+	}
+	s.mux.HandleFunc("/"+httpBootPath, s.httpBootLoader(httpBootLoader))
+	if len(srv.EFILdlinux) > 0 {
+		s.mux.HandleFunc("/ldlinux.e64", gzipped(serveBlob("ldlinux.e64", srv.EFILdlinux)))
+	}
+	s.mux.HandleFunc("/pxelinux.cfg/", gzipped(s.PxelinuxConfig))
+	s.mux.HandleFunc("/ipxe", gzipped(s.IPXEScript))
+	s.mux.HandleFunc("/f/", s.File)
+	s.mux.HandleFunc("/static/", gzipped(s.Static))
+	s.mux.HandleFunc("/arch/", s.Arch)
+	s.mux.HandleFunc("/id/", s.BootID)
+	s.mux.HandleFunc("/profile/", s.Profile)
+	s.mux.Handle("/metrics", metrics.Handler())
+	s.mux.HandleFunc("/healthz", s.Healthz)
+	s.mux.HandleFunc("/readyz", s.Readyz)
+	s.mux.HandleFunc("/boot/progress/", s.Progress)
+	s.mux.HandleFunc("/events", s.Events)
+	s.mux.HandleFunc("/api/specs", s.Specs)
+	s.mux.HandleFunc("/api/wouldboot/", s.WouldBoot)
+	s.mux.HandleFunc("/api/leases", s.Leases)
+	s.mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, http.StatusNotFound, "No such API endpoint")
+	})
+	if srv.Pprof {
+		s.mux.HandleFunc("/debug/pprof/", pprof.Index)
+		s.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		s.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		s.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		s.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return s, nil
+}
+
+// Serve runs the server until ctx is cancelled, at which point it
+// shuts down and returns ctx.Err(). In-flight transfers get a grace
+// period to complete.
+func (srv *Server) Serve(ctx context.Context) error {
+	certFile, keyFile := srv.CertFile, srv.KeyFile
+	s, err := srv.state()
+	if err != nil {
+		return err
+	}
+	if _, err = srv.Listen(); err != nil {
+		return err
 	}
-	if _, err := io.ReadFull(rand.Reader, s.key[:]); err != nil {
-		return fmt.Errorf("cannot initialize ephemeral signing key: %s", err)
+	l := srv.listener
+
+	// Bootloaders get pointed at the prefix, and config files only
+	// contain URLs relative to it, so stripping it here is all it
+	// takes to serve from somewhere other than the root.
+	var handler http.Handler = s.mux
+	if prefix := strings.Trim(srv.PathPrefix, "/"); prefix != "" {
+		handler = http.StripPrefix("/"+prefix, s.mux)
+		log.Log("HTTP", "Serving under /%s/", prefix)
 	}
 
-	http.HandleFunc("/ldlinux.c32", s.Ldlinux)
-	http.HandleFunc("/pxelinux.cfg/", s.PxelinuxConfig)
-	http.HandleFunc("/f/", s.File)
+	if srv.AccessLog != nil {
+		handler = accessLog(handler, srv.AccessLog)
+	}
 
-	log.Log("HTTP", "Listening on port %d", port)
-	return http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	hs := &http.Server{
+		Addr:              l.Addr().String(),
+		Handler:           handler,
+		ReadHeaderTimeout: timeout(srv.ReadHeaderTimeout, DefaultReadHeaderTimeout),
+		IdleTimeout:       timeout(srv.IdleTimeout, DefaultIdleTimeout),
+		WriteTimeout:      timeout(srv.WriteTimeout, DefaultWriteTimeout),
+	}
+	errs := make(chan error, 1)
+	go func() {
+		if certFile != "" {
+			log.Log("HTTP", "Listening for HTTPS on %s", hs.Addr)
+			errs <- hs.ServeTLS(l, certFile, keyFile)
+			return
+		}
+		log.Log("HTTP", "Listening on %s", hs.Addr)
+		errs <- hs.Serve(l)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		log.Log("HTTP", "Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := hs.Shutdown(shutdownCtx); err != nil {
+			hs.Close()
+		}
+		return ctx.Err()
+	}
+}
+
+// Listen opens the server's socket, and returns the address it's
+// bound to. Calling it before Serve lets callers find out which port
+// the OS picked when Port is 0, e.g. to tell PXE clients. Serve calls
+// it if nobody has yet. Calling it again returns the same address.
+func (srv *Server) Listen() (net.Addr, error) {
+	srv.listenMu.Lock()
+	defer srv.listenMu.Unlock()
+	if srv.listener == nil {
+		l, err := net.Listen("tcp", dhcp.ListenAddr(srv.BindAddr, srv.Port))
+		if err != nil {
+			return nil, err
+		}
+		srv.listener = l
+	}
+	return srv.listener.Addr(), nil
+}
+
+// port returns the port the server is listening on, or will listen
+// on if Listen hasn't been called yet.
+func (srv *Server) port() int {
+	srv.listenMu.Lock()
+	defer srv.listenMu.Unlock()
+	if srv.listener != nil {
+		if addr, ok := srv.listener.Addr().(*net.TCPAddr); ok {
+			return addr.Port
+		}
+	}
+	return srv.Port
+}
+
+// timeout returns the timeout to use for a Server timeout setting of
+// d: def if d is zero, and no timeout if it's negative.
+func timeout(d, def time.Duration) time.Duration {
+	switch {
+	case d == 0:
+		return def
+	case d < 0:
+		return 0
+	default:
+		return d
+	}
 }
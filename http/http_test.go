@@ -0,0 +1,390 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danderson/pixiecore/api"
+	"github.com/danderson/pixiecore/cachingbooter"
+	"github.com/danderson/pixiecore/defaultargsbooter"
+	"github.com/danderson/pixiecore/failbooter"
+	"github.com/danderson/pixiecore/log"
+	"github.com/danderson/pixiecore/loggingbooter"
+	"github.com/danderson/pixiecore/metrics"
+	"github.com/danderson/pixiecore/multibooter"
+	"github.com/danderson/pixiecore/oneshotbooter"
+	"github.com/danderson/pixiecore/pxe"
+)
+
+func TestMain(m *testing.M) {
+	stdlog.SetOutput(ioutil.Discard)
+	go log.RecordLogs(false)
+	os.Exit(m.Run())
+}
+
+// testServer returns the internals of a Server that boots with b.
+func testServer(t testing.TB, b *api.FakeBooter) *httpServer {
+	srv := &Server{
+		Booter:  b,
+		Ldlinux: []byte("ldlinux contents"),
+		Loaders: map[uint16][]byte{7: []byte("efi loader contents")},
+	}
+	s, err := srv.state()
+	if err != nil {
+		t.Fatalf("creating server: %s", err)
+	}
+	return s
+}
+
+func TestHeadWritesNoBody(t *testing.T) {
+	kernel := []byte("kernel contents")
+	s := testServer(t, &api.FakeBooter{Files: map[string][]byte{"kernel": kernel}})
+
+	tests := []struct {
+		path   string
+		length int
+		gzip   bool
+	}{
+		{"/" + s.signedFileURL("kernel", time.Now().Add(time.Minute)), len(kernel), false},
+		{"/ldlinux.c32", len("ldlinux contents"), false},
+		{"/ldlinux.c32", -1, true},
+		{"/syslinux.efi", len("efi loader contents"), false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("HEAD", test.path, nil)
+		if test.gzip {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		rec := httptest.NewRecorder()
+		s.mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("HEAD %s (gzip %v): status %d, want 200", test.path, test.gzip, rec.Code)
+			continue
+		}
+		if rec.Body.Len() != 0 {
+			t.Errorf("HEAD %s (gzip %v): wrote %d byte body, want none", test.path, test.gzip, rec.Body.Len())
+		}
+		if test.length >= 0 {
+			if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(test.length) {
+				t.Errorf("HEAD %s: Content-Length %q, want %d", test.path, got, test.length)
+			}
+		}
+	}
+}
+
+// appendLine returns the APPEND line of the pxelinux config that s
+// gives to mac.
+func appendLine(t *testing.T, s *httpServer, mac net.HardwareAddr) string {
+	cfg, _ := s.pxelinuxConfig(context.Background(), mac, 0, "", "http://pixiecore/", "192.168.0.10:1234")
+	for _, l := range strings.Split(cfg, "\n") {
+		if strings.HasPrefix(l, "APPEND") {
+			return l
+		}
+	}
+	t.Fatalf("no APPEND line in config for %s:\n%s", mac, cfg)
+	return ""
+}
+
+func TestPxelinuxConfigInitrds(t *testing.T) {
+	tests := []struct {
+		initrd  []string
+		cmdline string
+		// Number of initrd URLs expected, or 0 for no initrd=.
+		want int
+	}{
+		{nil, "", 0},
+		{nil, "console=ttyS0", 0},
+		{[]string{"a"}, "", 1},
+		{[]string{"a"}, "console=ttyS0", 1},
+		{[]string{"a", "b", "c"}, "console=ttyS0", 3},
+		{[]string{"a", "b", "a", "c", "b"}, "console=ttyS0", 3},
+	}
+	for _, test := range tests {
+		mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+		s := testServer(t, &api.FakeBooter{Specs: map[string]*api.BootSpec{
+			mac.String(): {Kernel: "kernel", Initrd: test.initrd, Cmdline: test.cmdline},
+		}})
+		line := appendLine(t, s, mac)
+
+		fields := strings.Fields(line)
+		var initrds []string
+		for _, f := range fields[1:] {
+			if strings.HasPrefix(f, "initrd=") {
+				if initrds != nil {
+					t.Errorf("%q: more than one initrd= in %q", test.initrd, line)
+				}
+				initrds = strings.Split(strings.TrimPrefix(f, "initrd="), ",")
+			}
+		}
+		if test.want == 0 && strings.Contains(line, "initrd=") {
+			t.Errorf("%q: got %q, want no initrd=", test.initrd, line)
+		}
+		if len(initrds) != test.want {
+			t.Errorf("%q: got %d initrds in %q, want %d", test.initrd, len(initrds), line, test.want)
+		}
+		seen := map[string]bool{}
+		for _, u := range initrds {
+			if u == "" || seen[u] {
+				t.Errorf("%q: empty or repeated initrd URL in %q", test.initrd, line)
+			}
+			seen[u] = true
+		}
+		if test.cmdline != "" && !strings.HasSuffix(line, " "+test.cmdline) {
+			t.Errorf("%q: got %q, want it to end with the cmdline %q", test.initrd, line, test.cmdline)
+		}
+		if test.cmdline == "" && test.want == 0 && line != "APPEND" {
+			t.Errorf("%q: got %q, want a bare APPEND", test.initrd, line)
+		}
+	}
+}
+
+func TestDedup(t *testing.T) {
+	tests := []struct{ in, want []string }{
+		{nil, nil},
+		{[]string{"a"}, []string{"a"}},
+		{[]string{"a", "b", "a", "c", "b"}, []string{"a", "b", "c"}},
+	}
+	for _, test := range tests {
+		if got := dedup(append([]string(nil), test.in...)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("dedup(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestWouldBootHasNoSideEffects(t *testing.T) {
+	mac := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	fake := &api.FakeBooter{Specs: map[string]*api.BootSpec{
+		mac.String(): {Kernel: "kernel"},
+	}}
+	tests := []struct {
+		name     string
+		booter   api.Booter
+		wantSpec bool
+	}{
+		{"peeker", oneshotbooter.New(fake), true},
+		// Hides FakeBooter's PeekBootSpec.
+		{"not peeker", struct{ api.Booter }{fake}, false},
+	}
+	for _, test := range tests {
+		s, err := (&Server{Booter: test.booter}).state()
+		if err != nil {
+			t.Fatalf("%s: creating server: %s", test.name, err)
+		}
+		// Twice, so that a oneshot boot would be used up.
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			s.WouldBoot(w, httptest.NewRequest("GET", "/api/wouldboot/"+mac.String(), nil))
+			var got wouldBoot
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("%s: decoding answer: %s", test.name, err)
+			}
+			if got.Decision != "netboot" {
+				t.Errorf("%s: decision is %q (%s), want netboot", test.name, got.Decision, got.Reason)
+			}
+			if gotSpec := got.Spec != nil; gotSpec != test.wantSpec {
+				t.Errorf("%s: got spec %v, want %v", test.name, gotSpec, test.wantSpec)
+			}
+		}
+	}
+	if n := fake.BootSpecCalls(); n != 0 {
+		t.Errorf("WouldBoot called BootSpec %d times, want 0", n)
+	}
+}
+
+func TestHTTPBootDirect(t *testing.T) {
+	direct := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	loader := net.HardwareAddr{1, 2, 3, 4, 5, 7}
+	s := testServer(t, &api.FakeBooter{
+		Specs: map[string]*api.BootSpec{
+			direct.String(): {Kernel: "kernel", EFIDirect: true},
+			loader.String(): {Kernel: "kernel"},
+		},
+		Files: map[string][]byte{"kernel": []byte("kernel contents")},
+	})
+
+	tests := []struct {
+		mac  net.HardwareAddr
+		arch uint16
+		want string
+	}{
+		{direct, pxe.ArchEFIx64HTTP, "kernel contents"},
+		{loader, pxe.ArchEFIx64HTTP, "efi loader contents"},
+		// Only HTTP Boot clients skip the loader.
+		{direct, pxe.ArchEFIx64, "efi loader contents"},
+	}
+	for _, test := range tests {
+		path := fmt.Sprintf("/id/%s/arch/%d/syslinux.efi", log.NewBootID(test.mac), test.arch)
+		w := httptest.NewRecorder()
+		s.mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != test.want {
+			t.Errorf("GET %s: got %d %q, want %q", path, w.Code, w.Body.String(), test.want)
+		}
+	}
+}
+
+// failingFile is a stream that always fails.
+type failingFile struct{}
+
+func (failingFile) Read([]byte) (int, error) { return 0, errors.New("broken") }
+func (failingFile) Close() error             { return nil }
+
+func TestRetryStopsWithRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	reopened := 0
+	r := &retryReader{
+		ctx: ctx,
+		f:   failingFile{},
+		reopen: func() (io.ReadCloser, error) {
+			reopened++
+			return failingFile{}, nil
+		},
+		pretty:  "kernel",
+		retries: 3,
+	}
+	start := time.Now()
+	if _, err := r.Read(make([]byte, 10)); err == nil {
+		t.Fatal("Read of a broken stream succeeded")
+	}
+	if d := time.Since(start); d >= retryBackoff {
+		t.Errorf("Read took %s after the request was done, want under %s", d, retryBackoff)
+	}
+	if reopened != 0 {
+		t.Errorf("reopened the stream %d times after the request was done, want 0", reopened)
+	}
+}
+
+// ctxBooter is an api.ContextBooter that waits for its context to be
+// cancelled, and records that it was.
+type ctxBooter struct {
+	api.Booter
+	cancelled chan string
+}
+
+func (b ctxBooter) BootSpecContext(ctx context.Context, hw net.HardwareAddr) (*api.BootSpec, error) {
+	<-ctx.Done()
+	b.cancelled <- "BootSpecContext"
+	return nil, ctx.Err()
+}
+
+func (b ctxBooter) FileContext(ctx context.Context, id string) (io.ReadCloser, string, error) {
+	<-ctx.Done()
+	b.cancelled <- "FileContext"
+	return nil, "", ctx.Err()
+}
+
+func TestWrappersPassContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pixiecore-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wrappers := map[string]func(api.Booter) api.Booter{
+		"logging":     func(b api.Booter) api.Booter { return loggingbooter.New(b, nil) },
+		"oneshot":     func(b api.Booter) api.Booter { return oneshotbooter.New(b) },
+		"fail":        func(b api.Booter) api.Booter { return failbooter.New(b, 3) },
+		"defaultargs": func(b api.Booter) api.Booter { return defaultargsbooter.New(b, "quiet", false) },
+		"multi":       func(b api.Booter) api.Booter { return multibooter.New(b) },
+		"caching": func(b api.Booter) api.Booter {
+			c, err := cachingbooter.New(b, dir, 1<<20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return c
+		},
+	}
+	mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	for name, wrap := range wrappers {
+		inner := ctxBooter{&api.FakeBooter{}, make(chan string, 2)}
+		b := api.WithContext(wrap(inner))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := b.BootSpecContext(ctx, mac); err != context.Canceled {
+			t.Errorf("%s: BootSpecContext returned %v, want %v", name, err, context.Canceled)
+		}
+		if _, _, err := b.FileContext(ctx, "kernel"); err != context.Canceled {
+			t.Errorf("%s: FileContext returned %v, want %v", name, err, context.Canceled)
+		}
+		close(inner.cancelled)
+		var got []string
+		for call := range inner.cancelled {
+			got = append(got, call)
+		}
+		if len(got) != 2 {
+			t.Errorf("%s: cancellation reached %q, want both BootSpecContext and FileContext", name, got)
+		}
+	}
+}
+
+func TestTFTPHandlerAdvertiseIP(t *testing.T) {
+	mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+	srv := &Server{
+		Port:        8080,
+		AdvertiseIP: net.IPv4(203, 0, 113, 7),
+		Booter: &api.FakeBooter{
+			Specs: map[string]*api.BootSpec{mac.String(): {Kernel: "kernel"}},
+		},
+		Ldlinux: []byte("ldlinux contents"),
+	}
+	fallback := func(string, net.Addr) (io.ReadCloser, error) { return nil, errors.New("fallback") }
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	f, err := srv.TFTPHandler(fallback)("pxelinux.cfg/01-00-11-22-33-44-55", client)
+	if err != nil {
+		t.Fatalf("TFTPHandler: %s", err)
+	}
+	defer f.Close()
+	cfg, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(cfg), "http://203.0.113.7:8080/") {
+		t.Errorf("pxelinux config doesn't point at the advertised IP:\n%s", cfg)
+	}
+	if strings.Contains(string(cfg), "127.0.0.1") {
+		t.Errorf("pxelinux config points at the local address:\n%s", cfg)
+	}
+}
+
+func TestIPXEScriptCountsSite(t *testing.T) {
+	mac := net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x66}
+	sites, err := pxe.ParseSiteMap(strings.NewReader("192.0.2.0/24 ipxe-lab\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		Booter: &api.FakeBooter{
+			Specs: map[string]*api.BootSpec{mac.String(): {Kernel: "kernel"}},
+		},
+		Ldlinux: []byte("ldlinux contents"),
+		Sites:   sites,
+	}
+	s, err := srv.state()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/ipxe?arch=0&mac="+mac.String(), nil)
+	req.RemoteAddr = "192.0.2.10:1234"
+	s.mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `pixiecore_site_boot_specs_total{site="ipxe-lab",result="netboot"} 1`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("metrics don't include %s:\n%s", want, rec.Body)
+	}
+}
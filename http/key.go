@@ -0,0 +1,47 @@
+package http
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/danderson/pixiecore/log"
+)
+
+// loadSigningKey reads the URL signing key from path. If path doesn't
+// exist, it generates a new random key and saves it there, readable
+// only by us.
+func loadSigningKey(path string) (key [32]byte, err error) {
+	bs, err := ioutil.ReadFile(path)
+	if err == nil {
+		if len(bs) != len(key) {
+			return key, fmt.Errorf("signing key file %q is %d bytes, want %d", path, len(bs), len(key))
+		}
+		copy(key[:], bs)
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return key, fmt.Errorf("reading signing key: %s", err)
+	}
+
+	if _, err = io.ReadFull(rand.Reader, key[:]); err != nil {
+		return key, fmt.Errorf("cannot generate signing key: %s", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return key, fmt.Errorf("creating signing key file: %s", err)
+	}
+	if _, err = f.Write(key[:]); err != nil {
+		f.Close()
+		os.Remove(path)
+		return key, fmt.Errorf("writing signing key file: %s", err)
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(path)
+		return key, fmt.Errorf("writing signing key file: %s", err)
+	}
+	log.Log("HTTP", "Generated new URL signing key in %s", path)
+	return key, nil
+}
@@ -0,0 +1,41 @@
+package http
+
+import (
+	"net/http"
+	"time"
+)
+
+// jsonLease is the JSON form of a dhcp.Lease.
+type jsonLease struct {
+	MAC     string    `json:"mac"`
+	IP      string    `json:"ip"`
+	Expires time.Time `json:"expires"`
+	// True if the address is only reserved for the client, waiting
+	// for it to accept the offer.
+	Offered bool `json:"offered,omitempty"`
+}
+
+// Leases serves /api/leases, which lists the addresses the full DHCP
+// server has leased or offered, for debugging.
+func (s *httpServer) Leases(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeProblem(w, http.StatusMethodNotAllowed, "Only GET and HEAD are supported")
+		return
+	}
+	if s.leases == nil {
+		writeProblem(w, http.StatusNotImplemented, "Not running a DHCP server")
+		return
+	}
+
+	ret := []jsonLease{}
+	for _, l := range s.leases() {
+		ret = append(ret, jsonLease{
+			MAC:     l.MAC.String(),
+			IP:      l.IP.String(),
+			Expires: l.Expires,
+			Offered: l.Offered,
+		})
+	}
+	writeJSON(w, ret)
+}
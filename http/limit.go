@@ -0,0 +1,69 @@
+package http
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultTransferQueueTimeout is how long a file request waits for a
+// transfer slot if Server.TransferQueueTimeout is unset.
+const DefaultTransferQueueTimeout = 30 * time.Second
+
+// transferLimiter caps the number of concurrent file transfers.
+// Requests beyond the cap queue up for a while before giving up.
+type transferLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+	waiting int32
+}
+
+// newTransferLimiter returns a limiter allowing max concurrent
+// transfers, or nil (which allows everything) if max <= 0.
+func newTransferLimiter(max int, timeout time.Duration) *transferLimiter {
+	if max <= 0 {
+		return nil
+	}
+	if timeout <= 0 {
+		timeout = DefaultTransferQueueTimeout
+	}
+	return &transferLimiter{
+		slots:   make(chan struct{}, max),
+		timeout: timeout,
+	}
+}
+
+// acquire waits for a transfer slot, and returns false if none frees
+// up in time, or ctx is cancelled first. queued is the number of
+// requests that were waiting, including this one, when it started
+// waiting, or 0 if it got a slot straight away.
+func (l *transferLimiter) acquire(ctx context.Context) (ok bool, queued int) {
+	if l == nil {
+		return true, 0
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true, 0
+	default:
+	}
+
+	queued = int(atomic.AddInt32(&l.waiting, 1))
+	defer atomic.AddInt32(&l.waiting, -1)
+	t := time.NewTimer(l.timeout)
+	defer t.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true, queued
+	case <-t.C:
+		return false, queued
+	case <-ctx.Done():
+		return false, queued
+	}
+}
+
+func (l *transferLimiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
@@ -0,0 +1,37 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+)
+
+// elfMagic starts every ELF binary. Syslinux modules, including
+// ldlinux.c32 and ldlinux.e64, are ELF since syslinux 5.
+var elfMagic = []byte("\x7fELF")
+
+// LoadLdlinux reads ldlinux.c32 (or another syslinux module) from
+// path, for use as Server.Ldlinux. The file may be gzipped, in which
+// case it's decompressed. It's an error for the result not to look
+// like a syslinux module, so that a bad file gets noticed at startup
+// rather than by every machine that tries to boot.
+func LoadLdlinux(path string) ([]byte, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(bs) >= 2 && bs[0] == 0x1f && bs[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(bs))
+		if err != nil {
+			return nil, fmt.Errorf("decompressing %s: %s", path, err)
+		}
+		if bs, err = ioutil.ReadAll(gz); err != nil {
+			return nil, fmt.Errorf("decompressing %s: %s", path, err)
+		}
+	}
+	if !bytes.HasPrefix(bs, elfMagic) {
+		return nil, fmt.Errorf("%s is not a syslinux module (not an ELF binary)", path)
+	}
+	return bs, nil
+}
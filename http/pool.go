@@ -0,0 +1,44 @@
+package http
+
+import (
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+// Fleets booting at once mean lots of concurrent transfers, many of
+// them small, so the per-transfer buffers are recycled rather than
+// left to the garbage collector. A gzip.Writer in particular is
+// several hundred KiB of state.
+var (
+	copyBufs = sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, 32*1024)
+			return &b
+		},
+	}
+	gzipWriters sync.Pool
+)
+
+// copyFile is io.Copy with a pooled buffer.
+func copyFile(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBufs.Get().(*[]byte)
+	defer copyBufs.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// getGzip returns a gzip.Writer writing to w, which should be given
+// back with putGzip when done.
+func getGzip(w io.Writer) *gzip.Writer {
+	if gz, ok := gzipWriters.Get().(*gzip.Writer); ok {
+		gz.Reset(w)
+		return gz
+	}
+	return gzip.NewWriter(w)
+}
+
+func putGzip(gz *gzip.Writer) {
+	// Don't keep the last destination alive.
+	gz.Reset(nil)
+	gzipWriters.Put(gz)
+}
@@ -0,0 +1,104 @@
+package http
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danderson/pixiecore/api"
+	"github.com/danderson/pixiecore/log"
+)
+
+const (
+	// How long a machine's reported boot progress is remembered.
+	progressTTL = time.Hour
+	// Longest status string a machine can report.
+	maxStatusLen = 256
+)
+
+// progressStore remembers the last boot progress reported by each
+// machine.
+type progressStore struct {
+	mu      sync.Mutex
+	entries map[string]progressEntry
+}
+
+type progressEntry struct {
+	status  string
+	updated time.Time
+}
+
+func (p *progressStore) set(hw net.HardwareAddr, status string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.entries == nil {
+		p.entries = map[string]progressEntry{}
+	}
+	now := time.Now()
+	for mac, e := range p.entries {
+		if now.Sub(e.updated) > progressTTL {
+			delete(p.entries, mac)
+		}
+	}
+	p.entries[hw.String()] = progressEntry{status, now}
+}
+
+func (p *progressStore) get(hw net.HardwareAddr) (progressEntry, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.entries[hw.String()]
+	if !ok || time.Since(e.updated) > progressTTL {
+		return progressEntry{}, false
+	}
+	return e, true
+}
+
+// Progress serves /boot/progress/<mac>/<signature>. Machines POST
+// their boot progress here in the "status" form value, which gets
+// passed on to the Booter if it's an api.ProgressRecorder. The URL,
+// signature included, is handed to each boot as {{.ProgressURL}} in
+// its cmdline, so that nothing else on the network can report
+// progress (e.g. failures) on a machine's behalf. A GET of
+// /boot/progress/<mac> returns the last reported status.
+func (s *httpServer) Progress(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	rest, sig := strings.TrimPrefix(r.URL.Path, "/boot/progress/"), ""
+	if i := strings.IndexByte(rest, '/'); i != -1 {
+		rest, sig = rest[:i], rest[i+1:]
+	}
+	mac, err := net.ParseMAC(rest)
+	if err != nil {
+		http.Error(w, "Malformed MAC address in request", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		e, ok := s.progress.get(mac)
+		if !ok {
+			http.Error(w, "No progress reported", http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "%s %s\n", e.updated.Format(time.RFC3339), e.status)
+	case "POST":
+		if err = s.checkSignature(progressSigningID(mac), sig); err != nil {
+			log.Log("HTTP", "Rejected progress report for %s from %s: %s", mac, r.RemoteAddr, err)
+			http.Error(w, "Invalid progress URL signature", http.StatusForbidden)
+			return
+		}
+		status := r.FormValue("status")
+		if status == "" || len(status) > maxStatusLen {
+			http.Error(w, "Missing or oversized status", http.StatusBadRequest)
+			return
+		}
+		s.progress.set(mac, status)
+		api.RecordProgress(s.booter, mac, status)
+		log.Log("HTTP", "%s (%s) reported boot progress %q", mac, r.RemoteAddr, status)
+		w.Write([]byte("ok\n"))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,160 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/danderson/pixiecore/log"
+)
+
+// retryBackoff is how long retryReader waits before its first attempt
+// to resume a failed stream. It doubles with every further attempt.
+const retryBackoff = 500 * time.Millisecond
+
+// retryReader reads from a Booter file stream, and if the stream fails
+// partway through, reopens it and resumes from where it left off, up
+// to a fixed number of times.
+type retryReader struct {
+	// The request the stream is for. Retries stop once it's done.
+	ctx     context.Context
+	f       io.ReadCloser
+	reopen  func() (io.ReadCloser, error)
+	pretty  string
+	offset  int64
+	retries int
+	// The read error that ended the transfer early, if any.
+	err error
+	// A read error that came with data, to deal with on the next
+	// Read.
+	pending error
+
+	// Guards f against abort, which is called from another
+	// goroutine.
+	mu      sync.Mutex
+	aborted bool
+}
+
+// errAborted is the error resuming an aborted retryReader gets.
+var errAborted = errors.New("transfer aborted")
+
+func (r *retryReader) Read(b []byte) (int, error) {
+	backoff := retryBackoff
+	for {
+		n, err := 0, r.pending
+		r.pending = nil
+		if err == nil {
+			n, err = r.f.Read(b)
+			r.offset += int64(n)
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			// Hand back what we got first. Retrying can wait for
+			// the next Read, since the stream can't be trusted to
+			// return the error again.
+			r.pending = err
+			return n, nil
+		}
+		if r.retries <= 0 || r.isAborted() {
+			r.err = err
+			return 0, err
+		}
+		r.retries--
+		log.Log("HTTP", "Reading %s failed at offset %d (%s), retrying in %s", r.pretty, r.offset, err, backoff)
+		if !r.wait(backoff) {
+			r.err = err
+			return 0, err
+		}
+		backoff *= 2
+		if rerr := r.resume(); rerr != nil {
+			log.Error("HTTP", "Couldn't resume %s at offset %d: %s", r.pretty, r.offset, rerr)
+			r.err = err
+			return 0, err
+		}
+	}
+}
+
+// wait waits for d, and returns false if the request is done first.
+func (r *retryReader) wait(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
+
+// resume replaces the failed stream with a fresh one, positioned at
+// the current offset.
+func (r *retryReader) resume() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.aborted {
+		return errAborted
+	}
+	r.f.Close()
+	f, err := r.reopen()
+	if err != nil {
+		r.f = errReadCloser{err}
+		return err
+	}
+	r.f = f
+	if s, ok := f.(io.Seeker); ok {
+		_, err = s.Seek(r.offset, io.SeekStart)
+		return err
+	}
+	_, err = io.CopyN(ioutil.Discard, f, r.offset)
+	return err
+}
+
+// Seek seeks the stream, so that http.ServeContent can serve Range
+// requests for seekable files and still get retries. It fails if the
+// stream isn't an io.Seeker.
+func (r *retryReader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	s, ok := r.f.(io.Seeker)
+	r.mu.Unlock()
+	if !ok {
+		return 0, errors.New("stream is not seekable")
+	}
+	n, err := s.Seek(offset, whence)
+	if err != nil {
+		return n, err
+	}
+	r.offset, r.pending = n, nil
+	return n, nil
+}
+
+func (r *retryReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// abort closes the stream from another goroutine, to unblock a Read
+// that's waiting on it, and stops further retries.
+func (r *retryReader) abort() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.aborted = true
+	r.f.Close()
+}
+
+func (r *retryReader) isAborted() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.aborted
+}
+
+// errReadCloser stands in for a stream that couldn't be reopened.
+type errReadCloser struct{ err error }
+
+func (e errReadCloser) Read([]byte) (int, error) { return 0, e.err }
+func (e errReadCloser) Close() error             { return nil }
@@ -0,0 +1,61 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/danderson/pixiecore/api"
+	"github.com/danderson/pixiecore/log"
+)
+
+// jsonSpec is the JSON form of a BootSpec, matching the API server
+// response format in README.api.md.
+type jsonSpec struct {
+	Kernel  string              `json:"kernel"`
+	Initrd  []string            `json:"initrd"`
+	Cmdline string              `json:"cmdline,omitempty"`
+	ByArch  map[uint16]jsonSpec `json:"by_arch,omitempty"`
+
+	EFIDirect bool `json:"efi_direct,omitempty"`
+}
+
+// Specs serves /api/specs, which lists everything the Booter would
+// boot, if it's an api.Enumerator.
+func (s *httpServer) Specs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeProblem(w, http.StatusMethodNotAllowed, "Only GET and HEAD are supported")
+		return
+	}
+	if s.enumerator == nil {
+		writeProblem(w, http.StatusNotImplemented, "Booter can't list what it boots")
+		return
+	}
+	specs, err := s.enumerator.ListSpecs()
+	if err == api.ErrNotEnumerable {
+		writeProblem(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	if err != nil {
+		log.Log("HTTP", "Listing boot specs for %s: %s", r.RemoteAddr, err)
+		writeProblem(w, http.StatusInternalServerError, "Couldn't list boot specs")
+		return
+	}
+
+	ret := map[string]jsonSpec{}
+	for mac, spec := range specs {
+		js := jsonSpec{
+			Kernel:    spec.Kernel,
+			Initrd:    spec.Initrd,
+			Cmdline:   spec.Cmdline,
+			EFIDirect: spec.EFIDirect,
+		}
+		for arch, as := range spec.ByArch {
+			if js.ByArch == nil {
+				js.ByArch = map[uint16]jsonSpec{}
+			}
+			js.ByArch[arch] = jsonSpec{Kernel: as.Kernel, Initrd: as.Initrd, Cmdline: as.Cmdline}
+		}
+		ret[mac] = js
+	}
+	writeJSON(w, ret)
+}
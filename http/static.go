@@ -0,0 +1,27 @@
+package http
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/danderson/pixiecore/log"
+)
+
+// Static serves the blobs given in Server.Static at /static/<name>.
+// The Content-Type comes from the name's extension, or failing that
+// from sniffing the contents.
+func (s *httpServer) Static(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/static/")
+	b, ok := s.static[name]
+	if !ok {
+		log.Debug("HTTP", "%s asked for static file %q, which we don't have", r.RemoteAddr, name)
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(b))
+	if r.Method != "HEAD" {
+		log.Debug("HTTP", "Sent static file %s to %s (%d bytes)", name, r.RemoteAddr, len(b))
+	}
+}
@@ -0,0 +1,101 @@
+package http
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/danderson/pixiecore/api"
+	"github.com/danderson/pixiecore/log"
+)
+
+// wouldBoot is the JSON answer of WouldBoot.
+type wouldBoot struct {
+	MAC string `json:"mac"`
+	// What the machine would be told to do: "netboot", "disk",
+	// "onboarding", "retry" or "fallback".
+	Decision string    `json:"decision"`
+	Reason   string    `json:"reason,omitempty"`
+	Spec     *jsonSpec `json:"spec,omitempty"`
+}
+
+// WouldBoot serves /api/wouldboot/<mac>, which says what the machine
+// with that MAC address would boot if it netbooted now, for checking
+// that a machine is set up right before rebooting it. The optional
+// "arch" and "profile" query parameters select the client
+// architecture (as in DHCP option 93) and boot profile to ask about.
+//
+// Nothing is booted, signed or counted: the Booter is asked with
+// api.PeekBootSpec. The spec is only shown for Booters that are
+// api.Peekers, since for others asking for it might count as a boot.
+func (s *httpServer) WouldBoot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeProblem(w, http.StatusMethodNotAllowed, "Only GET and HEAD are supported")
+		return
+	}
+	mac, err := net.ParseMAC(strings.TrimPrefix(r.URL.Path, "/api/wouldboot/"))
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "Malformed MAC address in request")
+		return
+	}
+	var arch uint16
+	if a := r.URL.Query().Get("arch"); a != "" {
+		n, err := strconv.ParseUint(a, 10, 16)
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, "Malformed arch in request")
+			return
+		}
+		arch = uint16(n)
+	}
+	ctx, err := requestProfile(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "Malformed profile in request")
+		return
+	}
+
+	ret := wouldBoot{MAC: mac.String()}
+	if !s.macFilter.Allows(mac) {
+		ret.Decision, ret.Reason = "disk", "MAC address is not allowed"
+		writeJSON(w, ret)
+		return
+	}
+	archSpec, err := api.PeekBootSpec(ctx, s.booter, mac, profile(ctx))
+	switch {
+	case err == api.ErrUnknownMAC && s.onboarding != "":
+		ret.Decision, ret.Reason = "onboarding", err.Error()
+	case err == api.ErrBootFromDisk:
+		ret.Decision, ret.Reason = "disk", err.Error()
+	case err == api.ErrTemporary:
+		ret.Decision, ret.Reason = "retry", err.Error()
+	case err != nil:
+		ret.Decision, ret.Reason = "fallback", err.Error()
+	case s.dryRun:
+		ret.Decision, ret.Reason = "disk", "dry run"
+	default:
+		ret.Decision = "netboot"
+	}
+	if archSpec != nil {
+		// Worth showing even if it won't be booted, so that the
+		// operator can see what the Booter thinks.
+		spec := archSpec.ForArch(arch)
+		ret.Spec = &jsonSpec{
+			Kernel:    spec.Kernel,
+			Initrd:    spec.Initrd,
+			Cmdline:   spec.Cmdline,
+			EFIDirect: spec.EFIDirect,
+		}
+	}
+	log.Debug("HTTP", "%s asked whether %s would netboot: %s", r.RemoteAddr, mac, ret.Decision)
+	writeJSON(w, ret)
+}
+
+// writeJSON sends v as an indented JSON response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
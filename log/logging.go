@@ -1,31 +1,320 @@
 package log
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// A Format is a way of writing out log entries.
+type Format int32
+
+const (
+	// Text writes log entries as human-readable lines.
+	Text Format = iota
+	// JSON writes each log entry as a JSON object on its own line.
+	JSON
+)
+
+// A Level is how important a log entry is. Each subsystem logs
+// entries at or above its level, see SetLevel.
+type Level int32
+
+const (
+	// LevelError is for failures that need an operator's
+	// attention, logged by Error.
+	LevelError Level = iota
+	// LevelInfo is for the normal progress of boots, logged by Log.
+	LevelInfo
+	// LevelDebug is for details that only matter when something's
+	// wrong, logged by Debug.
+	LevelDebug
+)
+
+var levelNames = []string{"error", "info", "debug"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return fmt.Sprintf("Level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the Level called name, one of "error", "info"
+// or "debug".
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if n == name {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
 type LogEntry struct {
 	Subsystem string
-	Debug     bool
-	Msg       string
+	Level     Level
+	// Set for entries at LevelDebug.
+	Debug bool
+	Msg   string
+
+	// Set when the message mentions a client's MAC address or
+	// network address.
+	MAC        string
+	RemoteAddr string
+	// Set when the message is about a particular boot, see BootID.
+	BootID BootID
+	// Set when the message is about a machine at a known site, see
+	// Site.
+	Site Site
+	Time time.Time
+}
+
+// A BootID identifies one attempt by a machine to boot, so that the
+// log entries for each stage of it (PXE, config, files) can be tied
+// together. Entries are tagged with one using WithBoot.
+type BootID string
+
+// NewBootID returns a fresh BootID for a boot of the machine with
+// the given MAC address.
+func NewBootID(mac net.HardwareAddr) BootID {
+	var nonce [4]byte
+	rand.Read(nonce[:])
+	return BootID(hex.EncodeToString(mac) + "-" + hex.EncodeToString(nonce[:]))
+}
+
+// MAC returns the MAC address of the machine the boot is for, or nil
+// if id wasn't made by NewBootID.
+func (id BootID) MAC() net.HardwareAddr {
+	i := strings.IndexByte(string(id), '-')
+	if i == -1 {
+		return nil
+	}
+	mac, err := hex.DecodeString(string(id[:i]))
+	if err != nil || len(mac) == 0 {
+		return nil
+	}
+	return net.HardwareAddr(mac)
+}
+
+// A Site is the name of the site (e.g. datacenter) a machine is at,
+// derived from its network address. Entries are tagged with one using
+// WithSite.
+type Site string
+
+// A Tagged logger tags the entries it logs with a boot ID and site.
+// Empty tags are left out.
+type Tagged struct {
+	id   BootID
+	site Site
+}
+
+// WithBoot returns a logger that tags entries with boot id.
+func WithBoot(id BootID) Tagged {
+	return Tagged{id: id}
+}
+
+// WithSite returns a logger that tags entries with site.
+func WithSite(site Site) Tagged {
+	return Tagged{site: site}
+}
+
+// WithSite returns a copy of t that also tags entries with site.
+func (t Tagged) WithSite(site Site) Tagged {
+	t.site = site
+	return t
+}
+
+// Error is like the package-level Error, with t's tags.
+func (t Tagged) Error(subsystem string, msg string, args ...interface{}) {
+	logCh <- entry(subsystem, LevelError, t, msg, args...)
+}
+
+// Log is like the package-level Log, with t's tags.
+func (t Tagged) Log(subsystem string, msg string, args ...interface{}) {
+	logCh <- entry(subsystem, LevelInfo, t, msg, args...)
+}
+
+// Debug is like the package-level Debug, with t's tags.
+func (t Tagged) Debug(subsystem string, msg string, args ...interface{}) {
+	logCh <- entry(subsystem, LevelDebug, t, msg, args...)
 }
 
-var logCh = make(chan LogEntry)
+var (
+	logCh  = make(chan LogEntry)
+	format int32
 
+	levelsMu     sync.RWMutex
+	defaultLevel = LevelInfo
+	levels       = map[string]Level{}
+
+	subsMu sync.Mutex
+	subs   = map[chan LogEntry]bool{}
+)
+
+// How many entries a subscriber can fall behind by before it starts
+// missing some.
+const subscriberBuffer = 100
+
+// Subscribe returns a channel that receives every non-debug log
+// entry, for streaming live events to observers. Entries are dropped
+// if the subscriber doesn't keep up. Call cancel when done.
+func Subscribe() (entries <-chan LogEntry, cancel func()) {
+	ch := make(chan LogEntry, subscriberBuffer)
+	subsMu.Lock()
+	subs[ch] = true
+	subsMu.Unlock()
+	return ch, func() {
+		subsMu.Lock()
+		delete(subs, ch)
+		subsMu.Unlock()
+	}
+}
+
+func publish(l LogEntry) {
+	subsMu.Lock()
+	defer subsMu.Unlock()
+	for ch := range subs {
+		select {
+		case ch <- l:
+		default:
+		}
+	}
+}
+
+// SetFormat sets the format of logs written by RecordLogs. The
+// default is Text.
+func SetFormat(f Format) {
+	atomic.StoreInt32(&format, int32(f))
+}
+
+// SetLevel sets the level of the given subsystem, e.g. "HTTP", so
+// that only its entries at or above level get written. An empty
+// subsystem sets the level for subsystems that haven't been given
+// one. It can be called at any time. The default is LevelInfo.
+func SetLevel(subsystem string, level Level) {
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+	if subsystem == "" {
+		defaultLevel = level
+		return
+	}
+	levels[subsystem] = level
+}
+
+// enabled returns true if entries from subsystem at level should be
+// written.
+func enabled(subsystem string, level Level) bool {
+	levelsMu.RLock()
+	defer levelsMu.RUnlock()
+	max, ok := levels[subsystem]
+	if !ok {
+		max = defaultLevel
+	}
+	return level <= max
+}
+
+// RecordLogs writes out log entries, forever. If debug is set, the
+// default level is LevelDebug rather than LevelInfo.
+//
+// Entries below LevelDebug are published to subscribers whatever
+// the levels are set to.
 func RecordLogs(debug bool) {
+	if debug {
+		SetLevel("", LevelDebug)
+	}
 	for l := range logCh {
-		if l.Debug && !debug {
+		if !l.Debug {
+			publish(l)
+		}
+		if !enabled(l.Subsystem, l.Level) {
 			continue
 		}
+		if Format(atomic.LoadInt32(&format)) == JSON {
+			writeJSON(l)
+			continue
+		}
+		tags := ""
+		if l.BootID != "" {
+			tags += fmt.Sprintf(" [boot %s]", l.BootID)
+		}
+		if l.Site != "" {
+			tags += fmt.Sprintf(" [site %s]", l.Site)
+		}
+		log.Printf("[%s] %s%s", l.Subsystem, l.Msg, tags)
+	}
+}
+
+// MarshalJSON encodes l in the format used for JSON logs.
+func (l LogEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Time       string `json:"ts"`
+		Subsystem  string `json:"subsystem"`
+		Level      string `json:"level"`
+		Debug      bool   `json:"debug,omitempty"`
+		Msg        string `json:"msg"`
+		MAC        string `json:"mac,omitempty"`
+		RemoteAddr string `json:"remote_addr,omitempty"`
+		BootID     BootID `json:"boot_id,omitempty"`
+		Site       Site   `json:"site,omitempty"`
+	}{l.Time.UTC().Format(time.RFC3339Nano), l.Subsystem, l.Level.String(), l.Debug, l.Msg, l.MAC, l.RemoteAddr, l.BootID, l.Site})
+}
+
+func writeJSON(l LogEntry) {
+	bs, err := json.Marshal(l)
+	if err != nil {
 		log.Printf("[%s] %s", l.Subsystem, l.Msg)
+		return
 	}
+	fmt.Fprintf(os.Stderr, "%s\n", bs)
+}
+
+// Error logs a failure, at LevelError.
+func Error(subsystem string, msg string, args ...interface{}) {
+	logCh <- entry(subsystem, LevelError, Tagged{}, msg, args...)
 }
 
 func Log(subsystem string, msg string, args ...interface{}) {
-	logCh <- LogEntry{subsystem, false, fmt.Sprintf(msg, args...)}
+	logCh <- entry(subsystem, LevelInfo, Tagged{}, msg, args...)
 }
 
 func Debug(subsystem string, msg string, args ...interface{}) {
-	logCh <- LogEntry{subsystem, true, fmt.Sprintf(msg, args...)}
+	logCh <- entry(subsystem, LevelDebug, Tagged{}, msg, args...)
+}
+
+// entry builds a LogEntry with tags t, picking out MAC and network
+// addresses from the message arguments for structured output.
+func entry(subsystem string, level Level, t Tagged, msg string, args ...interface{}) LogEntry {
+	ret := LogEntry{
+		Subsystem: subsystem,
+		Level:     level,
+		Debug:     level == LevelDebug,
+		BootID:    t.id,
+		Site:      t.site,
+		Time:      time.Now(),
+	}
+	ret.Msg = fmt.Sprintf(msg, args...)
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case net.HardwareAddr:
+			ret.MAC = v.String()
+		case net.Addr:
+			ret.RemoteAddr = v.String()
+		case string:
+			// net/http gives us remote addresses as "ip:port"
+			// strings.
+			if host, _, err := net.SplitHostPort(v); err == nil && net.ParseIP(host) != nil {
+				ret.RemoteAddr = v
+			}
+		}
+	}
+	return ret
 }
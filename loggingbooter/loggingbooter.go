@@ -0,0 +1,103 @@
+// Package loggingbooter provides a Booter wrapper that logs every
+// decision the wrapped Booter makes.
+//
+// It's meant for figuring out why a machine isn't booting the way
+// you expect. It doesn't change any behavior, so it can be wrapped
+// around any Booter and removed again once you're done.
+package loggingbooter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/danderson/pixiecore/api"
+	"github.com/danderson/pixiecore/log"
+)
+
+// A Logf function logs a message for a subsystem, like log.Log and
+// log.Debug.
+type Logf func(subsystem, msg string, args ...interface{})
+
+// New returns a Booter that behaves exactly like b, and logs each
+// call and its result with logf. Pass log.Log or log.Debug to choose
+// the level.
+func New(b api.Booter, logf Logf) api.Booter {
+	if logf == nil {
+		logf = log.Debug
+	}
+	return &loggingBooter{b, logf}
+}
+
+type loggingBooter struct {
+	b    api.Booter
+	logf Logf
+}
+
+func (b *loggingBooter) ShouldBoot(hw net.HardwareAddr) error {
+	err := b.b.ShouldBoot(hw)
+	if err != nil {
+		b.logf("Booter", "ShouldBoot(%s): no (%s)", hw, err)
+	} else {
+		b.logf("Booter", "ShouldBoot(%s): yes", hw)
+	}
+	return err
+}
+
+func (b *loggingBooter) BootSpec(hw net.HardwareAddr) (*api.BootSpec, error) {
+	spec, err := b.b.BootSpec(hw)
+	return b.logSpec(fmt.Sprintf("BootSpec(%s)", hw), spec, err)
+}
+
+// BootSpecContext is like BootSpec, passing the context through to
+// the wrapped Booter if it's an api.ContextBooter.
+func (b *loggingBooter) BootSpecContext(ctx context.Context, hw net.HardwareAddr) (*api.BootSpec, error) {
+	spec, err := api.WithContext(b.b).BootSpecContext(ctx, hw)
+	return b.logSpec(fmt.Sprintf("BootSpec(%s)", hw), spec, err)
+}
+
+// BootSpecProfile is like BootSpec, passing the profile through to
+// the wrapped Booter if it's an api.ProfileBooter.
+func (b *loggingBooter) BootSpecProfile(ctx context.Context, hw net.HardwareAddr, profile string) (*api.BootSpec, error) {
+	spec, err := api.WithProfiles(b.b).BootSpecProfile(ctx, hw, profile)
+	return b.logSpec(fmt.Sprintf("BootSpecProfile(%s, %q)", hw, profile), spec, err)
+}
+
+// logSpec logs the result of call, and returns it.
+func (b *loggingBooter) logSpec(call string, spec *api.BootSpec, err error) (*api.BootSpec, error) {
+	if err != nil {
+		b.logf("Booter", "%s: error (%s)", call, err)
+		return nil, err
+	}
+	b.logf("Booter", "%s: kernel=%q initrd=%q cmdline=%q", call, spec.Kernel, strings.Join(spec.Initrd, ","), spec.Cmdline)
+	return spec, nil
+}
+
+// PeekBootSpec passes through to the wrapped Booter. It isn't
+// logged, since nothing gets booted.
+func (b *loggingBooter) PeekBootSpec(ctx context.Context, hw net.HardwareAddr, profile string) (*api.BootSpec, error) {
+	return api.PeekBootSpec(ctx, b.b, hw, profile)
+}
+
+func (b *loggingBooter) File(id string) (io.ReadCloser, string, error) {
+	return b.FileContext(context.Background(), id)
+}
+
+// FileContext is like File, passing the context through to the
+// wrapped Booter if it's an api.ContextBooter.
+func (b *loggingBooter) FileContext(ctx context.Context, id string) (io.ReadCloser, string, error) {
+	f, pretty, err := api.WithContext(b.b).FileContext(ctx, id)
+	if err != nil {
+		b.logf("Booter", "File(%q): error (%s)", id, err)
+		return nil, "", err
+	}
+	b.logf("Booter", "File(%q): %s", id, pretty)
+	return f, pretty, nil
+}
+
+// Unwrap implements api.Wrapper.
+func (b *loggingBooter) Unwrap() api.Booter {
+	return b.b
+}
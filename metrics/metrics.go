@@ -0,0 +1,196 @@
+// Package metrics keeps counters about Pixiecore's activity, and
+// exposes them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// PXERequests counts the PXE requests we replied to.
+	PXERequests = NewCounter("pixiecore_pxe_requests_total", "PXE boot requests answered.")
+	// BootSpecs counts pxelinux config requests, by whether we told
+	// the client to netboot ("netboot"), to do its onboarding boot
+	// because we don't know it ("onboarding"), to try again later
+	// ("retry"), not to netboot ("disk"), or to do whatever the
+	// fallback policy says because we couldn't work out what to boot
+	// ("fallback").
+	BootSpecs = NewCounterVec("pixiecore_boot_specs_total", "Boot spec decisions made for pxelinux config requests.", "result")
+	// SitePXERequests and SiteBootSpecs are PXERequests and
+	// BootSpecs broken down by the site the machine is at, when
+	// sites are configured.
+	SitePXERequests = NewCounterVec("pixiecore_site_pxe_requests_total", "PXE boot requests answered, by site.", "site")
+	SiteBootSpecs   = NewCounterVec("pixiecore_site_boot_specs_total", "Boot spec decisions made for pxelinux config requests, by site.", "site", "result")
+	// FileBytes counts the bytes served by the file handler.
+	FileBytes = NewCounter("pixiecore_file_bytes_total", "Bytes of kernels and initrds served.")
+	// FileErrors counts file requests that failed.
+	FileErrors = NewCounter("pixiecore_file_errors_total", "File transfers that failed.")
+	// FileDuration tracks how long file transfers take.
+	FileDuration = NewHistogram("pixiecore_file_transfer_duration_seconds", "Duration of kernel and initrd transfers.", []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300})
+)
+
+// A metric is something that can write itself out in the exposition
+// format.
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	mu      sync.Mutex
+	metrics []metric
+)
+
+func register(m metric) {
+	mu.Lock()
+	defer mu.Unlock()
+	metrics = append(metrics, m)
+}
+
+// A Counter is a monotonically increasing count.
+type Counter struct {
+	name, help string
+	val        uint64
+}
+
+// NewCounter creates and registers a Counter.
+func NewCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	register(c)
+	return c
+}
+
+// Inc adds 1 to the counter.
+func (c *Counter) Inc() { c.Add(1) }
+
+// Add adds n to the counter.
+func (c *Counter) Add(n uint64) { atomic.AddUint64(&c.val, n) }
+
+func (c *Counter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	fmt.Fprintf(w, "%s %d\n", c.name, atomic.LoadUint64(&c.val))
+}
+
+// A CounterVec is a set of counters partitioned by the values of
+// some labels.
+type CounterVec struct {
+	name, help string
+	labels     []string
+
+	mu   sync.Mutex
+	vals map[string]uint64 // by label values, joined with labelSep
+}
+
+// labelSep separates label values in CounterVec keys. It can't appear
+// in valid UTF-8.
+const labelSep = "\xff"
+
+// NewCounterVec creates and registers a CounterVec with the given
+// labels.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, vals: map[string]uint64{}}
+	register(c)
+	return c
+}
+
+// Inc adds 1 to the counter for the given label values, which must be
+// in the same order as the labels given to NewCounterVec.
+func (c *CounterVec) Inc(values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.vals[strings.Join(values, labelSep)]++
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	var values []string
+	for v := range c.vals {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	for _, v := range values {
+		var pairs []string
+		for i, lv := range strings.Split(v, labelSep) {
+			if i < len(c.labels) {
+				pairs = append(pairs, fmt.Sprintf("%s=%q", c.labels[i], lv))
+			}
+		}
+		fmt.Fprintf(w, "%s{%s} %d\n", c.name, strings.Join(pairs, ","), c.vals[v])
+	}
+}
+
+// A Histogram counts observations into buckets.
+type Histogram struct {
+	name, help string
+	bounds     []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates and registers a Histogram with the given
+// bucket upper bounds, which must be sorted in increasing order.
+func NewHistogram(name, help string, bounds []float64) *Histogram {
+	h := &Histogram{name: name, help: help, bounds: bounds, counts: make([]uint64, len(bounds))}
+	register(h)
+	return h
+}
+
+// Observe records one observation of v.
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// ObserveSince records the time elapsed since start, in seconds.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, b := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(b), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Handler returns an http.Handler that serves all registered metrics
+// in the Prometheus text exposition format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		mu.Lock()
+		ms := append([]metric(nil), metrics...)
+		mu.Unlock()
+		for _, m := range ms {
+			m.write(w)
+		}
+	})
+}
@@ -0,0 +1,125 @@
+// Package multibooter provides a Booter that consults several Booters
+// in order, and goes with the first one that has an answer.
+//
+// This makes it easy to layer boot configuration sources, e.g. a
+// per-machine database in front of a static default.
+package multibooter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/danderson/pixiecore/api"
+)
+
+// New returns a Booter that asks each of booters in turn, and uses
+// the first answer. A Booter that doesn't know the machine
+// (api.ErrUnknownMAC) passes it on to the next one. Any other answer,
+// including api.ErrBootFromDisk and other errors, is final, so that a
+// later default can't netboot a machine an earlier Booter said
+// shouldn't be. If no Booter knows the machine, the result is
+// api.ErrUnknownMAC.
+func New(booters ...api.Booter) api.Booter {
+	return multiBooter(booters)
+}
+
+type multiBooter []api.Booter
+
+var errNoBooters = errors.New("no Booters configured")
+
+func (m multiBooter) ShouldBoot(hw net.HardwareAddr) error {
+	if len(m) == 0 {
+		return errNoBooters
+	}
+	for _, b := range m {
+		if err := b.ShouldBoot(hw); err != api.ErrUnknownMAC {
+			return err
+		}
+	}
+	return api.ErrUnknownMAC
+}
+
+func (m multiBooter) BootSpec(hw net.HardwareAddr) (*api.BootSpec, error) {
+	return m.BootSpecContext(context.Background(), hw)
+}
+
+// BootSpecContext is like BootSpec, passing the context through to
+// the Booters that are api.ContextBooters.
+func (m multiBooter) BootSpecContext(ctx context.Context, hw net.HardwareAddr) (*api.BootSpec, error) {
+	if len(m) == 0 {
+		return nil, errNoBooters
+	}
+	for _, b := range m {
+		if spec, err := api.WithContext(b).BootSpecContext(ctx, hw); err != api.ErrUnknownMAC {
+			return spec, err
+		}
+	}
+	return nil, api.ErrUnknownMAC
+}
+
+// PeekBootSpec is like BootSpec, without side effects in any of the
+// Booters.
+func (m multiBooter) PeekBootSpec(ctx context.Context, hw net.HardwareAddr, profile string) (*api.BootSpec, error) {
+	if len(m) == 0 {
+		return nil, errNoBooters
+	}
+	for _, b := range m {
+		if spec, err := api.PeekBootSpec(ctx, b, hw, profile); err != api.ErrUnknownMAC {
+			return spec, err
+		}
+	}
+	return nil, api.ErrUnknownMAC
+}
+
+// Reload reloads each Booter that's an api.Reloader, and returns the
+// first error, if any. It's only ErrNotReloadable if none of them
+// are.
+func (m multiBooter) Reload() error {
+	var (
+		ret        error
+		reloadable bool
+	)
+	for _, b := range m {
+		err := api.Reload(b)
+		if err == api.ErrNotReloadable {
+			continue
+		}
+		reloadable = true
+		if err != nil && ret == nil {
+			ret = err
+		}
+	}
+	if !reloadable {
+		return api.ErrNotReloadable
+	}
+	return ret
+}
+
+// File asks each Booter for id in turn. File IDs aren't namespaced,
+// so the Booters should hand out IDs that only they understand. If
+// none of them can serve it, the first error other than
+// api.ErrNotFound wins.
+func (m multiBooter) File(id string) (io.ReadCloser, string, error) {
+	return m.FileContext(context.Background(), id)
+}
+
+// FileContext is like File, passing the context through to the
+// Booters that are api.ContextBooters.
+func (m multiBooter) FileContext(ctx context.Context, id string) (io.ReadCloser, string, error) {
+	if len(m) == 0 {
+		return nil, "", errNoBooters
+	}
+	ret := api.ErrNotFound
+	for _, b := range m {
+		f, pretty, err := api.WithContext(b).FileContext(ctx, id)
+		if err == nil {
+			return f, pretty, nil
+		}
+		if err != api.ErrNotFound && ret == api.ErrNotFound {
+			ret = err
+		}
+	}
+	return nil, "", ret
+}
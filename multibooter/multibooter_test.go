@@ -0,0 +1,66 @@
+package multibooter
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/danderson/pixiecore/api"
+)
+
+var mac = net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}
+
+func fixed(err error) api.Booter {
+	return &api.FakeBooter{
+		BootSpecFunc: func(net.HardwareAddr) (*api.BootSpec, error) {
+			if err != nil {
+				return nil, err
+			}
+			return &api.BootSpec{Kernel: "kernel"}, nil
+		},
+	}
+}
+
+func TestBootSpec(t *testing.T) {
+	errBroken := errors.New("broken")
+	tests := []struct {
+		name    string
+		booters []api.Booter
+		want    error
+	}{
+		{"unknown then default", []api.Booter{fixed(api.ErrUnknownMAC), fixed(nil)}, nil},
+		{"boot from disk is final", []api.Booter{fixed(api.ErrBootFromDisk), fixed(nil)}, api.ErrBootFromDisk},
+		{"errors are final", []api.Booter{fixed(errBroken), fixed(nil)}, errBroken},
+		{"all unknown", []api.Booter{fixed(api.ErrUnknownMAC), fixed(api.ErrUnknownMAC)}, api.ErrUnknownMAC},
+		{"unknown then error", []api.Booter{fixed(api.ErrUnknownMAC), fixed(errBroken)}, errBroken},
+	}
+	for _, test := range tests {
+		b := New(test.booters...)
+		if _, err := b.BootSpec(mac); err != test.want {
+			t.Errorf("%s: BootSpec returned %v, want %v", test.name, err, test.want)
+		}
+		if err := b.ShouldBoot(mac); err != test.want {
+			t.Errorf("%s: ShouldBoot returned %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	errBroken := errors.New("broken")
+	broken := &api.FakeBooter{FileFunc: func(string) (io.ReadCloser, string, error) {
+		return nil, "", errBroken
+	}}
+	has := &api.FakeBooter{Files: map[string][]byte{"kernel": []byte("k")}}
+	empty := &api.FakeBooter{}
+
+	if _, _, err := New(broken, has).File("kernel"); err != nil {
+		t.Errorf("File with a later Booter serving it: %s", err)
+	}
+	if _, _, err := New(empty, broken, empty).File("kernel"); err != errBroken {
+		t.Errorf("File returned %v, want the real error %v", err, errBroken)
+	}
+	if _, _, err := New(empty, empty).File("kernel"); err != api.ErrNotFound {
+		t.Errorf("File returned %v, want ErrNotFound", err)
+	}
+}
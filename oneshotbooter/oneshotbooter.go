@@ -0,0 +1,237 @@
+// Package oneshotbooter provides a Booter wrapper that netboots each
+// machine only once.
+//
+// This is useful for installs: the machine netboots into an
+// installer, and on its next boot it gets told to boot from disk,
+// into whatever got installed. Call Reset to make a machine netboot
+// again.
+//
+// A Booter made by NewPersistent keeps which machines have netbooted
+// in a state file, one "<mac> <RFC 3339 time>" line per machine, so
+// that they don't netboot again after a restart. Operators can make a
+// machine netboot again by deleting its line and calling Reload
+// (pixiecore does on SIGHUP).
+package oneshotbooter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danderson/pixiecore/api"
+	"github.com/danderson/pixiecore/log"
+)
+
+// How long after the first BootSpec a machine can keep asking for it.
+// A single boot can involve several requests (e.g. if the bootloader
+// retries), and we don't want to cut the machine off halfway.
+const gracePeriod = time.Minute
+
+// A Booter netboots each machine at most once, according to an
+// underlying Booter.
+type Booter struct {
+	api.Booter
+	// State file, or "" to keep state in memory only.
+	path string
+
+	mu     sync.Mutex
+	booted map[string]time.Time
+}
+
+// New returns a Booter that netboots machines once, as b would, and
+// then tells them to boot from disk. It forgets which machines have
+// netbooted when the process exits.
+func New(b api.Booter) *Booter {
+	return &Booter{
+		Booter: b,
+		booted: map[string]time.Time{},
+	}
+}
+
+// NewPersistent is like New, but keeps which machines have netbooted
+// in the state file at path, which is created if it doesn't exist.
+func NewPersistent(b api.Booter, path string) (*Booter, error) {
+	ret := New(b)
+	ret.path = path
+	booted, err := readState(path)
+	if err != nil {
+		return nil, err
+	}
+	ret.booted = booted
+	return ret, nil
+}
+
+// readState reads the state file at path. A missing file is an empty
+// state.
+func readState(path string) (map[string]time.Time, error) {
+	ret := map[string]time.Time{}
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := bufio.NewScanner(bytes.NewReader(bs))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fs := strings.Fields(line)
+		if len(fs) != 2 {
+			return nil, fmt.Errorf("%s:%d: want \"<mac> <time>\"", path, n)
+		}
+		mac, err := net.ParseMAC(fs[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+		t, err := time.Parse(time.RFC3339, fs[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+		ret[mac.String()] = t
+	}
+	return ret, nil
+}
+
+// save writes the state file, if there is one. Must be called with
+// b.mu held.
+func (b *Booter) save() error {
+	if b.path == "" {
+		return nil
+	}
+	macs := make([]string, 0, len(b.booted))
+	for mac := range b.booted {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+	var buf bytes.Buffer
+	for _, mac := range macs {
+		fmt.Fprintf(&buf, "%s %s\n", mac, b.booted[mac].UTC().Format(time.RFC3339))
+	}
+	// Write and rename, so that a crash can't leave a torn file.
+	tmp, err := ioutil.TempFile(filepath.Dir(b.path), ".oneshot")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), b.path)
+}
+
+// Reset forgets that hw has netbooted, so that it netboots again next
+// time.
+func (b *Booter) Reset(hw net.HardwareAddr) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.booted, hw.String())
+	return b.save()
+}
+
+// done returns api.ErrBootFromDisk if hw has already used up its
+// netboot.
+func (b *Booter) done(hw net.HardwareAddr) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if t, ok := b.booted[hw.String()]; ok && time.Since(t) > gracePeriod {
+		log.Debug("OneShot", "Booting %s from disk, it already netbooted at %s", hw, t.Format(time.RFC3339))
+		return api.ErrBootFromDisk
+	}
+	return nil
+}
+
+func (b *Booter) ShouldBoot(hw net.HardwareAddr) error {
+	if err := b.done(hw); err != nil {
+		return err
+	}
+	return b.Booter.ShouldBoot(hw)
+}
+
+func (b *Booter) BootSpec(hw net.HardwareAddr) (*api.BootSpec, error) {
+	return b.BootSpecProfile(context.Background(), hw, "")
+}
+
+// BootSpecContext is like BootSpec, passing the context through to
+// the wrapped Booter.
+func (b *Booter) BootSpecContext(ctx context.Context, hw net.HardwareAddr) (*api.BootSpec, error) {
+	return b.BootSpecProfile(ctx, hw, "")
+}
+
+// FileContext passes through to the wrapped Booter, so that wrapping
+// doesn't hide its api.ContextBooter implementation.
+func (b *Booter) FileContext(ctx context.Context, id string) (io.ReadCloser, string, error) {
+	return api.WithContext(b.Booter).FileContext(ctx, id)
+}
+
+// BootSpecProfile is like BootSpec, passing the profile through to
+// the wrapped Booter if it's an api.ProfileBooter. Netbooting into
+// any profile uses up the machine's netboot.
+func (b *Booter) BootSpecProfile(ctx context.Context, hw net.HardwareAddr, profile string) (*api.BootSpec, error) {
+	if err := b.done(hw); err != nil {
+		return nil, err
+	}
+	spec, err := api.WithProfiles(b.Booter).BootSpecProfile(ctx, hw, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.booted[hw.String()]; !ok {
+		b.booted[hw.String()] = time.Now()
+		if err = b.save(); err != nil {
+			// Better to netboot the machine twice than not at
+			// all.
+			log.Error("OneShot", "Saving that %s netbooted: %s", hw, err)
+		}
+	}
+	return spec, nil
+}
+
+// PeekBootSpec says what BootSpec would, without using up hw's
+// netboot.
+func (b *Booter) PeekBootSpec(ctx context.Context, hw net.HardwareAddr, profile string) (*api.BootSpec, error) {
+	if err := b.done(hw); err != nil {
+		return nil, err
+	}
+	return api.PeekBootSpec(ctx, b.Booter, hw, profile)
+}
+
+// Reload implements api.Reloader, rereading the state file. Booters
+// made by New have none, and return api.ErrNotReloadable.
+func (b *Booter) Reload() error {
+	if b.path == "" {
+		return api.ErrNotReloadable
+	}
+	booted, err := readState(b.path)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.booted = booted
+	b.mu.Unlock()
+	return nil
+}
+
+// Unwrap implements api.Wrapper.
+func (b *Booter) Unwrap() api.Booter {
+	return b.Booter
+}
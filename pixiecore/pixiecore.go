@@ -1,20 +1,36 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/danderson/pixiecore/api"
+	"github.com/danderson/pixiecore/apibooter"
 	"github.com/danderson/pixiecore/assets"
+	"github.com/danderson/pixiecore/cachingbooter"
+	"github.com/danderson/pixiecore/defaultargsbooter"
 	"github.com/danderson/pixiecore/dhcp"
+	"github.com/danderson/pixiecore/dhcp6"
+	"github.com/danderson/pixiecore/execbooter"
+	"github.com/danderson/pixiecore/failbooter"
+	"github.com/danderson/pixiecore/filebooter"
 	"github.com/danderson/pixiecore/http"
+	"github.com/danderson/pixiecore/oneshotbooter"
 	"github.com/danderson/pixiecore/pxe"
+	"github.com/danderson/pixiecore/staticbooter"
 	"github.com/danderson/pixiecore/tftp"
 	pixiecorelog "github.com/danderson/pixiecore/log"
 )
@@ -30,17 +46,139 @@ var (
 	portTFTP = flag.Int("port-tftp", 69, "Port to listen on for TFTP requests")
 	portHTTP = flag.Int("port-http", 70, "Port to listen on for HTTP requests")
 
+	dhcp6Enable = flag.Bool("dhcp6", false, "Also answer UEFI HTTP Boot clients over DHCPv6")
+	portDHCP6   = flag.Int("port-dhcp6", 547, "Port to listen on for DHCPv6 requests")
+
+	dhcpRange     = flag.String("dhcp-range", "", "If set, run a full DHCP server leasing this range of addresses (e.g. 192.168.1.100-192.168.1.200) instead of ProxyDHCP, for networks with no other DHCP server")
+	dhcpNetmask   = flag.String("dhcp-netmask", "255.255.255.0", "Subnet mask to give clients of -dhcp-range")
+	dhcpRouter    = flag.String("dhcp-router", "", "Default gateway to give clients of -dhcp-range (default: none)")
+	dhcpLeaseTime = flag.Duration("dhcp-lease-time", dhcp.DefaultLeaseTime, "How long to lease -dhcp-range addresses for")
+
+	tlsCert = flag.String("tls-cert", "", "Path to a PEM certificate, to serve HTTPS instead of HTTP (self-signed is fine)")
+	tlsKey  = flag.String("tls-key", "", "Path to the PEM private key for -tls-cert")
+
+	bootMessage = flag.String("boot-message", "", "Message to display while machines boot (default: a limerick)")
+
+	rebootTimeout = flag.Duration("reboot-timeout", pxe.DefaultRebootTimeout, "How long pxelinux waits before rebooting after a failed boot, or -1s to never reboot")
+
+	fileRetries  = flag.Int("file-retries", 3, "How many times to resume a file transfer that fails partway through")
+	maxFileSize  = flag.Int64("max-file-size", 0, "Abort transfers of files bigger than this many bytes (0 means no limit)")
+	contentTypes = flag.String("content-types", "", "Comma-separated list of .ext=type, giving the Content-Type of served files by extension, on top of the built-in ones for .json, .yaml and such (e.g. .ks=text/plain)")
+
+	httpWriteTimeout = flag.Duration("http-write-timeout", http.DefaultWriteTimeout, "Maximum time to send an HTTP response, which must allow for large images over slow links, or -1s for no limit")
+
+	httpPrefix = flag.String("http-prefix", "/", "Path to serve HTTP under, when behind a reverse proxy")
+
+	tftpConfigs = flag.Bool("tftp-pxelinux-config", false, "Also serve pxelinux configs over TFTP, for firmware that won't fetch them over HTTP")
+
+	accessLog = flag.String("access-log", "", "If set, write HTTP access logs in Combined Log Format to this file, or - for stdout")
+
+	ldlinuxFile = flag.String("ldlinux", "", "Path to an ldlinux.c32 (optionally gzipped) to use instead of the built-in one")
+
+	efiLoader   = flag.String("efi-loader", "", "Path to syslinux.efi, to boot x64 UEFI machines")
+	efiLdlinux  = flag.String("efi-ldlinux", "", "Path to the ldlinux.e64 that goes with -efi-loader")
+	staticDir   = flag.String("static-dir", "", "Directory of files to serve at /static/<name>, e.g. installer MOTDs or kickstarts")
+	moduleDir   = flag.String("syslinux-modules", "", "Directory of extra syslinux modules (*.c32, e.g. menu.c32 and its libraries) to serve alongside ldlinux.c32")
+	loaderFiles = flag.String("loaders", "", "Comma-separated list of arch=path, giving the first bootloader for UEFI machines of each architecture (option 93 code, e.g. 11=grubaa64.efi)")
+
+	pprofEnable = flag.Bool("pprof", false, "Serve Go profiling handlers under /debug/pprof/ on the HTTP port. Don't use on untrusted networks")
+
+	signingKeyFile = flag.String("signing-key-file", "", "File to keep the URL signing key in, so URLs survive restarts (created if missing)")
+
+	bindAddr = flag.String("bind-address", "", "IP address to listen on for PXE and HTTP requests (default: all)")
+
+	advertiseIP = flag.String("advertise-ip", "", "IP address to tell PXE clients to talk to, if not the one they reached us on (e.g. behind a load balancer)")
+
+	maxTransfers = flag.Int("max-transfers", 0, "Maximum number of concurrent HTTP file transfers, 0 for no limit")
+
+	fileURLBase = flag.String("file-url-base", "", "If set, hand out absolute file URLs under this base URL, e.g. https://boot.example.com/pixiecore/")
+
+	contentAddressed = flag.Bool("content-addressed-urls", false, "Give files URLs based on their contents where possible, so caching proxies can dedupe them")
+
+	fallback       = flag.String("fallback", "disk", "What machines that shouldn't netboot do: disk to boot from disk, or reboot to try again")
+	fallbackConfig = flag.String("fallback-config", "", "Path to a pxelinux config to serve to machines that shouldn't netboot, instead of -fallback")
+
+	retryDelay  = flag.Duration("retry-delay", http.DefaultRetryDelay, "How long machines wait before asking again when the boot source is temporarily unavailable")
+	retryJitter = flag.Duration("retry-jitter", http.DefaultRetryJitter, "Maximum random extra wait on top of -retry-delay, so that machines don't all retry at once, or -1s for none")
+
+	onboardingConfig = flag.String("onboarding-config", "", "Path to a pxelinux config to serve to machines the boot source doesn't know, e.g. to boot an inventory image")
+	onboardingScript = flag.String("onboarding-ipxe", "", "Path to an iPXE script to serve to machines the boot source doesn't know")
+
+	dryRun = flag.Bool("dry-run", false, "Log what machines would boot, but tell them to boot from disk")
+
+	pxeInterfaces = flag.String("pxe-interfaces", "", "Comma-separated list of interfaces to serve PXE on (default: all)")
+
+	pxeRateLimit = flag.Int("pxe-rate-limit", pxe.DefaultRateLimit, "Maximum PXE replies per second to a single client, or -1 for no limit")
+
+	allowMACs = flag.String("allow-macs", "", "Comma-separated list of MAC addresses or prefixes (e.g. 00:11:22:00:00:00/24) to serve. If set, all others are ignored")
+	denyMACs  = flag.String("deny-macs", "", "Comma-separated list of MAC addresses or prefixes never to serve")
+
+	allowMACsFile = flag.String("allow-macs-file", "", "Path to a file of MAC addresses or prefixes, one per line, to serve on top of -allow-macs. If set, all others are ignored. Reread on SIGHUP")
+	denyMACsFile  = flag.String("deny-macs-file", "", "Path to a file of MAC addresses or prefixes, one per line, never to serve on top of -deny-macs. Reread on SIGHUP")
+
+	siteMap = flag.String("site-map", "", "Path to a file of \"subnet site\" lines (e.g. 10.1.0.0/16 dc1), to tag logs and metrics with the site machines boot from")
+
+	legacyBootOptions = flag.Bool("legacy-boot-options", false, "Also send the TFTP server and boot file in DHCP options 66 and 67, for old firmware that ignores the BOOTP header")
+
+	pxeDump = flag.Bool("pxe-dump", false, "Log a decoded dump of every PXE request and reply (needs -debug or -log-level PXE=debug)")
+
+	interfaceIPTTL = flag.Duration("interface-ip-ttl", dhcp.DefaultInterfaceIPTTL, "How long to remember the address of each interface DHCP and PXE replies go out on, or -1s to look it up for every request")
+
+	pxeBufferSize = flag.Int("pxe-buffer-size", 0, "Size in bytes of the buffer PXE requests are read into (default: the largest interface MTU, at least 1500)")
+
 	apiServer  = flag.String("api", "", "Path to the boot API server")
-	apiTimeout = flag.Duration("api-timeout", 5*time.Second, "Timeout on boot API server requests")
+	apiTimeout = flag.Duration("api-timeout", 5*time.Second, "Timeout on boot API server and -provisioning-api boot spec requests")
+
+	provisioningAPI     = flag.String("provisioning-api", "", "Base URL of a provisioning service to ask what to boot at <url>/v1/boot/<mac>, and to fetch files from at <url>/v1/file/<id>")
+	provisioningAPIAuth = flag.String("provisioning-api-auth", "", "Header to send with -provisioning-api requests, e.g. \"Authorization: Bearer <token>\"")
+
+	configFile = flag.String("config", "", "Path to a YAML file of per-machine boot configs")
+
+	execSpec    = flag.String("exec-spec", "", "Command to run with a MAC address, that prints the machine's boot spec as JSON")
+	execFile    = flag.String("exec-file", "", "Command to run with a file ID, that prints the file's contents")
+	execTimeout = flag.Duration("exec-timeout", 5*time.Second, "How long -exec-spec can run before it's killed, and the machine boots from disk")
+
+	defaultCmdline = flag.String("default-cmdline", "", "Kernel arguments to add to every machine's commandline, unless its boot spec already sets them")
+
+	oneShot      = flag.Bool("once", false, "Netboot each machine only once, then boot it from disk")
+	oneShotState = flag.String("once-state", "", "File to keep which machines -once has netbooted in, so restarts don't netboot them again. Delete a machine's line and send SIGHUP to netboot it again")
+
+	maxBootFailures = flag.Int("max-boot-failures", 0, "If set, boot machines from disk after they report this many failures in a row to /boot/progress/<mac>")
+
+	cacheDir  = flag.String("cache-dir", "", "If set, cache kernels and initrds in this directory")
+	cacheSize = flag.Int64("cache-size", 1<<30, "Maximum size in bytes of the -cache-dir cache")
 
 	kernelFile    = flag.String("kernel", "", "Path to the linux kernel file to boot")
 	initrdFile    = flag.String("initrd", "", "Comma-separated list of initrds to pass to the kernel")
 	kernelCmdline = flag.String("cmdline", "", "Additional arguments for the kernel commandline")
 
-	debug = flag.Bool("debug", false, "Log more things that aren't directly related to booting a recognized client")
+	debug     = flag.Bool("debug", false, "Log more things that aren't directly related to booting a recognized client")
+	logFormat = flag.String("log-format", "text", "Format of log output, either text or json")
+	logLevels = flag.String("log-level", "", "Comma-separated log levels (error, info or debug), either for a subsystem (e.g. HTTP=error) or, without a subsystem, for all others")
 )
 
 func pickBooter() (api.Booter, error) {
+	// Only one of the booters below can be used, so it's an error to
+	// ask for more than one.
+	var modes []string
+	for _, f := range []struct{ name, val string }{
+		{"-api", *apiServer},
+		{"-provisioning-api", *provisioningAPI},
+		{"-config", *configFile},
+		{"-exec-spec", *execSpec},
+		{"-kernel", *kernelFile},
+	} {
+		if f.val != "" {
+			modes = append(modes, f.name)
+		}
+	}
+	if len(modes) > 1 {
+		return nil, fmt.Errorf("cannot provide %s together", strings.Join(modes, " and "))
+	}
+	if *execFile != "" && *execSpec == "" {
+		return nil, errors.New("cannot provide -exec-file without -exec-spec")
+	}
+
 	switch {
 	case *apiServer != "":
 		if *kernelFile != "" {
@@ -56,31 +194,284 @@ func pickBooter() (api.Booter, error) {
 		log.Printf("Starting Pixiecore in API mode, with server %s", *apiServer)
 		return api.RemoteBooter(*apiServer, *apiTimeout)
 
-	case *kernelFile != "":
-		if *apiServer != "" {
-			return nil, errors.New("cannot provide -api with -kernel")
+	case *provisioningAPI != "":
+		if *kernelFile != "" || *initrdFile != "" || *kernelCmdline != "" {
+			return nil, errors.New("cannot provide -kernel, -initrd or -cmdline with -provisioning-api")
+		}
+
+		log.Printf("Starting Pixiecore in provisioning API mode, with service %s", *provisioningAPI)
+		return apibooter.New(*provisioningAPI, *provisioningAPIAuth, *apiTimeout)
+
+	case *configFile != "":
+		if *kernelFile != "" || *initrdFile != "" || *kernelCmdline != "" {
+			return nil, errors.New("cannot provide -kernel, -initrd or -cmdline with -config")
+		}
+
+		log.Printf("Starting Pixiecore in config file mode, with config %s", *configFile)
+		return filebooter.NewFileBooter(*configFile)
+
+	case *execSpec != "":
+		if *kernelFile != "" || *initrdFile != "" || *kernelCmdline != "" {
+			return nil, errors.New("cannot provide -kernel, -initrd or -cmdline with -exec-spec")
 		}
+
+		log.Printf("Starting Pixiecore in exec mode, with command %s", *execSpec)
+		return execbooter.New(strings.Fields(*execSpec), strings.Fields(*execFile), *execTimeout)
+
+	case *kernelFile != "":
 		if *initrdFile == "" {
 			return nil, errors.New("must provide -initrd with -kernel")
 		}
 
 		log.Printf("Starting Pixiecore in static mode")
-		return api.StaticBooter(*kernelFile, strings.Split(*initrdFile, ","), *kernelCmdline), nil
+		return staticbooter.NewStatic(*kernelFile, strings.Split(*initrdFile, ","), *kernelCmdline)
 
 	default:
-		return nil, errors.New("must specify either -api, or -kernel/-initrd")
+		return nil, errors.New("must specify either -api, -provisioning-api, -config, -exec-spec/-exec-file, or -kernel/-initrd")
+	}
+}
+
+// onboardingBooter offers to boot machines that the wrapped Booter
+// doesn't know, so that they get as far as the onboarding config. It
+// also offers when the wrapped Booter can't tell right now, so that
+// the machine gets told to retry.
+type onboardingBooter struct {
+	api.Booter
+}
+
+func (b onboardingBooter) ShouldBoot(hw net.HardwareAddr) error {
+	if err := b.Booter.ShouldBoot(hw); err != api.ErrUnknownMAC && err != api.ErrTemporary {
+		return err
+	}
+	return nil
+}
+
+// filteredBooter refuses to boot machines that the -allow-macs and
+// -deny-macs filter doesn't let through, so that they don't even get
+// a DHCP offer.
+type filteredBooter struct {
+	api.Booter
+	filter *api.MACFilter
+}
+
+var errMACDenied = errors.New("MAC address is not allowed")
+
+func (b filteredBooter) ShouldBoot(hw net.HardwareAddr) error {
+	if !b.filter.Allows(hw) {
+		return errMACDenied
+	}
+	return b.Booter.ShouldBoot(hw)
+}
+
+// reloadOnSIGHUP reloads booter's configuration, and filter's MAC
+// lists if there's a filter, every time we get SIGHUP.
+func reloadOnSIGHUP(booter api.Booter, filter *api.MACFilter) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := api.Reload(booter); err != nil {
+			pixiecorelog.Error("Main", "Reloading on SIGHUP: %s", err)
+		} else {
+			pixiecorelog.Log("Main", "Reloaded the Booter's configuration on SIGHUP")
+		}
+		if filter == nil {
+			continue
+		}
+		if err := filter.Reload(); err != nil {
+			pixiecorelog.Error("Main", "Reloading the MAC filter on SIGHUP: %s", err)
+		} else {
+			pixiecorelog.Log("Main", "Reloaded the MAC filter on SIGHUP")
+		}
+	}
+}
+
+// parseContentTypes parses -content-types.
+func parseContentTypes(spec string) (map[string]string, error) {
+	ret := map[string]string{}
+	if spec == "" {
+		return ret, nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		i := strings.IndexByte(entry, '=')
+		if i == -1 || !strings.HasPrefix(entry, ".") {
+			return nil, fmt.Errorf("%q is not .ext=type", entry)
+		}
+		if _, _, err := mime.ParseMediaType(entry[i+1:]); err != nil {
+			return nil, fmt.Errorf("bad type in %q: %s", entry, err)
+		}
+		ret[entry[:i]] = entry[i+1:]
+	}
+	return ret, nil
+}
+
+// readLoaders reads the loaders given to -loaders.
+func readLoaders(spec string) (map[uint16][]byte, error) {
+	ret := map[uint16][]byte{}
+	if spec == "" {
+		return ret, nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		i := strings.IndexByte(entry, '=')
+		if i == -1 {
+			return nil, fmt.Errorf("%q is not arch=path", entry)
+		}
+		arch, err := strconv.ParseUint(entry[:i], 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("bad architecture in %q: %s", entry, err)
+		}
+		if ret[uint16(arch)], err = ioutil.ReadFile(entry[i+1:]); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// readModules reads the syslinux modules in dir, keyed by name
+// without the .c32 suffix.
+func readModules(dir string) (map[string][]byte, error) {
+	ret := map[string][]byte{}
+	if dir == "" {
+		return ret, nil
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.c32"))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		bs, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		ret[strings.TrimSuffix(filepath.Base(p), ".c32")] = bs
+	}
+	return ret, nil
+}
+
+// readStatic reads the regular files in dir, keyed by name.
+func readStatic(dir string) (map[string][]byte, error) {
+	ret := map[string][]byte{}
+	if dir == "" {
+		return ret, nil
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		if ret[fi.Name()], err = ioutil.ReadFile(filepath.Join(dir, fi.Name())); err != nil {
+			return nil, err
+		}
 	}
+	return ret, nil
+}
+
+// parsePool builds the full DHCP server's address pool from the
+// -dhcp-* flags.
+func parsePool() (*dhcp.Pool, error) {
+	mask := net.ParseIP(*dhcpNetmask).To4()
+	if mask == nil {
+		return nil, fmt.Errorf("invalid -dhcp-netmask %q", *dhcpNetmask)
+	}
+	pool, err := dhcp.ParsePool(*dhcpRange, net.IPMask(mask))
+	if err != nil {
+		return nil, fmt.Errorf("parsing -dhcp-range: %s", err)
+	}
+	if *dhcpRouter != "" {
+		if pool.Router = net.ParseIP(*dhcpRouter).To4(); pool.Router == nil {
+			return nil, fmt.Errorf("invalid -dhcp-router %q", *dhcpRouter)
+		}
+	}
+	pool.LeaseTime = *dhcpLeaseTime
+	return pool, nil
 }
 
 func main() {
 	flag.Parse()
 
+	if (*tlsCert == "") != (*tlsKey == "") {
+		flag.Usage()
+		fmt.Fprintf(os.Stderr, "\nERROR: -tls-cert and -tls-key must be provided together\n")
+		os.Exit(1)
+	}
+	if *advertiseIP != "" && net.ParseIP(*advertiseIP).To4() == nil {
+		flag.Usage()
+		fmt.Fprintf(os.Stderr, "\nERROR: -advertise-ip must be an IPv4 address\n")
+		os.Exit(1)
+	}
+	var macFilter *api.MACFilter
+	if *allowMACs != "" || *denyMACs != "" || *allowMACsFile != "" || *denyMACsFile != "" {
+		var err error
+		if macFilter, err = api.LoadMACFilter(*allowMACs, *denyMACs, *allowMACsFile, *denyMACsFile); err != nil {
+			flag.Usage()
+			fmt.Fprintf(os.Stderr, "\nERROR: bad -allow-macs, -deny-macs or their files: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	var sites *pxe.SiteMap
+	if *siteMap != "" {
+		var err error
+		if sites, err = pxe.LoadSiteMap(*siteMap); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: reading -site-map: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	httpScheme := "http"
+	if *tlsCert != "" {
+		httpScheme = "https"
+	}
+
+	switch *logFormat {
+	case "text":
+	case "json":
+		pixiecorelog.SetFormat(pixiecorelog.JSON)
+	default:
+		flag.Usage()
+		fmt.Fprintf(os.Stderr, "\nERROR: unknown log format %q\n", *logFormat)
+		os.Exit(1)
+	}
+	if *debug {
+		pixiecorelog.SetLevel("", pixiecorelog.LevelDebug)
+	}
+	if err := setLogLevels(*logLevels); err != nil {
+		flag.Usage()
+		fmt.Fprintf(os.Stderr, "\nERROR: bad -log-level: %s\n", err)
+		os.Exit(1)
+	}
+
 	booter, err := pickBooter()
 	if err != nil {
 		flag.Usage()
 		fmt.Fprintf(os.Stderr, "\nERROR: %s\n", err)
 		os.Exit(1)
 	}
+	if *cacheDir != "" {
+		booter, err = cachingbooter.New(booter, *cacheDir, *cacheSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: setting up cache: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if *defaultCmdline != "" {
+		booter = defaultargsbooter.New(booter, *defaultCmdline, false)
+	}
+	switch {
+	case *oneShotState != "":
+		if booter, err = oneshotbooter.NewPersistent(booter, *oneShotState); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: reading -once-state: %s\n", err)
+			os.Exit(1)
+		}
+	case *oneShot:
+		booter = oneshotbooter.New(booter)
+	}
+	// Outermost, so that machines that keep failing don't use up
+	// their -once netboot.
+	if *maxBootFailures > 0 {
+		booter = failbooter.New(booter, *maxBootFailures)
+	}
+	go reloadOnSIGHUP(booter, macFilter)
 
 	pxelinux, err := assets.Asset("lpxelinux.0")
 	if err != nil {
@@ -92,20 +483,244 @@ func main() {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	if *ldlinuxFile != "" {
+		if ldlinux, err = http.LoadLdlinux(*ldlinuxFile); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: loading ldlinux: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	var efiLoaderBlob, efiLdlinuxBlob []byte
+	if *efiLoader != "" {
+		if efiLoaderBlob, err = ioutil.ReadFile(*efiLoader); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: reading EFI loader: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if *efiLdlinux != "" {
+		if efiLdlinuxBlob, err = http.LoadLdlinux(*efiLdlinux); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: reading EFI ldlinux: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	loaders, err := readLoaders(*loaderFiles)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: reading -loaders: %s\n", err)
+		os.Exit(1)
+	}
+	types, err := parseContentTypes(*contentTypes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: parsing -content-types: %s\n", err)
+		os.Exit(1)
+	}
+	modules, err := readModules(*moduleDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: reading -syslinux-modules: %s\n", err)
+		os.Exit(1)
+	}
+	static, err := readStatic(*staticDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: reading -static-dir: %s\n", err)
+		os.Exit(1)
+	}
+	// Machines we have no loader for are better off falling through
+	// to their next boot method.
+	arches := []uint16{pxe.ArchIA32}
+	if efiLoaderBlob != nil || loaders[pxe.ArchEFIx64] != nil {
+		arches = append(arches, pxe.ArchEFIx64, pxe.ArchEFIx64HTTP)
+	}
+	for arch := range loaders {
+		arches = append(arches, arch)
+	}
+
+	var onboardingCfg, onboardingIPXE []byte
+	if *onboardingConfig != "" {
+		if onboardingCfg, err = ioutil.ReadFile(*onboardingConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: reading onboarding config: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if *onboardingScript != "" {
+		if onboardingIPXE, err = ioutil.ReadFile(*onboardingScript); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: reading onboarding script: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	if *dhcp6Enable && efiLoaderBlob == nil && loaders[pxe.ArchEFIx64] == nil {
+		fmt.Fprintf(os.Stderr, "ERROR: -dhcp6 needs an x64 UEFI loader, from -efi-loader or -loaders\n")
+		os.Exit(1)
+	}
+	var pool *dhcp.Pool
+	if *dhcpRange != "" {
+		if pool, err = parsePool(); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	dhcpBooter := booter
+	if onboardingCfg != nil || onboardingIPXE != nil {
+		dhcpBooter = onboardingBooter{booter}
+	}
+	if macFilter != nil {
+		dhcpBooter = filteredBooter{dhcpBooter, macFilter}
+	}
+
+	httpServer := &http.Server{
+		Port:             *portHTTP,
+		BindAddr:         *bindAddr,
+		AdvertiseIP:      net.ParseIP(*advertiseIP),
+		Booter:           booter,
+		Ldlinux:          ldlinux,
+		EFILoader:        efiLoaderBlob,
+		EFILdlinux:       efiLdlinuxBlob,
+		Loaders:          loaders,
+		Modules:          modules,
+		Static:           static,
+		OnboardingConfig: string(onboardingCfg),
+		OnboardingScript: string(onboardingIPXE),
+		Pprof:            *pprofEnable,
+		SigningKeyFile:   *signingKeyFile,
+		MaxTransfers:     *maxTransfers,
+		ContentAddressed: *contentAddressed,
+		ContentTypes:     types,
+		CertFile:         *tlsCert,
+		KeyFile:          *tlsKey,
+		BootMessage:      http.Limerick,
+		DryRun:           *dryRun,
+		FileRetries:      *fileRetries,
+		MaxFileSize:      *maxFileSize,
+		PathPrefix:       *httpPrefix,
+		WriteTimeout:     *httpWriteTimeout,
+		RetryDelay:       *retryDelay,
+		RetryJitter:      *retryJitter,
+		MACFilter:        macFilter,
+		Sites:            sites,
+	}
+	if pool != nil {
+		httpServer.Leases = pool.Leases
+	}
+	switch {
+	case *fallbackConfig != "":
+		cfg, err := ioutil.ReadFile(*fallbackConfig)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: reading fallback config: %s\n", err)
+			os.Exit(1)
+		}
+		httpServer.Fallback, httpServer.FallbackConfig = http.FallbackCustom, string(cfg)
+	case *fallback == "disk":
+	case *fallback == "reboot":
+		httpServer.Fallback = http.FallbackReboot
+	default:
+		flag.Usage()
+		fmt.Fprintf(os.Stderr, "\nERROR: unknown -fallback %q\n", *fallback)
+		os.Exit(1)
+	}
+	if *fileURLBase != "" {
+		httpServer.FileURL = http.BaseURL(*fileURLBase)
+	}
+	switch *accessLog {
+	case "":
+	case "-":
+		httpServer.AccessLog = os.Stdout
+	default:
+		f, err := os.OpenFile(*accessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: opening access log: %s\n", err)
+			os.Exit(1)
+		}
+		httpServer.AccessLog = f
+	}
+	// Only override the limerick if asked to, so that
+	// -boot-message="" can turn the message off entirely.
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "boot-message" {
+			httpServer.BootMessage = *bootMessage
+		}
+	})
+	// Listen first, so that the PXE and DHCPv6 servers point clients
+	// at the port we actually got, which the OS picks if -port-http
+	// is 0.
+	addr, err := httpServer.Listen()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	httpPort := addr.(*net.TCPAddr).Port
+
+	pxeServer := &pxe.Server{
+		Port:            *portPXE,
+		HTTPPort:        httpPort,
+		BindAddr:        *bindAddr,
+		HTTPScheme:      httpScheme,
+		HTTPPathPrefix:  *httpPrefix,
+		SupportedArches: arches,
+		RebootTimeout:   *rebootTimeout,
+		RateLimit:       *pxeRateLimit,
+		InterfaceIPTTL:  *interfaceIPTTL,
+		ReadBufferSize:  *pxeBufferSize,
+		MACFilter:       macFilter,
+		Sites:           sites,
+
+		LegacyBootOptions: *legacyBootOptions,
+		DumpPackets:       *pxeDump,
+	}
+	if *advertiseIP != "" {
+		pxeServer.AdvertiseIP = net.ParseIP(*advertiseIP)
+	}
+	if *pxeInterfaces != "" {
+		pxeServer.Interfaces = strings.Split(*pxeInterfaces, ",")
+	}
+	dhcpServer := &dhcp.Server{
+		Port:            *portDHCP,
+		Booter:          dhcpBooter,
+		SupportedArches: arches,
+		HTTPBootURL:     pxeServer.HTTPBootURL,
+		InterfaceIPTTL:  *interfaceIPTTL,
+	}
 
 	go func() {
-		log.Fatalln(dhcp.ServeProxyDHCP(*portDHCP, booter))
+		if pool != nil {
+			log.Fatalln(dhcpServer.ServeDHCP(pool))
+		}
+		log.Fatalln(dhcpServer.ServeProxyDHCP())
 	}()
+	if *dhcp6Enable {
+		go func() {
+			log.Fatalln(dhcp6.ServeDHCPv6(*portDHCP6, dhcpBooter, pxeServer.HTTPBootURL))
+		}()
+	}
 	go func() {
-		log.Fatalln(pxe.ServePXE(*portPXE, *portHTTP))
+		log.Fatalln(pxeServer.Serve(context.Background()))
 	}()
 	go func() {
 		tftp.Log = func(msg string, args ...interface{}) { pixiecorelog.Log("TFTP", msg, args...) }
 		tftp.Debug = func(msg string, args ...interface{}) { pixiecorelog.Debug("TFTP", msg, args...) }
-		log.Fatalln(tftp.ListenAndServe("udp4", ":"+strconv.Itoa(*portTFTP), tftp.Blob(pxelinux)))
+		handler := httpServer.LoaderTFTPHandler(tftp.Blob(pxelinux))
+		if *tftpConfigs {
+			handler = httpServer.TFTPHandler(handler)
+		}
+		log.Fatalln(tftp.ListenAndServe("udp4", fmt.Sprintf(":%d", *portTFTP), handler))
 	}()
 	go func() {
-		log.Fatalln(http.ServeHTTP(*portHTTP, booter, ldlinux))
+		log.Fatalln(httpServer.Serve(context.Background()))
 	}()
-	pixiecorelog.RecordLogs(*debug)
+	pixiecorelog.RecordLogs(false)
+}
+
+// setLogLevels applies a list of log levels like
+// "debug,HTTP=error".
+func setLogLevels(spec string) error {
+	for _, s := range strings.Split(spec, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		subsystem, name := "", s
+		if i := strings.IndexByte(s, '='); i != -1 {
+			subsystem, name = s[:i], s[i+1:]
+		}
+		level, err := pixiecorelog.ParseLevel(name)
+		if err != nil {
+			return err
+		}
+		pixiecorelog.SetLevel(subsystem, level)
+	}
+	return nil
 }
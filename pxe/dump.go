@@ -0,0 +1,100 @@
+package pxe
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/danderson/pixiecore/dhcp"
+)
+
+// Names of the DHCP options PXE traffic usually carries, for packet
+// dumps.
+var optionNames = map[byte]string{
+	43:  "vendor specific",
+	53:  "message type",
+	54:  "server identifier",
+	55:  "parameter request list",
+	57:  "max message size",
+	60:  "vendor class",
+	66:  "TFTP server name",
+	67:  "boot file name",
+	77:  "user class",
+	93:  "client architecture",
+	94:  "client network interface",
+	97:  "client machine identifier",
+	175: "iPXE",
+	210: "pxelinux path prefix",
+	211: "pxelinux reboot time",
+}
+
+// Options whose values are sub-options, which get decoded too.
+var encapsulatedOptions = map[byte]bool{43: true, 175: true}
+
+// dumpPacket returns a human-readable breakdown of the DHCP packet b,
+// followed by a hex dump of it, for debugging interop problems with
+// particular firmware.
+func dumpPacket(b []byte) string {
+	var out bytes.Buffer
+	if len(b) < 240 {
+		fmt.Fprintf(&out, "  (too short to be DHCP)\n")
+	} else {
+		fmt.Fprintf(&out, "  op=%d htype=%d hlen=%d hops=%d xid=%x secs=%d flags=%#04x\n", b[0], b[1], b[2], b[3], b[4:8], int(b[8])<<8|int(b[9]), int(b[10])<<8|int(b[11]))
+		fmt.Fprintf(&out, "  ciaddr=%s yiaddr=%s siaddr=%s giaddr=%s\n", net.IP(b[12:16]), net.IP(b[16:20]), net.IP(b[20:24]), net.IP(b[24:28]))
+		hlen := int(b[2])
+		if hlen > 16 {
+			hlen = 16
+		}
+		fmt.Fprintf(&out, "  chaddr=%s sname=%q file=%q\n", net.HardwareAddr(b[28:28+hlen]), cString(b[44:108]), cString(b[108:236]))
+		if !bytes.Equal(b[236:240], dhcp.DhcpMagic) {
+			fmt.Fprintf(&out, "  (no DHCP magic cookie)\n")
+		} else {
+			dumpOptions(&out, b[240:], "  ")
+		}
+	}
+	out.WriteString(hex.Dump(b))
+	return out.String()
+}
+
+// dumpOptions writes a line for each option in b, indented by indent.
+func dumpOptions(out *bytes.Buffer, b []byte, indent string) {
+	typ, val, b, err := dhcp.NextOption(b)
+	for err == nil && typ != 255 {
+		name := optionNames[typ]
+		if name == "" {
+			name = "unknown"
+		}
+		fmt.Fprintf(out, "%soption %d (%s), %d bytes: %s\n", indent, typ, name, len(val), optionValue(val))
+		if encapsulatedOptions[typ] && indent == "  " {
+			dumpOptions(out, val, indent+"  ")
+		}
+		typ, val, b, err = dhcp.NextOption(b)
+	}
+	if err != nil {
+		fmt.Fprintf(out, "%s(malformed options: %s)\n", indent, err)
+	}
+}
+
+// optionValue formats an option value as text if it's printable, else
+// as hex.
+func optionValue(val []byte) string {
+	if len(val) == 0 {
+		return "(empty)"
+	}
+	for _, c := range val {
+		if c < 0x20 || c > 0x7e {
+			return hex.EncodeToString(val)
+		}
+	}
+	return fmt.Sprintf("%q", val)
+}
+
+// cString returns the NUL-terminated string in b.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i != -1 {
+		b = b[:i]
+	}
+	return strings.TrimSpace(string(b))
+}
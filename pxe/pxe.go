@@ -2,27 +2,290 @@ package pxe
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/net/ipv4"
+	"github.com/danderson/pixiecore/api"
 	"github.com/danderson/pixiecore/dhcp"
 	"github.com/danderson/pixiecore/log"
+	"github.com/danderson/pixiecore/metrics"
 )
 
+// Client system architectures, as advertised in DHCP option 93. See
+// RFC 4578 and the IANA "Processor Architecture Types" registry.
+const (
+	ArchIA32       = 0x00
+	ArchEFIIA32    = 0x06
+	ArchEFIx64     = 0x07
+	ArchEFIBC      = 0x09
+	ArchEFIARM32   = 0x0a
+	ArchEFIARM64   = 0x0b
+	ArchEFIx64HTTP = 0x10
+)
+
+// EFILoaderPath is the path, relative to the HTTP server, of the EFI
+// bootloader that UEFI HTTP Boot clients are pointed at.
+const EFILoaderPath = "syslinux.efi"
+
+// BIOSLoaderPath is the path, relative to the TFTP server, of the
+// bootloader that legacy BIOS clients are pointed at. The TFTP server
+// serves pxelinux under any name it doesn't have a loader for, so
+// this is mostly for the benefit of packet captures and clients that
+// check the name.
+const BIOSLoaderPath = "lpxelinux.0"
+
+// LoaderPath returns the path, relative to the TFTP and HTTP servers,
+// of the first bootloader for clients of the given architecture. BIOS
+// machines get BIOSLoaderPath, x64 UEFI machines get EFILoaderPath,
+// others get an arch-specific name.
+func LoaderPath(arch uint16) string {
+	switch arch {
+	case ArchIA32:
+		return BIOSLoaderPath
+	case ArchEFIx64, ArchEFIx64HTTP:
+		return EFILoaderPath
+	default:
+		return fmt.Sprintf("loader-%d.efi", arch)
+	}
+}
+
 type PXEPacket struct {
 	dhcp.DHCPPacket
 	ClientIP net.IP
 	// The boot type requested by the client. We need to mirror this
 	// in the PXE reply.
 	BootType []byte
+	// All PXE vendor sub-options (option 43) sent by the client,
+	// keyed by sub-option code.
+	VendorOptions map[byte][]byte
+	// The options the client asked for in option 55, or nil if it
+	// didn't send a list.
+	RequestedOptions []byte
+	// The client's user class, from option 77.
+	UserClass string
+	// Feature flags advertised by iPXE in option 175, keyed by
+	// sub-option code (see the IPXEFeature constants). Nil if the
+	// client didn't send any.
+	IPXEFeatures map[byte][]byte
+	// If boot fails, how long pxelinux should wait before rebooting
+	// to try again. Zero or less means don't reboot.
+	RebootTimeout time.Duration
+	// Whether to repeat the TFTP server and boot file name in options
+	// 66 and 67, for firmware that ignores the BOOTP header fields.
+	LegacyBootOptions bool
 
 	HTTPServer string
 }
 
+// A BootItem is an entry in a PXE boot menu.
+type BootItem = dhcp.BootItem
+
+// IsIPXE returns true if the client is already running iPXE, as
+// opposed to a raw PXE ROM. Clients already in iPXE must be given a
+// boot script rather than another bootloader, else they'd chainload
+// forever.
+func (p *PXEPacket) IsIPXE() bool {
+	// iPXE sends a bare "iPXE" rather than the RFC 3004 encoding,
+	// but accept both.
+	return p.UserClass == "iPXE" || p.UserClass == "\x04iPXE"
+}
+
+// Profile returns the boot profile the client asked for with its user
+// class, or "" if it didn't ask for one. See api.ProfileBooter.
+func (p *PXEPacket) Profile() string {
+	if p.IsIPXE() || p.UserClass == "" {
+		return ""
+	}
+	class := p.UserClass
+	if int(class[0]) == len(class)-1 {
+		// RFC 3004 encoding, a list of length-prefixed classes. A
+		// list of one is all we understand.
+		class = class[1:]
+	}
+	if !ValidProfile(class) {
+		return ""
+	}
+	return class
+}
+
+// ValidProfile returns true if name is acceptable as a boot profile
+// name: up to 64 letters, digits, dots, dashes and underscores.
+func ValidProfile(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// iPXE feature sub-options of option 175.
+const (
+	IPXEFeaturePXEExt  = 0x10
+	IPXEFeatureHTTP    = 0x13
+	IPXEFeatureHTTPS   = 0x14
+	IPXEFeatureTFTP    = 0x15
+	IPXEFeatureBzImage = 0x18
+	IPXEFeatureEFI     = 0x24
+)
+
+// IPXESupports returns true if iPXE advertised the given feature. If
+// it didn't send any feature flags at all, all features are assumed
+// to be present.
+func (p *PXEPacket) IPXESupports(feature byte) bool {
+	if p.IPXEFeatures == nil {
+		return true
+	}
+	v, ok := p.IPXEFeatures[feature]
+	return ok && (len(v) == 0 || v[0] != 0)
+}
+
+// useIPXEScript returns true if the client is iPXE, and able to fetch
+// its boot script from our HTTP server. iPXE builds without support
+// for the server's URL scheme get chainloaded to pxelinux instead.
+func (p *PXEPacket) useIPXEScript() bool {
+	if !p.IsIPXE() {
+		return false
+	}
+	if strings.HasPrefix(p.HTTPServer, "https:") {
+		return p.IPXESupports(IPXEFeatureHTTPS)
+	}
+	return p.IPXESupports(IPXEFeatureHTTP)
+}
+
+// How often Serve wakes up from reading the socket to check whether
+// it should stop.
+const pollInterval = time.Second
+
+// DefaultRebootTimeout is how long pxelinux waits before rebooting
+// after a failed boot, unless configured otherwise.
+const DefaultRebootTimeout = 5 * time.Second
+
+// DefaultRateLimit is the number of replies per second a single
+// client gets, if Server.RateLimit is unset. Well-behaved clients send
+// one or two requests per boot, so this only kicks in for clients
+// stuck in a loop.
+const DefaultRateLimit = 5
+
+// A Server answers PXE boot requests, chainloading clients into
+// pxelinux served over HTTP.
+type Server struct {
+	// Port to listen on for PXE requests.
+	Port int
+	// Address to listen on, as a host or host:port. If it includes a
+	// port, it overrides Port. If empty, listen on all addresses.
+	// Replies still point clients at the address of the interface
+	// the request came in on.
+	BindAddr string
+	// If set, the address clients are told to talk to, in the DHCP
+	// server identifier and HTTP URLs, e.g. a load balancer in front
+	// of us. If unset, the address of the interface the request came
+	// in on is used.
+	AdvertiseIP net.IP
+	// Port of the HTTP server that clients get chainloaded to.
+	HTTPPort int
+	// URL scheme of the HTTP server, "http" or "https". Defaults to
+	// "http".
+	HTTPScheme string
+	// Path under which the HTTP server serves everything, e.g.
+	// "/pixiecore/". Defaults to "/".
+	HTTPPathPrefix string
+	// Interfaces to serve PXE on, by name (e.g. "eth1") or index. If
+	// set, requests arriving on other interfaces are ignored. If
+	// empty, all interfaces are served.
+	Interfaces []string
+	// Client architectures (see the Arch constants) we can boot,
+	// i.e. that the TFTP and HTTP servers have a loader for at
+	// LoaderPath. If set, clients of other architectures don't get
+	// chainloaded, and fall through to their next boot method. If
+	// empty, all architectures are chainloaded.
+	SupportedArches []uint16
+	// How long pxelinux waits before rebooting to try again, if
+	// boot fails. Zero means DefaultRebootTimeout, negative means
+	// never reboot.
+	RebootTimeout time.Duration
+	// Boot menu offered to clients that haven't selected a boot item
+	// yet. If empty, such clients get a single-entry menu that boots
+	// straight away.
+	BootMenu []BootItem
+	// How long clients display BootMenu before picking the first
+	// entry.
+	BootMenuTimeout time.Duration
+	// Maximum number of replies per second sent to any one client,
+	// identified by MAC address or IP address. Zero means
+	// DefaultRateLimit, negative means unlimited.
+	RateLimit int
+	// How long to remember the address of each interface we reply
+	// from. Zero means dhcp.DefaultInterfaceIPTTL, negative means
+	// look it up for every request.
+	InterfaceIPTTL time.Duration
+	// If set, only machines the filter allows get a reply.
+	MACFilter *api.MACFilter
+	// Size of the buffer requests are read into. Bigger requests get
+	// truncated. Zero means dhcp.DefaultReadBufferSize().
+	ReadBufferSize int
+	// If set, replies to PXE ROMs also name the TFTP server and boot
+	// file in options 66 and 67. Some old firmware only looks there,
+	// but iPXE can get confused by them, so they're off by default
+	// and never sent to clients already running iPXE.
+	LegacyBootOptions bool
+	// If set, called after each reply that points a machine at its
+	// next stage of booting, with the machine's MAC address and its
+	// current IP address (which is unspecified if it doesn't have
+	// one yet). The Server doesn't answer other requests until it
+	// returns. The hook owns its arguments, and may keep them.
+	OnChainload func(mac net.HardwareAddr, clientIP net.IP)
+	// If set, log a decoded dump of every request and reply, at
+	// debug level. It's a lot of output, only meant for figuring out
+	// why some firmware won't boot.
+	DumpPackets bool
+	// If set, log entries and metrics about each machine are tagged
+	// with the site it's at.
+	Sites *SiteMap
+}
+
 func ServePXE(pxePort, httpPort int) error {
-	conn, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", pxePort))
+	return ServePXEContext(context.Background(), pxePort, httpPort)
+}
+
+// ServePXEContext is like ServePXE, but closes the socket and returns
+// ctx.Err() when ctx is cancelled.
+func ServePXEContext(ctx context.Context, pxePort, httpPort int) error {
+	s := &Server{
+		Port:     pxePort,
+		HTTPPort: httpPort,
+	}
+	return s.Serve(ctx)
+}
+
+// Serve answers PXE requests until ctx is cancelled, at which point
+// it closes the socket and returns ctx.Err().
+func (s *Server) Serve(ctx context.Context) error {
+	pxePort := s.Port
+	limit := s.RateLimit
+	if limit == 0 {
+		limit = DefaultRateLimit
+	}
+	limiter := newRateLimiter(limit)
+	ttl := s.InterfaceIPTTL
+	if ttl == 0 {
+		ttl = dhcp.DefaultInterfaceIPTTL
+	}
+	ips := dhcp.NewInterfaceIPCache(ttl)
+
+	conn, err := net.ListenPacket("udp4", dhcp.ListenAddr(s.BindAddr, pxePort))
 	if err != nil {
 		return err
 	}
@@ -32,82 +295,347 @@ func ServePXE(pxePort, httpPort int) error {
 		return err
 	}
 
-	log.Log("PXE", "Listening on port %d", pxePort)
-	buf := make([]byte, 1024)
+	log.Log("PXE", "Listening on %s", conn.LocalAddr())
+	bufSize := s.ReadBufferSize
+	if bufSize <= 0 {
+		bufSize = dhcp.DefaultReadBufferSize()
+	}
+	buf := make([]byte, bufSize)
 	for {
+		if err = ctx.Err(); err != nil {
+			log.Log("PXE", "Shutting down")
+			return err
+		}
+		if err = l.SetReadDeadline(time.Now().Add(pollInterval)); err != nil {
+			return err
+		}
 		n, msg, addr, err := l.ReadFrom(buf)
 		if err != nil {
-			log.Log("PXE", "Error reading from socket: %s", err)
+			if t, ok := err.(net.Error); ok && t.Timeout() {
+				continue
+			}
+			log.Error("PXE", "Error reading from socket: %s", err)
+			continue
+		}
+		if n == len(buf) {
+			log.Log("PXE", "Packet from %s filled the %d byte read buffer, it was probably truncated. Consider a bigger ReadBufferSize", addr, len(buf))
+		}
+
+		if s.DumpPackets {
+			log.Debug("PXE", "Received %d bytes from %s on interface %d:\n%s", n, addr, msg.IfIndex, dumpPacket(buf[:n]))
+		}
+
+		if !s.servesInterface(msg.IfIndex) {
+			log.Debug("PXE", "Ignoring packet from %s on interface %d, not in the list of served interfaces", addr, msg.IfIndex)
 			continue
 		}
 
 		req, err := ParsePXE(buf[:n])
 		if err != nil {
-			log.Debug("PXE", "ParsePXE: %s", err)
+			log.Debug("PXE", "ParsePXE: %s (packet: %x)", err, buf[:n])
+			continue
+		}
+		// Relayed requests come from the relay, which sits on the
+		// client's subnet, so the source address is good enough for
+		// clients that don't have an address yet.
+		siteIP := req.ClientIP
+		if siteIP == nil || siteIP.IsUnspecified() {
+			siteIP = addr.(*net.UDPAddr).IP
+		}
+		site := s.Sites.Site(siteIP)
+		log.WithSite(site).Debug("PXE", "%s (%s) has vendor class %q", req.MAC, req.ClientIP, req.VendorClass)
+		if arch, ok := dhcp.VendorClassArch(req.VendorClass); ok && arch != req.Arch {
+			log.Debug("PXE", "%s (%s) claims architecture %s in its vendor class, but %s in option 93; trusting option 93", req.MAC, req.ClientIP, ArchName(arch), ArchName(req.Arch))
+		}
+
+		if !s.MACFilter.Allows(req.MAC) {
+			log.WithSite(site).Log("PXE", "Ignoring %s (%s), its MAC address is not allowed", req.MAC, req.ClientIP)
 			continue
 		}
 
-		req.ServerIP, err = dhcp.InterfaceIP(msg.IfIndex)
+		if !s.supportsArch(req.Arch) {
+			// Chainloading would only get the machine stuck in a
+			// bootloader it can't run. Staying silent makes the
+			// firmware give up on us and boot from disk.
+			log.WithSite(site).Log("PXE", "Not chainloading %s (%s), its architecture %s is not supported", req.MAC, req.ClientIP, ArchName(req.Arch))
+			continue
+		}
+
+		keys := []string{req.MAC.String()}
+		if req.RelayIP == nil {
+			// Every client behind a relay shares its source
+			// address, so only limit by IP for local clients.
+			keys = append(keys, addr.(*net.UDPAddr).IP.String())
+		}
+		if !limiter.allow(keys...) {
+			log.Debug("PXE", "Not replying to %s (%s), it exceeded %d requests per second", req.MAC, addr, limit)
+			continue
+		}
+
+		if s.AdvertiseIP != nil {
+			req.ServerIP = s.AdvertiseIP.To4()
+		} else {
+			req.ServerIP, err = ips.InterfaceIP(msg.IfIndex)
+		}
 		if err != nil {
-			log.Log("PXE", "Couldn't find an IP address to use to reply to %s: %s", req.MAC, err)
+			log.Error("PXE", "Couldn't find an IP address to use to reply to %s: %s", req.MAC, err)
 			continue
 		}
-		req.HTTPServer = fmt.Sprintf("http://%s:%d/", req.ServerIP, httpPort)
+		if s.RebootTimeout != 0 {
+			req.RebootTimeout = s.RebootTimeout
+		}
+		req.BootMenu, req.BootMenuTimeout = s.BootMenu, s.BootMenuTimeout
+		req.LegacyBootOptions = s.LegacyBootOptions
+		// Tag everything this boot fetches from the HTTP server, so
+		// that its log entries can be tied back to this reply.
+		id := log.NewBootID(req.MAC)
+		if profile := req.Profile(); profile != "" {
+			log.WithBoot(id).WithSite(site).Debug("PXE", "%s (%s) asked for boot profile %q", req.MAC, req.ClientIP, profile)
+		}
+		req.HTTPServer = s.httpServer(req.ServerIP, id, req.Profile(), req.Arch)
 
-		log.Log("PXE", "Chainloading %s (%s) to pxelinux (via %s)", req.MAC, req.ClientIP, req.ServerIP)
+		switch {
+		case req.IsHTTPBoot():
+			log.WithBoot(id).WithSite(site).Log("PXE", "Pointing UEFI HTTP Boot client %s (%s) at %s%s", req.MAC, req.ClientIP, req.HTTPServer, LoaderPath(req.Arch))
+		case req.useIPXEScript():
+			log.WithBoot(id).WithSite(site).Log("PXE", "Pointing iPXE on %s (%s) at its boot script (via %s)", req.MAC, req.ClientIP, req.ServerIP)
+		case req.IsIPXE():
+			log.WithBoot(id).WithSite(site).Log("PXE", "iPXE on %s (%s) can't fetch %s, chainloading it to pxelinux (via %s)", req.MAC, req.ClientIP, req.HTTPServer, req.ServerIP)
+		case req.BootType == nil:
+			log.WithBoot(id).WithSite(site).Log("PXE", "Offering boot menu to %s (%s)", req.MAC, req.ClientIP)
+		case req.IsUEFI():
+			log.WithBoot(id).WithSite(site).Log("PXE", "Chainloading %s (%s) to %s (via %s)", req.MAC, req.ClientIP, LoaderPath(req.Arch), req.ServerIP)
+		default:
+			log.WithBoot(id).WithSite(site).Log("PXE", "Chainloading %s (%s) to pxelinux (via %s)", req.MAC, req.ClientIP, req.ServerIP)
+		}
 
-		if _, err := l.WriteTo(ReplyPXE(req), &ipv4.ControlMessage{
+		dst := addr
+		if req.RelayIP != nil {
+			// The relay passes the reply on to the client.
+			dst = &net.UDPAddr{IP: req.RelayIP, Port: 67}
+		}
+		reply := ReplyPXE(req)
+		if s.DumpPackets {
+			log.WithBoot(id).WithSite(site).Debug("PXE", "Sending %d bytes to %s on interface %d:\n%s", len(reply), dst, msg.IfIndex, dumpPacket(reply))
+		}
+		if _, err := l.WriteTo(reply, &ipv4.ControlMessage{
 			IfIndex: msg.IfIndex,
-		}, addr); err != nil {
-			log.Log("PXE", "Responding to %s: %s", req.MAC, err)
+		}, dst); err != nil {
+			log.WithBoot(id).WithSite(site).Error("PXE", "Responding to %s: %s", req.MAC, err)
 			continue
 		}
+		metrics.PXERequests.Inc()
+		if site != "" {
+			metrics.SitePXERequests.Inc(string(site))
+		}
+		// Clients that haven't selected a boot item (BootType is
+		// nil) get offered the boot menu, which doesn't chainload
+		// anything: the client comes back once the user picks an
+		// item. HTTP Boot clients don't go through the PXE menu at
+		// all.
+		menu := req.BootType == nil && !req.IsHTTPBoot()
+		if s.OnChainload != nil && !menu {
+			// req points into the read buffer, which the next
+			// request overwrites, so the hook gets copies it can
+			// keep.
+			s.OnChainload(append(net.HardwareAddr(nil), req.MAC...), append(net.IP(nil), req.ClientIP...))
+		}
 	}
 }
 
-func ReplyPXE(p *PXEPacket) []byte {
-	var b bytes.Buffer
+// httpServer returns the HTTP server URL that a client with the given
+// boot ID, profile and architecture gets pointed at, when it reached
+// us on serverIP.
+func (s *Server) httpServer(serverIP net.IP, id log.BootID, profile string, arch uint16) string {
+	scheme := s.HTTPScheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	prefix := "/"
+	if p := strings.Trim(s.HTTPPathPrefix, "/"); p != "" {
+		prefix = "/" + p + "/"
+	}
+	host := net.JoinHostPort(serverIP.String(), strconv.Itoa(s.HTTPPort))
+	ret := fmt.Sprintf("%s://%s%sid/%s/", scheme, host, prefix, id)
+	if profile != "" {
+		ret += fmt.Sprintf("profile/%s/", profile)
+	}
+	if arch != ArchIA32 {
+		// Let the HTTP server know what it's talking to, so it can
+		// pick an architecture-specific boot spec.
+		ret += fmt.Sprintf("arch/%d/", arch)
+	}
+	return ret
+}
 
-	// Fixed length BOOTP response
-	var bootp [236]byte
-	bootp[0] = 2     // BOOTP reply
-	bootp[1] = 1     // PHY = ethernet
-	bootp[2] = 6     // Hardware address length
-	bootp[10] = 0x80 // Please speak broadcast
-	copy(bootp[4:], p.TID)
-	copy(bootp[16:], p.ClientIP)
-	copy(bootp[20:], p.ServerIP)
-	copy(bootp[28:], p.MAC)
-	// Boot file name. Our TFTP server unconditionally serves up
-	// pxelinux no matter the name, so we just put something that
-	// looks nice in packet dumps.
-	copy(bootp[108:], "boot")
-	b.Write(bootp[:])
+// HTTPBootURL returns the URL of the loader that the UEFI HTTP Boot
+// client mac, of the given architecture, should boot when it reached
+// us on serverIP (IPv4 or IPv6). The HTTP server serves its kernel
+// there instead if the Booter says it can boot it directly.
+// It's meant for dhcp.Server.HTTPBootURL and dhcp6.ServeDHCPv6, for
+// clients that get their boot URL straight from a DHCP offer rather
+// than from us.
+func (s *Server) HTTPBootURL(mac net.HardwareAddr, arch uint16, serverIP net.IP) string {
+	if s.AdvertiseIP != nil && serverIP.To4() != nil {
+		serverIP = s.AdvertiseIP.To4()
+	}
+	return s.httpServer(serverIP, log.NewBootID(mac), "", arch) + LoaderPath(arch)
+}
 
-	// DHCP magic
-	b.Write(dhcp.DhcpMagic)
-	// Type = DHCPACK
-	b.Write([]byte{53, 1, 5})
-	// Server ID
-	b.Write([]byte{54, 4})
-	b.Write(p.ServerIP)
-	// Vendor class
-	b.Write([]byte{60, 9})
-	b.WriteString("PXEClient")
-	// Client UUID
-	b.Write([]byte{97, 17, 0})
-	b.Write(p.GUID)
+// servesInterface returns true if s should answer requests that
+// arrive on the interface with index ifIdx.
+func (s *Server) servesInterface(ifIdx int) bool {
+	if len(s.Interfaces) == 0 {
+		return true
+	}
+	name := ""
+	if iface, err := net.InterfaceByIndex(ifIdx); err == nil {
+		name = iface.Name
+	}
+	for _, want := range s.Interfaces {
+		if want == name || want == strconv.Itoa(ifIdx) {
+			return true
+		}
+	}
+	return false
+}
+
+// supportsArch returns true if the server can boot clients of the
+// given architecture.
+func (s *Server) supportsArch(arch uint16) bool {
+	if len(s.SupportedArches) == 0 {
+		return true
+	}
+	for _, a := range s.SupportedArches {
+		if a == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUEFI returns true if the client is UEFI firmware, rather than a
+// legacy BIOS.
+func (p *PXEPacket) IsUEFI() bool {
+	switch p.Arch {
+	case ArchEFIIA32, ArchEFIx64, ArchEFIBC, ArchEFIARM32, ArchEFIARM64, ArchEFIx64HTTP:
+		return true
+	}
+	return false
+}
+
+// ArchName returns a human-readable name for a client architecture.
+func ArchName(arch uint16) string {
+	switch arch {
+	case ArchIA32:
+		return "x86 BIOS"
+	case ArchEFIIA32:
+		return "x86 UEFI"
+	case ArchEFIx64:
+		return "x64 UEFI"
+	case ArchEFIBC:
+		return "EFI byte code"
+	case ArchEFIARM32:
+		return "ARM32 UEFI"
+	case ArchEFIARM64:
+		return "ARM64 UEFI"
+	case ArchEFIx64HTTP:
+		return "x64 UEFI HTTP Boot"
+	default:
+		return fmt.Sprintf("0x%04x", arch)
+	}
+}
+
+func ReplyPXE(p *PXEPacket) []byte {
+	if p.IsHTTPBoot() {
+		return replyHTTPBoot(p)
+	}
+	if p.BootType == nil {
+		return replyMenu(p)
+	}
+
+	var (
+		b        bytes.Buffer
+		bootfile string
+	)
+	switch {
+	case p.useIPXEScript():
+		// iPXE can fetch its boot script straight over HTTP.
+		bootfile = p.HTTPServer + "ipxe?mac=" + p.MAC.String()
+	case p.IsUEFI():
+		// UEFI firmware can't run pxelinux, it needs a loader built
+		// for its architecture, which our TFTP server serves under
+		// this name.
+		bootfile = LoaderPath(p.Arch)
+	default:
+		bootfile = BIOSLoaderPath
+	}
+	writeBOOTP(&b, p, bootfile)
+	writeAckOptions(&b, p, "PXEClient")
+	if p.useIPXEScript() {
+		// The script's URL can be too long for the BOOTP file field,
+		// and iPXE looks here first anyway.
+		dhcp.WriteOption(&b, 67, []byte(bootfile))
+	}
+	if p.LegacyBootOptions && !p.IsIPXE() {
+		// TFTP server name and boot file name, for firmware that
+		// doesn't look at siaddr and the BOOTP file field.
+		if p.Requested(66) {
+			dhcp.WriteOption(&b, 66, []byte(p.ServerIP.String()))
+		}
+		if p.Requested(67) {
+			dhcp.WriteOption(&b, 67, []byte(bootfile))
+		}
+	}
 	// Mirror the menu selection back at the client
-	b.Write([]byte{43, 7, 71, 4})
-	b.Write(p.BootType)
-	b.WriteByte(255)
+	vendor := []byte{71, byte(len(p.BootType))}
+	vendor = append(vendor, p.BootType...)
+	dhcp.WriteOption(&b, 43, append(vendor, 255))
 	// Pxelinux path prefix, which makes pxelinux use HTTP for
 	// everything.
-	b.Write([]byte{210, byte(len(p.HTTPServer))})
-	b.WriteString(p.HTTPServer)
-	// If boot fails, make pxelinux reboot after 5 seconds to try
+	dhcp.WriteOption(&b, 210, []byte(p.HTTPServer))
+	// If boot fails, make pxelinux reboot after a while to try
 	// again.
-	b.Write([]byte{211, 4, 0, 0, 0, 5})
+	if secs := p.RebootTimeout / time.Second; secs > 0 {
+		var timeout [4]byte
+		binary.BigEndian.PutUint32(timeout[:], uint32(secs))
+		dhcp.WriteOption(&b, 211, timeout[:])
+	}
+
+	// End DHCP options
+	b.WriteByte(255)
+
+	return b.Bytes()
+}
+
+// replyHTTPBoot constructs a reply for a UEFI HTTP Boot client. These
+// don't do PXE menus or pxelinux, they just want the URL of an EFI
+// bootloader.
+func replyHTTPBoot(p *PXEPacket) []byte {
+	var b bytes.Buffer
+	bootURL := p.HTTPServer + LoaderPath(p.Arch)
+
+	writeBOOTP(&b, p, bootURL)
+	// HTTP Boot clients ignore replies that don't identify as
+	// HTTPClient.
+	writeAckOptions(&b, p, "HTTPClient")
+	// Bootfile URL
+	dhcp.WriteOption(&b, 67, []byte(bootURL))
+
+	// End DHCP options
+	b.WriteByte(255)
+
+	return b.Bytes()
+}
+
+// replyMenu constructs a reply offering p.BootMenu to a client that
+// hasn't selected a boot item yet.
+func replyMenu(p *PXEPacket) []byte {
+	var b bytes.Buffer
+
+	writeBOOTP(&b, p, "")
+	writeAckOptions(&b, p, "PXEClient")
+	dhcp.WriteBootMenu(&b, &p.DHCPPacket)
 
 	// End DHCP options
 	b.WriteByte(255)
@@ -115,17 +643,66 @@ func ReplyPXE(p *PXEPacket) []byte {
 	return b.Bytes()
 }
 
+// Requested returns true if the client asked for option code in its
+// parameter request list, or sent no list at all.
+//
+// Replies only carry optional extras if they were requested. Options
+// the boot can't work without go in regardless: the DHCP basics, PXE
+// vendor options, and pxelinux's options 210 and 211, which the
+// firmware can't know to ask for on pxelinux's behalf.
+func (p *PXEPacket) Requested(code byte) bool {
+	return p.RequestedOptions == nil || bytes.IndexByte(p.RequestedOptions, code) != -1
+}
+
+// writeBOOTP writes the fixed length BOOTP part of a reply to p,
+// followed by the DHCP magic cookie.
+func writeBOOTP(b *bytes.Buffer, p *PXEPacket, bootfile string) {
+	var bootp [236]byte
+	bootp[0] = 2 // BOOTP reply
+	p.SetHardwareAddr(bootp[:])
+	p.SetRelay(bootp[:])
+	copy(bootp[4:], p.TID)
+	copy(bootp[16:], p.ClientIP)
+	copy(bootp[20:], p.ServerIP)
+	// The field holds 128 bytes, NUL-terminated. Rather than truncate
+	// longer names, leave them to option 67.
+	if len(bootfile) < 128 {
+		copy(bootp[108:], bootfile)
+	}
+	b.Write(bootp[:])
+	b.Write(dhcp.DhcpMagic)
+}
+
+// writeAckOptions writes the options that start every reply to p: the
+// message type, our server ID, vendorClass, and the client's UUID.
+func writeAckOptions(b *bytes.Buffer, p *PXEPacket, vendorClass string) {
+	// Type = DHCPACK
+	dhcp.WriteOption(b, 53, []byte{5})
+	dhcp.WriteOption(b, 54, p.ServerIP.To4())
+	p.WriteClientID(b)
+	dhcp.WriteOption(b, 60, []byte(vendorClass))
+	// Client UUID, with its type byte.
+	dhcp.WriteOption(b, 97, append([]byte{0}, p.GUID...))
+}
+
 func ParsePXE(b []byte) (req *PXEPacket, err error) {
 	if len(b) < 240 {
 		return nil, errors.New("packet too short")
 	}
 
+	htype, mac, err := dhcp.HardwareAddr(b)
+	if err != nil {
+		return nil, err
+	}
 	ret := &PXEPacket{
 		DHCPPacket: dhcp.DHCPPacket{
-			TID: b[4:8],
-			MAC: net.HardwareAddr(b[28:34]),
+			TID:          b[4:8],
+			MAC:          mac,
+			HardwareType: htype,
+			RelayIP:      dhcp.RelayIP(b[24:28]),
 		},
-		ClientIP: net.IP(b[12:16]),
+		ClientIP:      net.IP(b[12:16]),
+		RebootTimeout: DefaultRebootTimeout,
 	}
 
 	// We do lighter packet verification here, because the PXE port
@@ -135,34 +712,46 @@ func ParsePXE(b []byte) (req *PXEPacket, err error) {
 		return nil, fmt.Errorf("packet from %s (%s) is not a DHCP request", ret.MAC, ret.ClientIP)
 	}
 
-	typ, val, opts := dhcp.DhcpOption(b[240:])
-	for typ != 255 {
+	typ, val, opts, err := dhcp.NextOption(b[240:])
+	for err == nil && typ != 255 {
 		switch typ {
 		case 43:
-			pxeTyp, pxeVal, val := dhcp.DhcpOption(val)
-			for pxeTyp != 255 {
-				if pxeTyp == 71 {
-					ret.BootType = pxeVal
-					break
-				}
-				pxeTyp, pxeVal, val = dhcp.DhcpOption(val)
+			if ret.VendorOptions, err = dhcp.ParseOptions(val); err != nil {
+				return nil, fmt.Errorf("packet from %s (%s) has malformed option 43: %s", ret.MAC, ret.ClientIP, err)
+			}
+			ret.BootType = ret.VendorOptions[71]
+		case 55:
+			ret.RequestedOptions = append([]byte{}, val...)
+		case 60:
+			ret.VendorClass = string(val)
+		case 77:
+			ret.UserClass = string(val)
+		case 175:
+			if ret.IPXEFeatures, err = dhcp.ParseOptions(val); err != nil {
+				return nil, fmt.Errorf("packet from %s (%s) has malformed option 175: %s", ret.MAC, ret.ClientIP, err)
+			}
+		case 93:
+			// Clients may list several architectures, the first is
+			// the one they're running.
+			if len(val) < 2 || len(val)%2 != 0 {
+				return nil, fmt.Errorf("packet from %s (%s) has malformed option 93", ret.MAC, ret.ClientIP)
 			}
+			ret.Arch = binary.BigEndian.Uint16(val)
 		case 97:
 			if len(val) != 17 || val[0] != 0 {
 				return nil, fmt.Errorf("packet from %s (%s) has malformed option 97", ret.MAC, ret.ClientIP)
 			}
 			ret.GUID = val[1:]
 		}
-		typ, val, opts = dhcp.DhcpOption(opts)
+		typ, val, opts, err = dhcp.NextOption(opts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("packet from %s (%s) has malformed options: %s", ret.MAC, ret.ClientIP, err)
 	}
 
 	if ret.GUID == nil {
 		return nil, fmt.Errorf("%s (%s) is not a PXE client", ret.MAC, ret.ClientIP)
 	}
-	if ret.BootType == nil {
-		return nil, fmt.Errorf("%s (%s) hasn't selected a menu option", ret.MAC, ret.ClientIP)
-	}
-
 	// Valid PXE request!
 	return ret, nil
 }
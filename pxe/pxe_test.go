@@ -0,0 +1,137 @@
+package pxe
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/danderson/pixiecore/dhcp"
+)
+
+var testMAC = []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+
+// pxeRequest returns a port 4011 PXE request from testMAC, with the
+// given options after the client UUID.
+func pxeRequest(opts ...[]byte) []byte {
+	b := make([]byte, 240)
+	b[0] = 1 // BOOTREQUEST
+	b[1] = 1 // Ethernet
+	b[2] = 6
+	copy(b[4:8], []byte{1, 2, 3, 4})
+	copy(b[12:16], []byte{192, 168, 0, 10})
+	copy(b[28:], testMAC)
+	copy(b[236:240], dhcp.DhcpMagic)
+
+	var buf bytes.Buffer
+	buf.Write(b)
+	dhcp.WriteOption(&buf, 53, []byte{3})
+	dhcp.WriteOption(&buf, 60, []byte("PXEClient:Arch:00000:UNDI:002001"))
+	dhcp.WriteOption(&buf, 93, []byte{0, 0})
+	dhcp.WriteOption(&buf, 97, append([]byte{0}, bytes.Repeat([]byte{0xab}, 16)...))
+	for _, o := range opts {
+		buf.Write(o)
+	}
+	buf.WriteByte(255)
+	return buf.Bytes()
+}
+
+func TestParsePXE(t *testing.T) {
+	p, err := ParsePXE(pxeRequest([]byte{43, 7, 71, 4, 0x80, 0, 0, 0, 255}))
+	if err != nil {
+		t.Fatalf("ParsePXE: %s", err)
+	}
+	if !bytes.Equal(p.MAC, testMAC) {
+		t.Errorf("MAC = %s, want %x", p.MAC, testMAC)
+	}
+	if want := []byte{0x80, 0, 0, 0}; !bytes.Equal(p.BootType, want) {
+		t.Errorf("BootType = %x, want %x", p.BootType, want)
+	}
+}
+
+func TestParsePXEArchList(t *testing.T) {
+	// A client listing x64 UEFI first, then BIOS. The option comes
+	// after pxeRequest's, so it wins.
+	p, err := ParsePXE(pxeRequest([]byte{93, 4, 0, 7, 0, 0}))
+	if err != nil {
+		t.Fatalf("ParsePXE: %s", err)
+	}
+	if p.DHCPPacket.Arch != ArchEFIx64 {
+		t.Errorf("Arch = %d, want %d", p.DHCPPacket.Arch, ArchEFIx64)
+	}
+	if _, err = ParsePXE(pxeRequest([]byte{93, 3, 0, 7, 0})); err == nil {
+		t.Error("ParsePXE accepted an odd-length option 93")
+	}
+}
+
+func TestParsePXETruncatedOption43(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  []byte
+	}{
+		// Option 43 claims more bytes than the packet has left.
+		{"outer length", []byte{43, 200, 71, 4, 0x80, 0}},
+		// Option 43 fits, but its sub-option 71 overruns it.
+		{"sub-option length", []byte{43, 4, 71, 8, 0x80, 0}},
+		// Option 43 ends between a sub-option's type and length.
+		{"sub-option type only", []byte{43, 1, 71}},
+	}
+	for _, test := range tests {
+		if p, err := ParsePXE(pxeRequest(test.opt)); err == nil {
+			t.Errorf("%s: ParsePXE accepted truncated option 43, got BootType %x", test.name, p.BootType)
+		}
+	}
+}
+
+func TestReplyPXEGolden(t *testing.T) {
+	guid := bytes.Repeat([]byte{0xab}, 16)
+	p := &PXEPacket{
+		DHCPPacket: dhcp.DHCPPacket{
+			TID:          []byte{1, 2, 3, 4},
+			MAC:          testMAC,
+			HardwareType: 1,
+			GUID:         guid,
+			ServerIP:     net.IPv4(192, 168, 0, 1).To4(),
+		},
+		ClientIP:      net.IPv4(192, 168, 0, 10).To4(),
+		BootType:      []byte{0x80, 0x00, 0x00, 0x00},
+		HTTPServer:    "http://192.168.0.1:80/",
+		RebootTimeout: 10 * time.Second,
+	}
+
+	want := make([]byte, 236)
+	want[0] = 2     // BOOTREPLY
+	want[1] = 1     // Ethernet
+	want[2] = 6     // hlen
+	want[10] = 0x80 // broadcast
+	copy(want[4:], []byte{1, 2, 3, 4})
+	copy(want[16:], []byte{192, 168, 0, 10})
+	copy(want[20:], []byte{192, 168, 0, 1})
+	copy(want[28:], testMAC)
+	copy(want[108:], "lpxelinux.0")
+	want = append(want, 99, 130, 83, 99)
+	want = append(want, 53, 1, 5)
+	want = append(want, 54, 4, 192, 168, 0, 1)
+	want = append(want, 60, 9)
+	want = append(want, "PXEClient"...)
+	want = append(want, 97, 17, 0)
+	want = append(want, guid...)
+	want = append(want, 43, 7, 71, 4, 0x80, 0x00, 0x00, 0x00, 255)
+	want = append(want, 210, 22)
+	want = append(want, "http://192.168.0.1:80/"...)
+	want = append(want, 211, 4, 0, 0, 0, 10)
+	want = append(want, 255)
+
+	if got := ReplyPXE(p); !bytes.Equal(got, want) {
+		t.Errorf("ReplyPXE:\ngot:\n%s\nwant:\n%s", hex.Dump(got), hex.Dump(want))
+	}
+
+	// Option 43's length follows the boot type's.
+	p.BootType = []byte{0x80, 0x00}
+	got := ReplyPXE(p)
+	opt43 := []byte{43, 5, 71, 2, 0x80, 0x00, 255}
+	if !bytes.Contains(got, opt43) {
+		t.Errorf("ReplyPXE with a 2 byte boot type doesn't contain %x:\n%s", opt43, hex.Dump(got))
+	}
+}
@@ -0,0 +1,42 @@
+package pxe
+
+import "time"
+
+// rateLimiter counts events per key in one-second windows. It's only
+// used from the Serve loop, so it needs no locking.
+type rateLimiter struct {
+	limit  int
+	window time.Time
+	counts map[string]int
+}
+
+// newRateLimiter returns a limiter allowing limit events per second
+// for each key. A negative limit allows everything.
+func newRateLimiter(limit int) *rateLimiter {
+	return &rateLimiter{
+		limit:  limit,
+		counts: map[string]int{},
+	}
+}
+
+// allow records an event for each of keys, and returns false if any
+// of them has gone over the limit in the current window.
+func (l *rateLimiter) allow(keys ...string) bool {
+	if l.limit < 0 {
+		return true
+	}
+	// Starting a fresh map for every window also forgets about
+	// clients we haven't heard from in a while.
+	if now := time.Now().Truncate(time.Second); !now.Equal(l.window) {
+		l.window = now
+		l.counts = map[string]int{}
+	}
+	ok := true
+	for _, k := range keys {
+		l.counts[k]++
+		if l.counts[k] > l.limit {
+			ok = false
+		}
+	}
+	return ok
+}
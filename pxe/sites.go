@@ -0,0 +1,90 @@
+package pxe
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/danderson/pixiecore/log"
+)
+
+// UnknownSite is the site of machines whose address isn't in any of a
+// SiteMap's subnets.
+const UnknownSite log.Site = "unknown"
+
+// A SiteMap says which site (e.g. datacenter) machines are at, based
+// on the subnet their address is in, for tagging logs and metrics.
+type SiteMap struct {
+	// Most specific subnets first, so the first match is the best.
+	subnets []siteSubnet
+}
+
+type siteSubnet struct {
+	net  *net.IPNet
+	site log.Site
+}
+
+// ParseSiteMap reads a SiteMap from r, which has one subnet per line
+// followed by its site name, e.g. "10.1.0.0/16 dc1". Blank lines and
+// lines starting with # are ignored. When subnets overlap, the most
+// specific one wins.
+func ParseSiteMap(r io.Reader) (*SiteMap, error) {
+	ret := &SiteMap{}
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		fs := strings.Fields(s.Text())
+		if len(fs) == 0 || strings.HasPrefix(fs[0], "#") {
+			continue
+		}
+		if len(fs) != 2 {
+			return nil, fmt.Errorf("line %d: want \"subnet site\", got %q", line, s.Text())
+		}
+		_, subnet, err := net.ParseCIDR(fs[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		ret.subnets = append(ret.subnets, siteSubnet{subnet, log.Site(fs[1])})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(ret.subnets, func(i, j int) bool {
+		a, _ := ret.subnets[i].net.Mask.Size()
+		b, _ := ret.subnets[j].net.Mask.Size()
+		return a > b
+	})
+	return ret, nil
+}
+
+// LoadSiteMap reads a SiteMap from the file at path, see ParseSiteMap.
+func LoadSiteMap(path string) (*SiteMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := ParseSiteMap(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return m, nil
+}
+
+// Site returns the site of the machine at ip, or UnknownSite if ip
+// isn't in any of m's subnets. A nil SiteMap has no sites at all, and
+// returns "", which log entries ignore.
+func (m *SiteMap) Site(ip net.IP) log.Site {
+	if m == nil {
+		return ""
+	}
+	for _, s := range m.subnets {
+		if s.net.Contains(ip) {
+			return s.site
+		}
+	}
+	return UnknownSite
+}
@@ -0,0 +1,43 @@
+// Package staticbooter provides a Booter that boots every machine
+// into the same local kernel and initrds.
+package staticbooter
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/danderson/pixiecore/api"
+)
+
+// NewStatic returns a Booter that boots all machines with the given
+// kernel, initrds and commandline. It checks that all the files exist
+// and are readable, so that mistakes show up at startup rather than
+// when the first machine tries to boot.
+func NewStatic(kernelPath string, initrdPaths []string, cmdline string) (api.Booter, error) {
+	if err := checkFile("kernel", kernelPath); err != nil {
+		return nil, err
+	}
+	for _, p := range initrdPaths {
+		if err := checkFile("initrd", p); err != nil {
+			return nil, err
+		}
+	}
+	return api.StaticBooter(kernelPath, initrdPaths, cmdline), nil
+}
+
+// checkFile verifies that path is a readable regular file.
+func checkFile(what, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cannot use %s %q: %s", what, path, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot use %s %q: %s", what, path, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("cannot use %s %q: not a regular file", what, path)
+	}
+	return nil
+}
@@ -12,7 +12,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net"
 	"strconv"
@@ -24,11 +23,14 @@ const numRetries = 5
 type rrq struct {
 	Filename  string
 	BlockSize int
+	// The client sent the tsize option, asking us to tell it the
+	// size of the file before the transfer starts.
+	TransferSize bool
 }
 
 // Log is called with messages of general interest.
 var Log = func(msg string, args ...interface{}) {
-	log.Printf(msg, args)
+	log.Printf(msg, args...)
 }
 
 // Debug is called with messages relevant to debugging or tracing the
@@ -73,6 +75,12 @@ func ListenAndServe(family, addr string, handler Handler) error {
 	return nil
 }
 
+// ServeTFTP serves blob to every TFTP client that asks for a file on
+// the given port, regardless of the requested filename.
+func ServeTFTP(port int, blob []byte) error {
+	return ListenAndServe("udp4", fmt.Sprintf(":%d", port), Blob(blob))
+}
+
 // transfer handles a full TFTP transaction with a client.
 func transfer(addr net.Addr, req *rrq, handler Handler) {
 	conn, err := net.Dial("udp4", addr.String())
@@ -90,13 +98,25 @@ func transfer(addr net.Addr, req *rrq, handler Handler) {
 	}
 	defer f.Close()
 
+	size := int64(-1)
+	if s, ok := f.(sizer); ok {
+		size = s.Size()
+	}
+
 	bsize := 512
-	if req.BlockSize > 0 {
-		// OACK the blocksize option, ignore all others. Blocksize is
-		// implemented purely because it cuts the roundtrip count 3x.
-		bsize = req.BlockSize
+	if req.BlockSize > 0 || (req.TransferSize && size >= 0) {
+		// OACK the blocksize and tsize options, ignore all
+		// others. Blocksize is implemented purely because it cuts the
+		// roundtrip count 3x, and tsize lets clients size their
+		// buffers up front.
 		pkt := []byte{0, 6}
-		pkt = append(pkt, fmt.Sprintf("blksize\x00%d\x00", req.BlockSize)...)
+		if req.BlockSize > 0 {
+			bsize = req.BlockSize
+			pkt = append(pkt, fmt.Sprintf("blksize\x00%d\x00", req.BlockSize)...)
+		}
+		if req.TransferSize && size >= 0 {
+			pkt = append(pkt, fmt.Sprintf("tsize\x00%d\x00", size)...)
+		}
 		if err := sendPacket(conn, pkt, 0); err != nil {
 			// Some PXE ROMs seem to request a transfer with the tsize
 			// option to try and size a buffer, and immediately abort
@@ -109,6 +129,7 @@ func transfer(addr net.Addr, req *rrq, handler Handler) {
 	}
 
 	seq := uint16(1)
+	sent := 0
 	buf := make([]byte, bsize+4)
 	buf[1] = 3
 	for {
@@ -124,18 +145,33 @@ func transfer(addr net.Addr, req *rrq, handler Handler) {
 			return
 		}
 		seq++
+		sent += n
 		if n < bsize {
 			// Transfer complete, we're done.
-			Log("Sent %q to %s", req.Filename, addr)
+			Log("Sent %q to %s (%d bytes)", req.Filename, addr, sent)
 			return
 		}
 	}
 }
 
+// A sizer knows the total size of the byte stream it provides. If a
+// Handler's ReadCloser implements it, the server can answer the tsize
+// option.
+type sizer interface {
+	Size() int64
+}
+
+// blobReader serves a byte slice, and knows its size.
+type blobReader struct {
+	*bytes.Reader
+}
+
+func (blobReader) Close() error { return nil }
+
 // Blob returns a handler that serves b for all paths and clients.
 func Blob(b []byte) Handler {
 	return func(string, net.Addr) (io.ReadCloser, error) {
-		return ioutil.NopCloser(bytes.NewBuffer(b)), nil
+		return blobReader{bytes.NewReader(b)}, nil
 	}
 }
 
@@ -227,6 +263,10 @@ func parseRRQ(addr net.Addr, b []byte) (req *rrq, err error) {
 			return nil, fmt.Errorf("%s sent non-integer %q for option %q", addr, valStr, opt)
 		}
 		switch opt {
+		case "tsize":
+			// Clients send tsize=0 in requests, asking us to fill in
+			// the real size in the OACK.
+			req.TransferSize = true
 		case "blksize":
 			if val < 8 || val > 65464 {
 				return nil, fmt.Errorf("%s requested unsupported blocksize %q", addr, val)